@@ -0,0 +1,157 @@
+// Package client is the Go client of the karma8 gateway API. It streams
+// uploads and downloads without buffering whole files, retries failed
+// requests with backoff and resumes interrupted downloads.
+//
+// It only depends on the standard library, so that services can import it
+// without pulling in the gateway's dependencies.
+package client
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header names understood by the gateway.
+const (
+	apiKeyHeader    = "X-API-Key"
+	requestIDHeader = "X-Request-ID"
+)
+
+type Config struct {
+	// URL is the gateway address, such as http://localhost:8080.
+	URL string
+	// APIKey or Token authenticate the requests when set.
+	APIKey string
+	Token  string
+
+	// HTTPClient sends the requests, http.DefaultClient if nil. Transfers
+	// of large files take long, so it should not set an overall timeout;
+	// requests are bounded by their context instead.
+	HTTPClient *http.Client
+
+	// MaxRetries is how many times a failed request is retried. Requests
+	// are retried on network errors, 5xx and 429 responses, after a delay
+	// of RetryBackoff that doubles on every retry up to RetryMaxBackoff, or
+	// what the gateway asks for in Retry-After. Uploads are retried on
+	// fewer errors; see Client.Upload.
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		URL:             "http://localhost:8080",
+		MaxRetries:      3,
+		RetryBackoff:    200 * time.Millisecond,
+		RetryMaxBackoff: 5 * time.Second,
+	}
+}
+
+// Client talks to the gateway API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	config     Config
+	httpClient *http.Client
+}
+
+func New(config Config) *Client {
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL:    strings.TrimSuffix(config.URL, "/"),
+		config:     config,
+		httpClient: httpClient,
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.config.APIKey != "" {
+		req.Header.Set(apiKeyHeader, c.config.APIKey)
+	}
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+
+	return req, nil
+}
+
+// send sends one request and turns error statuses into an *Error.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, newError(resp)
+	}
+
+	return resp, nil
+}
+
+// retry calls attempt until it succeeds, fails with an error that is not
+// worth retrying or the retries run out.
+func (c *Client) retry(ctx context.Context, attempt func() error) error {
+	backoff := c.config.RetryBackoff
+
+	for retries := 0; ; retries++ {
+		err := attempt()
+		if err == nil || retries >= c.config.MaxRetries || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+
+		delay := jitter(backoff)
+		if apiErr, ok := asError(err); ok && apiErr.RetryAfter > 0 {
+			delay = apiErr.RetryAfter
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+		if c.config.RetryMaxBackoff > 0 && backoff > c.config.RetryMaxBackoff {
+			backoff = c.config.RetryMaxBackoff
+		}
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(url string) *Client {
+	config := DefaultConfig()
+	config.URL = url
+	config.APIKey = "key"
+	config.RetryBackoff = time.Millisecond
+	return New(config)
+}
+
+func TestUpload(t *testing.T) {
+	content := []byte("some file content")
+	var attempts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		if r.Header.Get(apiKeyHeader) != "key" {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if r.ContentLength <= int64(len(content)) {
+			http.Error(w, "expected a Content-Length", http.StatusLengthRequired)
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uploaded, _ := io.ReadAll(file)
+		if header.Filename != "a.txt" || !bytes.Equal(uploaded, content) {
+			http.Error(w, "unexpected upload "+header.Filename+" "+string(uploaded), http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(`{"file_uuid":"f-1"}`))
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL)
+
+	var sent int64
+	fileUUID, err := client.Upload(context.Background(), bytes.NewReader(content), UploadOptions{
+		Name:     "a.txt",
+		Progress: func(n int64) { sent = n },
+	})
+	if err != nil || fileUUID != "f-1" {
+		t.Fatalf("Upload = %q, %v", fileUUID, err)
+	}
+	if attempts.Load() != 2 || sent != int64(len(content)) {
+		t.Errorf("expected one retry and %d bytes sent, got %d attempts and %d bytes", len(content), attempts.Load(), sent)
+	}
+
+	// A reader that cannot be rewound is not retried.
+	attempts.Store(0)
+	_, err = client.Upload(context.Background(), io.MultiReader(strings.NewReader("x")), UploadOptions{Name: "a.txt"})
+	if err == nil || attempts.Load() != 1 {
+		t.Errorf("expected a single failed attempt, got %d attempts and %v", attempts.Load(), err)
+	}
+}
+
+func TestUpload_NotRetriedOnceSent(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+	}{
+		{
+			name: "server error",
+			respond: func(w http.ResponseWriter) {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			},
+		},
+		{
+			name: "unavailable",
+			respond: func(w http.ResponseWriter) {
+				http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			},
+		},
+		{
+			name: "connection lost",
+			respond: func(w http.ResponseWriter) {
+				panic(http.ErrAbortHandler)
+			},
+		},
+		{
+			name: "response cut short",
+			respond: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Length", "100")
+				w.Write([]byte(`{"file_uuid":`))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			io.Copy(io.Discard, r.Body)
+			tt.respond(w)
+		}))
+
+		_, err := newTestClient(server.URL).Upload(context.Background(), strings.NewReader("content"), UploadOptions{Name: "a.txt"})
+		server.Close()
+
+		if err == nil || attempts.Load() != 1 {
+			t.Errorf("%s: expected a single failed attempt, got %d attempts and %v", tt.name, attempts.Load(), err)
+		}
+	}
+}
+
+func TestDownload_Resume(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		offset := 0
+		if value, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			offset, _ = strconv.Atoi(strings.TrimSuffix(value, "-"))
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(offset)+"-19/20")
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[offset:])
+			return
+		}
+
+		// The first response breaks off halfway.
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:10])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL)
+
+	var out bytes.Buffer
+	n, err := client.Download(context.Background(), "f-1", &out)
+	if err != nil || n != int64(len(content)) || !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("Download = %d, %q, %v", n, out.String(), err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("expected 2 requests, got %d", requests.Load())
+	}
+
+	out.Reset()
+	n, err = client.DownloadRange(context.Background(), "f-1", 15, -1, &out)
+	if err != nil || n != 5 || out.String() != "fghij" {
+		t.Errorf("DownloadRange = %d, %q, %v", n, out.String(), err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Query().Get("file_uuid") {
+		case "missing":
+			w.Header().Set(requestIDHeader, "req-1")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"code":"not_found","message":"Unknown file","request_id":"req-1"}`)
+		case "busy":
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL)
+
+	_, err := client.Stat(context.Background(), "missing")
+	var apiErr *Error
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) || apiErr.RequestID != "req-1" {
+		t.Errorf("expected a not found error with a request ID, got %v", err)
+	}
+	if apiErr != nil && (apiErr.Code != "not_found" || apiErr.Message != "Unknown file") {
+		t.Errorf("expected the code and message of the JSON body, got %q and %q", apiErr.Code, apiErr.Message)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("a 404 should not be retried, got %d requests", requests.Load())
+	}
+
+	requests.Store(0)
+	_, err = client.Stat(context.Background(), "busy")
+	if !errors.Is(err, ErrRateLimited) || requests.Load() != 4 {
+		t.Errorf("expected a rate limit error after 4 requests, got %v after %d", err, requests.Load())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.Stat(ctx, "missing")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+}
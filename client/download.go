@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Download writes the file to w and returns the number of bytes written. A
+// download cut short is resumed where it stopped.
+func (c *Client) Download(ctx context.Context, fileUUID string, w io.Writer) (int64, error) {
+	return c.DownloadRange(ctx, fileUUID, 0, -1, w)
+}
+
+// DownloadRange writes length bytes of the file starting at offset to w, or
+// the rest of the file if length is negative, as when resuming a download
+// kept in a partial local copy. It returns the number of bytes written.
+func (c *Client) DownloadRange(ctx context.Context, fileUUID string, offset int64, length int64, w io.Writer) (int64, error) {
+	if length == 0 {
+		return 0, nil
+	}
+
+	var written int64
+	err := c.retry(ctx, func() error {
+		remaining := int64(-1)
+		if length > 0 {
+			remaining = length - written
+		}
+
+		n, err := c.download(ctx, fileUUID, offset+written, remaining, w)
+		written += n
+		return err
+	})
+
+	return written, err
+}
+
+// download makes one request for the range. Only the first request of a
+// download without a range asks for the whole file.
+func (c *Client) download(ctx context.Context, fileUUID string, offset int64, length int64, w io.Writer) (int64, error) {
+	query := url.Values{"file_uuid": {fileUUID}}
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/files/get", query, nil)
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+
+	ranged := offset > 0 || length > 0
+	if ranged {
+		value := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+		if length > 0 {
+			value += strconv.FormatInt(offset+length-1, 10)
+		}
+		req.Header.Set("Range", value)
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if ranged && resp.StatusCode != http.StatusPartialContent {
+		return 0, ErrRangeNotSupported
+	}
+
+	dst := &destination{w: w}
+	n, err := io.Copy(dst, resp.Body)
+	if dst.err != nil {
+		return n, &permanentError{dst.err}
+	}
+
+	return n, err
+}
+
+// destination records the errors of writing to the caller's writer, which
+// io.Copy does not tell apart from errors reading the response.
+type destination struct {
+	w   io.Writer
+	err error
+}
+
+func (d *destination) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
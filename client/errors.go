@@ -0,0 +1,130 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors that an *Error matches with errors.Is, depending on its status.
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrConflict           = errors.New("conflict")
+	ErrQuotaExceeded      = errors.New("quota exceeded")
+	ErrRateLimited        = errors.New("rate limited")
+	ErrUnavailable        = errors.New("unavailable")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// ErrRangeNotSupported is returned when a range is asked for and the gateway
+// sends the whole file instead.
+var ErrRangeNotSupported = errors.New("gateway does not support ranges")
+
+// Error is returned for requests the gateway answered with an error status.
+type Error struct {
+	StatusCode int
+	// Code tells errors that share a status apart, such as "already_exists"
+	// and "file_incomplete". It is empty for errors not sent as JSON.
+	Code    string
+	Message string
+	// RequestID identifies the request in the gateway's logs.
+	RequestID string
+	// RetryAfter is how long the gateway asked to wait before retrying.
+	RetryAfter time.Duration
+}
+
+func newError(resp *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get(requestIDHeader),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	var decoded struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(body, &decoded); err == nil && decoded.Code != "" {
+		apiErr.Code = decoded.Code
+		apiErr.Message = decoded.Message
+		if apiErr.RequestID == "" {
+			apiErr.RequestID = decoded.RequestID
+		}
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return apiErr
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("gateway returned %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusPreconditionFailed:
+		return target == ErrPreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return target == ErrQuotaExceeded
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case http.StatusServiceUnavailable:
+		return target == ErrUnavailable
+	}
+
+	return false
+}
+
+func asError(err error) (*Error, bool) {
+	var apiErr *Error
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+// permanentError marks a failure on the client's side that retrying does not
+// help, such as failing to write a download to its destination.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// isRetryable reports whether a request that failed with err may succeed on
+// another try.
+func isRetryable(err error) bool {
+	var permanent *permanentError
+	if errors.As(err, &permanent) || errors.Is(err, ErrRangeNotSupported) {
+		return false
+	}
+
+	if apiErr, ok := asError(err); ok {
+		return apiErr.StatusCode >= http.StatusInternalServerError || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	// Network errors, including a response cut short.
+	return true
+}
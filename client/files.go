@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// File is the metadata of a stored file.
+type File struct {
+	FileUUID  string    `json:"file_uuid"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Owner     string    `json:"owner"`
+	TenantID  string    `json:"tenant_id"`
+	Encrypted bool      `json:"encrypted"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Stat returns the metadata of a file.
+func (c *Client) Stat(ctx context.Context, fileUUID string) (File, error) {
+	var file File
+	err := c.getJSON(ctx, "/api/files/stat", url.Values{"file_uuid": {fileUUID}}, &file)
+	return file, err
+}
+
+type ListOptions struct {
+	// Prefix limits the listing to files whose name starts with it.
+	Prefix string
+	// After is the UUID the page starts after and Limit its size, which the
+	// gateway defaults to 100.
+	After string
+	Limit int
+}
+
+// List returns a page of the files the caller can read, ordered by UUID, and
+// the After value of the next page, which is empty on the last page.
+func (c *Client) List(ctx context.Context, opts ListOptions) ([]File, string, error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.After != "" {
+		query.Set("after", opts.After)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	var page struct {
+		Files     []File `json:"files"`
+		NextAfter string `json:"next_after"`
+	}
+	err := c.getJSON(ctx, "/api/files/list", query, &page)
+
+	return page.Files, page.NextAfter, err
+}
+
+// Delete removes a file. If a retry follows an attempt that went through
+// unnoticed, it fails with ErrNotFound.
+func (c *Client) Delete(ctx context.Context, fileUUID string) error {
+	return c.retry(ctx, func() error {
+		req, err := c.newRequest(ctx, http.MethodDelete, "/api/files/delete", url.Values{"file_uuid": {fileUUID}}, nil)
+		if err != nil {
+			return &permanentError{err}
+		}
+
+		resp, err := c.send(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		return nil
+	})
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, value any) error {
+	return c.retry(ctx, func() error {
+		req, err := c.newRequest(ctx, http.MethodGet, path, query, nil)
+		if err != nil {
+			return &permanentError{err}
+		}
+
+		resp, err := c.send(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+			return fmt.Errorf("decode response: %w", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,3 @@
+module karma8/client
+
+go 1.24.3
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+type UploadOptions struct {
+	// Name is the file name stored with the file.
+	Name string
+	// Size is the length of the content. It is found out for readers that
+	// report their length or can seek, and makes the request carry a
+	// Content-Length; the upload is streamed either way.
+	Size int64
+	// Progress is called with the number of bytes sent so far. It restarts
+	// from zero when the upload is retried.
+	Progress func(sent int64)
+}
+
+// Upload streams r to the gateway as a new file and returns its UUID. Every
+// attempt creates a file, so an upload is only retried when the gateway
+// cannot have stored it: when the request was rate limited or never reached
+// the gateway. Other failures, including server errors and connections lost
+// mid-request, are returned as they are. Retries also need r to seek back
+// to where it started.
+func (c *Client) Upload(ctx context.Context, r io.Reader, opts UploadOptions) (string, error) {
+	if opts.Size <= 0 {
+		opts.Size = readerSize(r)
+	}
+
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return c.upload(ctx, r, opts)
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return c.upload(ctx, r, opts)
+	}
+
+	var fileUUID string
+	err = c.retry(ctx, func() error {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return &permanentError{err}
+		}
+
+		var err error
+		fileUUID, err = c.upload(ctx, r, opts)
+		return err
+	})
+
+	return fileUUID, err
+}
+
+// upload sends the multipart form with the file in one request. The form is
+// assembled around r as it is read, rather than through a pipe, so that its
+// length is known up front when the size of r is.
+func (c *Client) upload(ctx context.Context, r io.Reader, opts UploadOptions) (string, error) {
+	var head bytes.Buffer
+	form := multipart.NewWriter(&head)
+	if _, err := form.CreateFormFile("file", opts.Name); err != nil {
+		return "", &permanentError{err}
+	}
+	headLen := head.Len()
+	if err := form.Close(); err != nil {
+		return "", &permanentError{err}
+	}
+	tail := bytes.Clone(head.Bytes()[headLen:])
+	head.Truncate(headLen)
+
+	var content io.Reader = r
+	if opts.Size > 0 {
+		content = io.LimitReader(r, opts.Size)
+	}
+	if opts.Progress != nil {
+		content = &progressReader{r: content, progress: opts.Progress}
+	}
+
+	body := io.MultiReader(&head, content, bytes.NewReader(tail))
+	req, err := c.newRequest(ctx, http.MethodPost, "/api/files/upload", nil, body)
+	if err != nil {
+		return "", &permanentError{err}
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if opts.Size >= 0 {
+		req.ContentLength = int64(headLen) + opts.Size + int64(len(tail))
+	} else {
+		req.ContentLength = -1
+	}
+
+	// Once the headers are written the gateway may store the file, whether
+	// or not its response arrives.
+	var wrote atomic.Bool
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteHeaders: func() { wrote.Store(true) },
+	}))
+
+	resp, err := c.send(req)
+	if err != nil {
+		if apiErr, ok := asError(err); ok && apiErr.StatusCode == http.StatusTooManyRequests {
+			return "", err
+		}
+		if wrote.Load() {
+			return "", &permanentError{err}
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		FileUUID string `json:"file_uuid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", &permanentError{fmt.Errorf("decode upload response: %w", err)}
+	}
+
+	return response.FileUUID, nil
+}
+
+// readerSize returns the number of bytes left in r, or -1 if it cannot tell.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case io.Seeker:
+		current, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err := r.Seek(current, io.SeekStart); err != nil {
+			return -1
+		}
+		return end - current
+	}
+
+	return -1
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress func(int64)
+	n        int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.n += int64(n)
+		p.progress(p.n)
+	}
+	return n, err
+}
@@ -0,0 +1,72 @@
+// Package apierror writes the JSON body of error responses.
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"karma8/common/logging"
+)
+
+// Codes tell clients what went wrong independently of the status, which
+// several codes share, and of the message, which is meant for people.
+const (
+	CodeInvalidArgument     = "invalid_argument"
+	CodeUnauthenticated     = "unauthenticated"
+	CodePermissionDenied    = "permission_denied"
+	CodeNotFound            = "not_found"
+	CodeAlreadyExists       = "already_exists"
+	CodeFileIncomplete      = "file_incomplete"
+	CodeChecksumMismatch    = "checksum_mismatch"
+	CodeMetadataMismatch    = "metadata_mismatch"
+	CodePreconditionFailed  = "precondition_failed"
+	CodeQuotaExceeded       = "quota_exceeded"
+	CodeTooLarge            = "too_large"
+	CodeRangeNotSatisfiable = "range_not_satisfiable"
+	CodeRateLimited         = "rate_limited"
+	CodeUnavailable         = "unavailable"
+	CodeInternal            = "internal"
+)
+
+// serverMessages are the messages of server errors. Their causes are only
+// logged, since they may name hosts, files or queries that clients must not
+// see.
+var serverMessages = map[int]string{
+	http.StatusInternalServerError: "Internal server error",
+	http.StatusServiceUnavailable:  "Service unavailable",
+}
+
+// Error is the body of every error response.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID identifies the request in the logs.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Write responds with status and an error body. The request ID is the one
+// the logging middleware assigned to the response.
+func Write(w http.ResponseWriter, status int, code string, message string) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(Error{
+		Code:      code,
+		Message:   message,
+		RequestID: header.Get(logging.RequestIDHeader),
+	})
+}
+
+// WriteServerError responds with a server error status and the fixed message
+// for it. The caller logs the error behind it.
+func WriteServerError(w http.ResponseWriter, status int, code string) {
+	message, ok := serverMessages[status]
+	if !ok {
+		message = http.StatusText(status)
+	}
+
+	Write(w, status, code, message)
+}
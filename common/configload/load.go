@@ -0,0 +1,187 @@
+// Package configload fills the config structs of the services from a YAML
+// file, environment variables and flags.
+package configload
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv names the environment variable that points at the YAML
+// config file, which can also be passed with the -config flag.
+const ConfigFileEnv = "CONFIG_FILE"
+
+// Load fills cfg, which holds the defaults, from the YAML config file, then
+// environment variables, then flags, each overriding the previous. Every leaf
+// field of cfg must have an env tag; its flag is the env name in lower case
+// with dashes. It returns the arguments left after the flags.
+func Load(cfg any, args []string, getenv func(string) string) ([]string, error) {
+	fields := leafFields(reflect.ValueOf(cfg).Elem(), "")
+
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	configFile := flags.String("config", getenv(ConfigFileEnv), "path to the YAML config file")
+	flagValues := make(map[string]*string, len(fields))
+	for _, field := range fields {
+		flagValues[field.env] = flags.String(field.flagName(), "", "overrides "+field.env)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read config file")
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, errors.Wrapf(err, "parse config file %s", *configFile)
+		}
+
+		// Decoding replaced the values of the fields, refresh them.
+		fields = leafFields(reflect.ValueOf(cfg).Elem(), "")
+	}
+
+	var problems []string
+	for _, field := range fields {
+		if value := getenv(field.env); value != "" {
+			if err := field.set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s=%q: %v", field.env, value, err))
+			}
+		}
+	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, field := range fields {
+		if set[field.flagName()] {
+			value := *flagValues[field.env]
+			if err := field.set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s=%q: %v", field.flagName(), value, err))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New("invalid config values:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return flags.Args(), nil
+}
+
+type leafField struct {
+	value  reflect.Value
+	path   string
+	env    string
+	secret bool
+}
+
+func (f leafField) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(f.env), "_", "-")
+}
+
+func leafFields(v reflect.Value, prefix string) []leafField {
+	var fields []leafField
+
+	t := v.Type()
+	for i := range t.NumField() {
+		structField := t.Field(i)
+		name, _, _ := strings.Cut(structField.Tag.Get("yaml"), ",")
+		path := prefix + name
+
+		if structField.Type.Kind() == reflect.Struct && structField.Type != reflect.TypeOf(time.Time{}) {
+			fields = append(fields, leafFields(v.Field(i), path+".")...)
+			continue
+		}
+
+		env := structField.Tag.Get("env")
+		if env == "" {
+			panic(fmt.Sprintf("config field %s has no env tag", path))
+		}
+
+		fields = append(fields, leafField{
+			value:  v.Field(i),
+			path:   path,
+			env:    env,
+			secret: structField.Tag.Get("secret") == "true",
+		})
+	}
+
+	return fields
+}
+
+func (f leafField) set(value string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		f.value.SetBool(b)
+	case int, int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		f.value.SetInt(n)
+	case float64:
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		f.value.SetFloat(x)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("not a duration such as 30s or 5m")
+		}
+		f.value.SetInt(int64(d))
+	case []string:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+	default:
+		panic(fmt.Sprintf("config field %s has unsupported type %s", f.path, f.value.Type()))
+	}
+
+	return nil
+}
+
+// Redacted renders cfg as YAML with the values of the fields tagged
+// secret:"true" hidden.
+func Redacted(cfg any) string {
+	copied := reflect.New(reflect.TypeOf(cfg).Elem())
+	copied.Elem().Set(reflect.ValueOf(cfg).Elem())
+
+	for _, field := range leafFields(copied.Elem(), "") {
+		if field.secret && field.value.String() != "" {
+			field.value.SetString("REDACTED")
+		}
+	}
+
+	out, err := yaml.Marshal(copied.Interface())
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+
+	return string(out)
+}
@@ -0,0 +1,150 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"karma8/common/response"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the ID of a request from the client, or from the
+// gateway to the storage nodes, so that their log lines can be correlated.
+const RequestIDHeader = "X-Request-ID"
+
+// level is the level of the default logger, which SetLevel changes at run
+// time.
+var level slog.LevelVar
+
+// Setup installs the default logger. Level is one of debug, info, warn or
+// error and format is json or text.
+func Setup(logLevel string, format string) error {
+	if err := SetLevel(logLevel); err != nil {
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: &level}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLevel changes the level of the default logger. An empty level means
+// info.
+func SetLevel(logLevel string) error {
+	var parsed slog.Level
+	if logLevel != "" {
+		if err := parsed.UnmarshalText([]byte(logLevel)); err != nil {
+			return fmt.Errorf("unknown log level %q", logLevel)
+		}
+	}
+
+	level.Set(parsed)
+	return nil
+}
+
+// Fatal logs msg and args at error level with the default logger and exits,
+// for failures that keep a command from starting.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+type requestIDKey struct{}
+
+// FromContext returns the logger of the request in ctx, which carries its
+// request ID, or the default logger outside of requests.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// WithLogger returns a context whose logger is logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// RequestID returns the ID of the request in ctx, if any.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// Middleware assigns every request an ID, taken from X-Request-ID if the
+// client sent one, attaches a logger carrying it to the request context and
+// writes an access log line once the request is done. Requests whose handler
+// panicked, as with http.ErrAbortHandler to cut a failed download short, are
+// logged as aborted before the panic goes on.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.HasTraceID() {
+			logger = logger.With("trace_id", spanContext.TraceID().String())
+		}
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		ctx = WithLogger(ctx, logger)
+
+		recorder := response.NewRecorder(w)
+		start := time.Now()
+
+		defer func() {
+			aborted := recover()
+
+			level := slog.LevelInfo
+			if aborted != nil {
+				level = slog.LevelWarn
+			}
+			logger.Log(ctx, level, "request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", recorder.Status,
+				"bytes", recorder.Bytes,
+				"duration", time.Since(start),
+				"remote_addr", r.RemoteAddr,
+				"aborted", aborted != nil,
+			)
+
+			if aborted != nil {
+				panic(aborted)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
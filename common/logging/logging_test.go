@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantStatus  float64
+		wantLevel   string
+		wantAborted bool
+	}{
+		{
+			name: "completed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+			},
+			wantStatus: http.StatusCreated,
+			wantLevel:  "INFO",
+		},
+		{
+			name: "aborted",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("part"))
+				panic(http.ErrAbortHandler)
+			},
+			wantStatus:  http.StatusOK,
+			wantLevel:   "WARN",
+			wantAborted: true,
+		},
+	}
+
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+
+		func() {
+			defer func() {
+				recovered := recover()
+				if tt.wantAborted && recovered != http.ErrAbortHandler {
+					t.Errorf("%s: expected the panic to go on, got %v", tt.name, recovered)
+				}
+				if !tt.wantAborted && recovered != nil {
+					t.Errorf("%s: unexpected panic %v", tt.name, recovered)
+				}
+			}()
+			Middleware(tt.handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/files", nil))
+		}()
+
+		var entry map[string]any
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: decode log line %q: %v", tt.name, out.String(), err)
+		}
+
+		if entry["status"] != tt.wantStatus || entry["level"] != tt.wantLevel || entry["aborted"] != tt.wantAborted {
+			t.Errorf("%s: expected status %v, level %s and aborted %v, got %v", tt.name, tt.wantStatus, tt.wantLevel, tt.wantAborted, entry)
+		}
+	}
+}
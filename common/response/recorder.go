@@ -0,0 +1,49 @@
+// Package response wraps http.ResponseWriter for middleware that observes or
+// changes what a handler writes.
+package response
+
+import "net/http"
+
+// Recorder passes a response through to the underlying writer and records
+// its status code and the number of body bytes written. Middleware that
+// changes how the body is written embeds it and overrides Write.
+type Recorder struct {
+	http.ResponseWriter
+	// Status is the status code sent, http.StatusOK if the handler did not
+	// set one.
+	Status      int
+	Bytes       int64
+	wroteHeader bool
+}
+
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *Recorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.Status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(p)
+	r.Bytes += int64(n)
+	return n, err
+}
+
+// Flush sends what has been written so far to the client, if the underlying
+// writer supports it, so that streaming handlers can flush through
+// middleware that checks for http.Flusher.
+func (r *Recorder) Flush() {
+	r.wroteHeader = true
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *Recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,83 @@
+package response
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantStatus  int
+		wantBytes   int64
+		wantFlushed bool
+	}{
+		{
+			name:       "implicit status",
+			handler:    func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) },
+			wantStatus: http.StatusOK,
+			wantBytes:  5,
+		},
+		{
+			name: "explicit status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("missing"))
+			},
+			wantStatus: http.StatusNotFound,
+			wantBytes:  7,
+		},
+		{
+			name: "status after body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantStatus: http.StatusOK,
+			wantBytes:  2,
+		},
+		{
+			name: "flush",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("part"))
+				w.(http.Flusher).Flush()
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantStatus:  http.StatusOK,
+			wantBytes:   4,
+			wantFlushed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			underlying := httptest.NewRecorder()
+			recorder := NewRecorder(underlying)
+
+			tt.handler(recorder, httptest.NewRequest("GET", "/", nil))
+
+			if recorder.Status != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, recorder.Status)
+			}
+			if recorder.Bytes != tt.wantBytes {
+				t.Errorf("Expected %d bytes, got %d", tt.wantBytes, recorder.Bytes)
+			}
+			if underlying.Flushed != tt.wantFlushed {
+				t.Errorf("Expected flushed %v, got %v", tt.wantFlushed, underlying.Flushed)
+			}
+		})
+	}
+}
+
+func TestRecorder_ResponseController(t *testing.T) {
+	underlying := httptest.NewRecorder()
+
+	if err := http.NewResponseController(NewRecorder(underlying)).Flush(); err != nil {
+		t.Errorf("Expected flush through the recorder to succeed, got %v", err)
+	}
+	if !underlying.Flushed {
+		t.Errorf("Expected the underlying writer to be flushed")
+	}
+}
@@ -0,0 +1,170 @@
+// Package security authenticates the requests of the gateway to the storage
+// nodes, by request signatures and mutual TLS.
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"karma8/common/apierror"
+
+	"github.com/pkg/errors"
+)
+
+// Headers of a signed request.
+const (
+	TimestampHeader = "X-Karma8-Timestamp"
+	NonceHeader     = "X-Karma8-Nonce"
+	SignatureHeader = "X-Karma8-Signature"
+)
+
+// Prefixes of the headers a signature covers: the checksum the node verifies
+// the body against, and the chunk metadata the node stores.
+var signedHeaderPrefixes = []string{"X-Checksum-", "X-Chunk-"}
+
+// Sign returns the HMAC-SHA256 signature of a request. It covers the method,
+// path and query, content length, timestamp and nonce, so that a captured
+// request can neither be pointed at another chunk nor replayed, and the
+// checksum and metadata headers, so that neither the body nor what the node
+// stores with it can be replaced.
+func Sign(secret []byte, method string, requestURI string, contentLength int64, timestamp string, nonce string, header http.Header) string {
+	lines := []string{
+		method,
+		requestURI,
+		strconv.FormatInt(contentLength, 10),
+		timestamp,
+		nonce,
+	}
+
+	var names []string
+	for name := range header {
+		for _, prefix := range signedHeaderPrefixes {
+			if strings.HasPrefix(http.CanonicalHeaderKey(name), prefix) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return strings.Compare(http.CanonicalHeaderKey(a), http.CanonicalHeaderKey(b))
+	})
+	for _, name := range names {
+		// Values are quoted so that no value can pass for another line.
+		lines = append(lines, http.CanonicalHeaderKey(name)+":"+strconv.Quote(strings.Join(header[name], ",")))
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest signs req with the shared secret, adding a timestamp and a
+// random nonce. The headers the signature covers must be set before.
+func SignRequest(req *http.Request, secret []byte) error {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return errors.Wrap(err, "generate nonce")
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Sign(secret, req.Method, req.URL.RequestURI(), req.ContentLength, timestamp, nonce, req.Header))
+
+	return nil
+}
+
+// RequireSignature rejects requests that are not signed with the shared
+// secret, whose timestamp is more than maxSkew away from now, or whose nonce
+// was already seen within that window.
+func RequireSignature(secret []byte, maxSkew time.Duration) func(http.Handler) http.Handler {
+	nonces := newNonceCache(2 * maxSkew)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timestamp := r.Header.Get(TimestampHeader)
+			nonce := r.Header.Get(NonceHeader)
+			signature := r.Header.Get(SignatureHeader)
+			if timestamp == "" || nonce == "" || signature == "" {
+				apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Request is not signed")
+				return
+			}
+
+			unix, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Invalid request timestamp")
+				return
+			}
+
+			now := time.Now()
+			if skew := now.Sub(time.Unix(unix, 0)).Abs(); skew > maxSkew {
+				apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Request timestamp outside the allowed window")
+				return
+			}
+
+			expected := Sign(secret, r.Method, r.URL.RequestURI(), r.ContentLength, timestamp, nonce, r.Header)
+			if !hmac.Equal([]byte(signature), []byte(expected)) {
+				apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Invalid request signature")
+				return
+			}
+
+			// Only record the nonce once the signature is known to be good, so
+			// that forged requests cannot fill the cache.
+			if !nonces.add(nonce, now) {
+				apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Request replayed")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// nonceCache remembers nonces for ttl. Requests older than the allowed skew
+// are rejected by their timestamp, so nonces do not need to be kept longer.
+type nonceCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{
+		ttl:  ttl,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// add records the nonce and reports whether it was new.
+func (c *nonceCache) add(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastPrune) > c.ttl {
+		for seenNonce, seenAt := range c.seen {
+			if now.Sub(seenAt) > c.ttl {
+				delete(c.seen, seenNonce)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if seenAt, ok := c.seen[nonce]; ok && now.Sub(seenAt) <= c.ttl {
+		return false
+	}
+
+	c.seen[nonce] = now
+	return true
+}
@@ -0,0 +1,253 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte(strings.Repeat("s", 32))
+
+func newSignedRequest(t *testing.T, secret []byte) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", "/api/chunks/upload?file_uuid=a&chunk_index=1", strings.NewReader("chunk"))
+	req.Header.Set("X-Checksum-SHA256", "checksum")
+	req.Header.Set("X-Chunk-Codec", "zstd")
+	if err := SignRequest(req, secret); err != nil {
+		t.Fatalf("sign request: %v", err)
+	}
+
+	return req
+}
+
+// signAt signs req as if it had been sent at sentAt.
+func signAt(req *http.Request, secret []byte, sentAt time.Time, nonce string) {
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Sign(secret, req.Method, req.URL.RequestURI(), req.ContentLength, timestamp, nonce, req.Header))
+}
+
+func TestRequireSignature(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    func(t *testing.T) *http.Request
+		wantStatus int
+	}{
+		{
+			name:       "valid",
+			request:    func(t *testing.T) *http.Request { return newSignedRequest(t, testSecret) },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "unsigned",
+			request: func(t *testing.T) *http.Request {
+				return httptest.NewRequest("GET", "/api/chunks/download?file_uuid=a&chunk_index=1", nil)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "other secret",
+			request:    func(t *testing.T) *http.Request { return newSignedRequest(t, []byte(strings.Repeat("x", 32))) },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "other chunk",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.URL.RawQuery = "file_uuid=a&chunk_index=2"
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "other method",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.Method = "DELETE"
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "other length",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.ContentLength++
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "other checksum",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.Header.Set("X-Checksum-SHA256", "other")
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "other metadata",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.Header.Set("X-Chunk-Codec", "none")
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "added metadata",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.Header.Set("X-Chunk-Owner", "mallory")
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "removed metadata",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.Header.Del("X-Chunk-Codec")
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "other unsigned header",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.Header.Set("X-Request-ID", "other")
+				return req
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "tampered signature",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				signature := []byte(req.Header.Get(SignatureHeader))
+				signature[0] ^= 1
+				req.Header.Set(SignatureHeader, string(signature))
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered timestamp",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				unix, _ := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+				req.Header.Set(TimestampHeader, strconv.FormatInt(unix+1, 10))
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "expired",
+			request: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest("GET", "/api/chunks/download?file_uuid=a&chunk_index=1", nil)
+				signAt(req, testSecret, time.Now().Add(-2*time.Minute), "expired")
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "from the future",
+			request: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest("GET", "/api/chunks/download?file_uuid=a&chunk_index=1", nil)
+				signAt(req, testSecret, time.Now().Add(2*time.Minute), "future")
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "within the skew",
+			request: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest("GET", "/api/chunks/download?file_uuid=a&chunk_index=1", nil)
+				signAt(req, testSecret, time.Now().Add(-30*time.Second), "recent")
+				return req
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "invalid timestamp",
+			request: func(t *testing.T) *http.Request {
+				req := newSignedRequest(t, testSecret)
+				req.Header.Set(TimestampHeader, "yesterday")
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	handler := RequireSignature(testSecret, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, tt.request(t))
+
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, recorder.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestRequireSignature_RejectsReplays(t *testing.T) {
+	handler := RequireSignature(testSecret, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := newSignedRequest(t, testSecret)
+	replayed := req.Clone(req.Context())
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, replayed)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("replayed request: status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	// A forged request must not use up the nonce of a genuine one.
+	forged := httptest.NewRequest("GET", "/api/chunks/download?file_uuid=b&chunk_index=1", nil)
+	signAt(forged, []byte(strings.Repeat("x", 32)), time.Now(), "shared-nonce")
+	handler.ServeHTTP(httptest.NewRecorder(), forged)
+
+	genuine := httptest.NewRequest("GET", "/api/chunks/download?file_uuid=b&chunk_index=1", nil)
+	signAt(genuine, testSecret, time.Now(), "shared-nonce")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, genuine)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("request after a forged one with its nonce: status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestNonceCache_ForgetsExpiredNonces(t *testing.T) {
+	cache := newNonceCache(time.Minute)
+	now := time.Now()
+
+	if !cache.add("a", now) {
+		t.Fatal("new nonce reported as seen")
+	}
+	if cache.add("a", now.Add(30*time.Second)) {
+		t.Error("nonce accepted twice within the ttl")
+	}
+	if !cache.add("b", now.Add(2*time.Minute)) {
+		t.Fatal("new nonce reported as seen")
+	}
+	if _, ok := cache.seen["a"]; ok {
+		t.Error("expired nonce was not pruned")
+	}
+}
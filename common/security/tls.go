@@ -0,0 +1,157 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// reloadInterval is how often the certificate files are checked for changes.
+const reloadInterval = 10 * time.Second
+
+// CertReloader presents a certificate from disk, as a server or as a client,
+// and picks up a renewed one without a restart. The files are checked for
+// changes during handshakes, at most once per reloadInterval.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current(), nil
+}
+
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.current(), nil
+}
+
+func (c *CertReloader) current() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastCheck) > reloadInterval {
+		c.lastCheck = time.Now()
+		if err := c.reloadIfChanged(); err != nil {
+			slog.Warn("keeping current TLS certificate", "error", err)
+		}
+	}
+
+	return c.cert
+}
+
+func (c *CertReloader) reloadIfChanged() error {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if modTime.Equal(c.modTime) {
+		return nil
+	}
+
+	return c.reload()
+}
+
+func (c *CertReloader) reload() error {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "load key pair")
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "stat")
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// ServerTLSConfig returns a TLS config that serves the certificate of
+// reloader and only accepts clients with a certificate issued by the CA in
+// clientCAFile.
+func ServerTLSConfig(reloader *CertReloader, clientCAFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read client ca")
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client ca file contains no certificates")
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		ClientCAs:      clientCAs,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// LoadClientTLSConfig returns a TLS config for mutual TLS with the storage
+// nodes: it trusts the CA in caFile and presents the certificate in
+// certFile, reloading it when it is renewed. serverName overrides the name
+// the nodes' certificates are checked against.
+func LoadClientTLSConfig(certFile string, keyFile string, caFile string, serverName string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read ca")
+	}
+
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("ca file contains no certificates")
+	}
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              rootCAs,
+		ServerName:           serverName,
+		GetClientCertificate: reloader.GetClientCertificate,
+	}, nil
+}
@@ -0,0 +1,277 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create ca certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse ca certificate: %v", err)
+	}
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue writes a certificate for name signed by the CA and its key to dir,
+// and returns their paths.
+func (ca *testCA) issue(t *testing.T, dir string, name string, serial int64) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+// touch moves the modification time of paths forward, as a renewal would.
+func touch(t *testing.T, at time.Time, paths ...string) {
+	t.Helper()
+
+	for _, path := range paths {
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatalf("chtimes %s: %v", path, err)
+		}
+	}
+}
+
+func serialOf(t *testing.T, cert *tls.Certificate) int64 {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, "storage", 10)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("new cert reloader: %v", err)
+	}
+
+	current := func() int64 {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("get certificate: %v", err)
+		}
+		return serialOf(t, cert)
+	}
+
+	if got := current(); got != 10 {
+		t.Fatalf("serial = %d, want 10", got)
+	}
+
+	tests := []struct {
+		name       string
+		renew      func()
+		wantSerial int64
+	}{
+		{
+			name:       "unchanged files",
+			renew:      func() {},
+			wantSerial: 10,
+		},
+		{
+			name: "renewed certificate",
+			renew: func() {
+				ca.issue(t, dir, "storage", 11)
+				touch(t, time.Now().Add(time.Minute), certFile, keyFile)
+			},
+			wantSerial: 11,
+		},
+		{
+			name: "invalid key pair keeps the current one",
+			renew: func() {
+				writeFile(t, keyFile, []byte("not a key"))
+				touch(t, time.Now().Add(2*time.Minute), keyFile)
+			},
+			wantSerial: 11,
+		},
+		{
+			name: "missing files keep the current one",
+			renew: func() {
+				os.Remove(certFile)
+			},
+			wantSerial: 11,
+		},
+		{
+			name: "fixed key pair",
+			renew: func() {
+				ca.issue(t, dir, "storage", 12)
+				touch(t, time.Now().Add(3*time.Minute), certFile, keyFile)
+			},
+			wantSerial: 12,
+		},
+	}
+
+	for _, tt := range tests {
+		tt.renew()
+
+		// The files are checked at most once per reloadInterval.
+		reloader.mu.Lock()
+		reloader.lastCheck = time.Time{}
+		reloader.mu.Unlock()
+
+		if got := current(); got != tt.wantSerial {
+			t.Errorf("%s: serial = %d, want %d", tt.name, got, tt.wantSerial)
+		}
+	}
+}
+
+func TestCertReloader_ChecksAtMostOncePerInterval(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, "storage", 10)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("new cert reloader: %v", err)
+	}
+
+	// The first handshake checks the files, which have not changed.
+	reloader.GetCertificate(nil)
+
+	ca.issue(t, dir, "storage", 11)
+	touch(t, time.Now().Add(time.Minute), certFile, keyFile)
+
+	cert, _ := reloader.GetCertificate(nil)
+	if got := serialOf(t, cert); got != 10 {
+		t.Errorf("serial = %d, want 10 until the interval passed", got)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+
+	serverCert, serverKey := ca.issue(t, dir, "storage", 10)
+	clientCert, clientKey := ca.issue(t, dir, "gateway", 20)
+
+	reloader, err := NewCertReloader(serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("new cert reloader: %v", err)
+	}
+
+	serverConfig, err := ServerTLSConfig(reloader, caFile)
+	if err != nil {
+		t.Fatalf("server tls config: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	clientConfig, err := LoadClientTLSConfig(clientCert, clientKey, caFile, "storage")
+	if err != nil {
+		t.Fatalf("client tls config: %v", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request with a client certificate: %v", err)
+	}
+	resp.Body.Close()
+
+	// Without a client certificate the handshake fails.
+	anonymous := clientConfig.Clone()
+	anonymous.GetClientCertificate = nil
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: anonymous}}
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Error("request without a client certificate succeeded")
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	// ReadHeaderTimeout bounds reading request headers and IdleTimeout how
+	// long keep-alive connections wait for the next request. ReadTimeout and
+	// WriteTimeout cover whole request and response bodies, so they are off
+	// by default to not cut large transfers.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// DrainDelay is how long readiness fails before the listener is closed,
+	// so that load balancers stop sending new requests first.
+	DrainDelay time.Duration
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// before their connections are closed.
+	ShutdownTimeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		DrainDelay:        5 * time.Second,
+		ShutdownTimeout:   10 * time.Minute,
+	}
+}
+
+// Server is an http.Server that drains in-flight requests on shutdown.
+type Server struct {
+	*http.Server
+	config   Config
+	draining atomic.Bool
+}
+
+func New(addr string, handler http.Handler, config Config) *Server {
+	return &Server{
+		Server: &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			ReadHeaderTimeout: config.ReadHeaderTimeout,
+			ReadTimeout:       config.ReadTimeout,
+			WriteTimeout:      config.WriteTimeout,
+			IdleTimeout:       config.IdleTimeout,
+			MaxHeaderBytes:    1 << 20,
+		},
+		config: config,
+	}
+}
+
+// Ready answers readiness probes. It fails once the server is draining.
+func (s *Server) Ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status": "draining"}`))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "ok"}`))
+}
+
+// Run serves with listen, typically ListenAndServe or ListenAndServeTLS,
+// until ctx is done. It then fails readiness for DrainDelay, stops accepting
+// connections and waits up to ShutdownTimeout for in-flight requests.
+func (s *Server) Run(ctx context.Context, listen func() error) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listen()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "drain_delay", s.config.DrainDelay, "shutdown_timeout", s.config.ShutdownTimeout)
+	s.draining.Store(true)
+	time.Sleep(s.config.DrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		s.Close()
+		return errors.Wrap(err, "in-flight requests did not finish")
+	}
+
+	slog.Info("all requests finished")
+	return nil
+}
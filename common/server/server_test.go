@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_Run_DrainsInFlightRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	config := DefaultConfig()
+	config.DrainDelay = 50 * time.Millisecond
+	config.ShutdownTimeout = 5 * time.Second
+
+	server := New("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}), config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- server.Run(ctx, func() error { return server.Serve(listener) })
+	}()
+
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+
+	<-started
+	cancel()
+
+	// Readiness fails while the in-flight request is still running.
+	time.Sleep(10 * time.Millisecond)
+	w := httptest.NewRecorder()
+	server.Ready(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readiness to fail while draining, got %d", w.Code)
+	}
+
+	close(release)
+
+	if body := <-response; body != "done" {
+		t.Errorf("Expected the in-flight request to finish, got %q", body)
+	}
+
+	if err := <-runErr; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRouteMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	router := mux.NewRouter()
+	router.Use(RouteMiddleware)
+	router.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	ctx, span := tracer.Start(context.Background(), "server")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items/1", nil).WithContext(ctx))
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+
+	if spans[0].Name() != "GET /items/{id}" {
+		t.Errorf("Expected span name %q, got %q", "GET /items/{id}", spans[0].Name())
+	}
+
+	want := attribute.String("http.route", "/items/{id}")
+	found := false
+	for _, attr := range spans[0].Attributes() {
+		if attr == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected attribute %v, got %v", want, spans[0].Attributes())
+	}
+}
+
+func TestSetup_Propagation(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	defer otel.SetTextMapPropagator(previous)
+
+	if _, err := Setup(context.Background(), Config{}); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	header := http.Header{}
+	otel.GetTextMapPropagator().Inject(trace.ContextWithSpanContext(context.Background(), spanContext), propagation.HeaderCarrier(header))
+
+	if header.Get("traceparent") == "" {
+		t.Fatalf("Expected a traceparent header")
+	}
+
+	got := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(header)))
+	if got.TraceID() != spanContext.TraceID() || got.SpanID() != spanContext.SpanID() {
+		t.Errorf("Expected span context %v to be propagated, got %v", spanContext, got)
+	}
+}
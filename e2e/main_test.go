@@ -79,7 +79,16 @@ func TestFileUploadAndDownload(t *testing.T) {
 		require.NoError(t, err, "Request should not fail")
 		defer resp.Body.Close()
 
-		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, "Should return 500 for non-existent file")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Should return 404 for non-existent file")
+
+		var apiErr struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr), "Error body should be JSON")
+		assert.Equal(t, "not_found", apiErr.Code, "Error code should be not_found")
+		assert.NotEmpty(t, apiErr.RequestID, "Error should carry the request ID")
 	})
 }
 
@@ -1,52 +1,158 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
+	"gateway/internal/auth"
+	"gateway/internal/compression"
+	"gateway/internal/config"
+	"gateway/internal/encryption"
 	"gateway/internal/handlers"
+	"gateway/internal/metrics"
+	"gateway/internal/ratelimit"
 	"gateway/internal/repository"
 	"gateway/internal/service"
 	"gateway/internal/storage"
+	"karma8/common/logging"
+	"karma8/common/security"
+	"karma8/common/server"
+	"karma8/common/tracing"
 
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
 func main() {
-	uploadDir := os.Getenv("UPLOAD_DIR")
-	if uploadDir == "" {
-		uploadDir = "./uploads"
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		logging.Fatal("error loading config", "error", err)
+	}
+
+	if len(args) > 0 && args[0] == "print-config" {
+		fmt.Print(cfg.Redacted())
+		return
+	}
+
+	if err := logging.Setup(cfg.Log.Level, cfg.Log.Format); err != nil {
+		logging.Fatal("error setting up logging", "error", err)
+	}
+
+	if err := os.MkdirAll(cfg.Upload.Dir, 0o755); err != nil {
+		logging.Fatal("error creating upload dir", "error", err)
 	}
 
-	db := initDB()
+	var keyWrapper encryption.KeyWrapper
+	if cfg.Encryption.Keyfile != "" {
+		keyring, err := encryption.LoadKeyfile(cfg.Encryption.Keyfile)
+		if err != nil {
+			logging.Fatal("error loading encryption keyfile", "error", err)
+		}
+		keyWrapper = keyring
+	}
+
+	compressionCodec, err := compression.ParseCodec(cfg.Upload.Compression)
+	if err != nil {
+		logging.Fatal("error parsing COMPRESSION", "error", err)
+	}
+
+	db := initDB(cfg.Database.DSN)
 	repository := repository.NewRepository(db)
 
-	storageAddrs := getStorageAddresses()
+	if len(args) > 0 {
+		runCommand(args, cfg, repository, keyWrapper)
+		return
+	}
 
-	storageManager, err := storage.NewStorageManager(storageAddrs)
+	slog.Info("effective config", "config", cfg.Redacted())
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		File:        cfg.Tracing.File,
+		ServiceName: "gateway",
+	})
 	if err != nil {
-		log.Fatal("Error creating storage manager:", err)
+		logging.Fatal("error setting up tracing", "error", err)
 	}
+	defer shutdownTracing(context.Background())
+
+	storageManager := newStorageManager(cfg.Storage)
 	defer storageManager.Close()
 
-	log.Printf("Initialized storage manager with %d storage instances", storageManager.GetNumStorage())
+	slog.Info("initialized storage manager", "storage_nodes", storageManager.GetNumStorage())
+
+	chunkerService := service.NewChunkerService(repository, storageManager, service.ChunkerConfig{
+		UploadDir:        cfg.Upload.Dir,
+		MemoryBufferSize: cfg.Upload.MemoryBuffer,
+		KeyWrapper:       keyWrapper,
+		Compression:      compressionCodec,
+	})
+	gatewayHandler := handlers.NewGatewayHandler(chunkerService, service.NewNamespaceService(repository, chunkerService))
+	adminHandler := handlers.NewAdminHandler(service.NewTenantService(repository), service.NewFsckService(repository, storageManager))
+
+	presigner := getPresigner(cfg.Auth)
+
+	authenticators := getAuthenticators(cfg.Auth)
+	if presigner != nil {
+		// Presigned URLs are checked first so that they work whatever other
+		// authentication is configured.
+		authenticators = append([]auth.Authenticator{presigner}, authenticators...)
+	}
 
-	chunkerService := service.NewChunkerService(repository, storageManager)
-	gatewayHandler := handlers.NewGatewayHandler(chunkerService)
+	rateLimitConfig, err := cfg.RateLimit.Limiter()
+	if err != nil {
+		logging.Fatal("error loading rate limits", "error", err)
+	}
+	rateLimiter := ratelimit.NewLimiter(rateLimitConfig)
 
 	muxRouter := mux.NewRouter()
-	muxRouter.Use(corsMiddleware)
+	muxRouter.Use(metrics.Middleware)
+	muxRouter.Use(tracing.RouteMiddleware)
+
+	apiRouter := muxRouter.PathPrefix("/api").Subrouter()
+	// Limiting by IP first bounds guessing credentials as well.
+	apiRouter.Use(rateLimiter.IPMiddleware)
+	apiRouter.Use(auth.Middleware(authenticators...))
+	apiRouter.Use(rateLimiter.Middleware)
+
+	apiRouter.Handle("/files/upload", auth.Require(auth.PermissionWrite)(http.HandlerFunc(gatewayHandler.UploadFile))).Methods("POST")
+	apiRouter.Handle("/files/get", auth.Require(auth.PermissionRead)(http.HandlerFunc(gatewayHandler.GetFile))).Methods("GET")
+	apiRouter.Handle("/files/stat", auth.Require(auth.PermissionRead)(http.HandlerFunc(gatewayHandler.StatFile))).Methods("GET")
+	apiRouter.Handle("/files/list", auth.Require(auth.PermissionRead)(http.HandlerFunc(gatewayHandler.ListFiles))).Methods("GET")
+	apiRouter.Handle("/files/delete", auth.Require(auth.PermissionWrite)(http.HandlerFunc(gatewayHandler.DeleteFile))).Methods("DELETE")
+	apiRouter.Handle("/paths/list", auth.Require(auth.PermissionRead)(http.HandlerFunc(gatewayHandler.ListPaths))).Methods("GET")
+	apiRouter.Handle("/paths/rename", auth.Require(auth.PermissionWrite)(http.HandlerFunc(gatewayHandler.RenamePath))).Methods("POST")
+
+	if presigner != nil {
+		presignHandler := handlers.NewPresignHandler(presigner, chunkerService, strings.TrimSuffix(cfg.HTTP.PublicURL, "/"))
+		apiRouter.HandleFunc("/files/presign", presignHandler.Presign).Methods("POST")
+	}
 
-	muxRouter.HandleFunc("/api/files/upload", gatewayHandler.UploadFile).Methods("POST")
-	muxRouter.HandleFunc("/api/files/get", gatewayHandler.GetFile).Methods("GET")
+	adminRouter := apiRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(auth.Require(auth.PermissionManageTenants))
+	adminRouter.HandleFunc("/tenants", adminHandler.ListTenants).Methods("GET")
+	adminRouter.HandleFunc("/tenants", adminHandler.CreateTenant).Methods("POST")
+	adminRouter.HandleFunc("/tenants/{id}", adminHandler.GetTenant).Methods("GET")
+	adminRouter.HandleFunc("/tenants/{id}", adminHandler.UpdateTenant).Methods("PUT")
+	adminRouter.HandleFunc("/fsck", adminHandler.GetFsck).Methods("GET")
+	adminRouter.HandleFunc("/fsck", adminHandler.StartFsck).Methods("POST")
+	adminRouter.HandleFunc("/fsck", adminHandler.CancelFsck).Methods("DELETE")
+
+	muxRouter.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	muxRouter.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -54,57 +160,297 @@ func main() {
 		w.Write([]byte(`{"status": "ok"}`))
 	}).Methods("GET")
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// CORS wraps the router rather than being router middleware so that it
+	// also answers preflight requests, which match no route. Tracing and
+	// access logging wrap it in turn, so that every request is covered.
+	handler := otelhttp.NewHandler(logging.Middleware(corsMiddleware(cfg.HTTP.CORSAllowedOrigins)(muxRouter)), "gateway")
+
+	httpServer := server.New(":"+cfg.HTTP.Port, handler, server.Config{
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+		DrainDelay:        cfg.HTTP.DrainDelay,
+		ShutdownTimeout:   cfg.HTTP.ShutdownTimeout,
+	})
+	muxRouter.HandleFunc("/ready", httpServer.Ready).Methods("GET")
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go cleanupAbortedUploads(ctx, chunkerService, cfg.Upload.CleanupInterval, cfg.Upload.AbortAfter)
+	go reloadOnSignal(ctx, cfg, storageManager, rateLimiter)
+
+	if err := httpServer.Run(ctx, httpServer.ListenAndServe); err != nil {
+		logging.Fatal("error running server", "error", err)
 	}
+}
+
+// reloadOnSignal reloads the config on SIGHUP until ctx is done. The storage
+// nodes, the rate limits and the log level are applied at once; an invalid
+// config is rejected as a whole and the current one is kept.
+func reloadOnSignal(ctx context.Context, current config.Config, storageManager *storage.StorageManager, rateLimiter *ratelimit.Limiter) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+
+		next, _, err := config.Load(os.Args[1:])
+		if err != nil {
+			slog.Error("config reload failed, keeping the current config", "error", err)
+			continue
+		}
 
-	if err := http.ListenAndServe(":"+port, muxRouter); err != nil {
-		log.Fatal("Error starting server:", err)
+		if err := applyConfig(next, storageManager, rateLimiter); err != nil {
+			slog.Error("config reload failed, keeping the current config", "error", err)
+			continue
+		}
+
+		if current.RestartRequired(next) {
+			slog.Warn("config changes other than the storage nodes, rate limits and log level take effect after a restart")
+		}
+
+		current = next
+		slog.Info("reloaded config", "storage_nodes", storageManager.GetNumStorage())
 	}
 }
 
-func getStorageAddresses() []string {
-	if addrs := os.Getenv("STORAGE_ADDRESSES"); addrs != "" {
-		return strings.Split(addrs, ",")
+func applyConfig(cfg config.Config, storageManager *storage.StorageManager, rateLimiter *ratelimit.Limiter) error {
+	rateLimitConfig, err := cfg.RateLimit.Limiter()
+	if err != nil {
+		return err
 	}
 
-	if addr := os.Getenv("STORAGE_HTTP_ADDR"); addr != "" {
-		return []string{addr}
+	if err := storageManager.SetAddresses(cfg.Storage.NodeAddresses()); err != nil {
+		return err
 	}
 
-	var addrs []string
-	numStorage := 10
-	if envNum := os.Getenv("NUM_STORAGE_INSTANCES"); envNum != "" {
-		if n, err := strconv.Atoi(envNum); err == nil && n > 0 && n <= 20 {
-			numStorage = n
+	rateLimiter.SetConfig(rateLimitConfig)
+	return logging.SetLevel(cfg.Log.Level)
+}
+
+// cleanupAbortedUploads periodically removes uploads that never completed,
+// such as those cut off when a gateway was killed, until ctx is done.
+func cleanupAbortedUploads(ctx context.Context, chunkerService *service.ChunkerService, interval time.Duration, abortAfter time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		cleaned, err := chunkerService.CleanupAbortedUploads(ctx, abortAfter)
+		if err != nil {
+			slog.Error("aborted upload cleanup failed", "error", err)
+		}
+		if cleaned > 0 {
+			slog.Info("cleaned up aborted uploads", "count", cleaned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newStorageManager creates the clients of the configured storage nodes.
+func newStorageManager(cfg config.StorageConfig) *storage.StorageManager {
+	storageConfig := storage.Config{
+		RetryAttempts:         cfg.RetryAttempts,
+		RetryBackoff:          cfg.RetryBackoff,
+		RetryMaxBackoff:       cfg.RetryMaxBackoff,
+		ConnectTimeout:        cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		BaseTimeout:           cfg.BaseTimeout,
+		MinThroughput:         cfg.MinThroughput,
+		IdleTimeout:           cfg.IdleTimeout,
+	}
+
+	var err error
+	if cfg.TLSCertFile != "" {
+		storageConfig.TLS, err = security.LoadClientTLSConfig(
+			cfg.TLSCertFile,
+			cfg.TLSKeyFile,
+			cfg.TLSCAFile,
+			cfg.TLSServerName,
+		)
+		if err != nil {
+			logging.Fatal("error loading storage TLS config", "error", err)
 		}
 	}
 
-	for i := 1; i <= numStorage; i++ {
-		addrs = append(addrs, fmt.Sprintf("storage-%d:8081", i))
+	if cfg.SigningSecret != "" {
+		storageConfig.SigningSecret = []byte(cfg.SigningSecret)
 	}
 
-	return addrs
+	storageManager, err := storage.NewStorageManager(cfg.NodeAddresses(), storageConfig)
+	if err != nil {
+		logging.Fatal("error creating storage manager", "error", err)
+	}
+
+	return storageManager
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+// runCommand runs one of the maintenance subcommands instead of the server.
+func runCommand(args []string, cfg config.Config, repository *repository.Repository, keyWrapper encryption.KeyWrapper) {
+	switch args[0] {
+	case "fsck":
+		flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "fix the metadata of chunks that were found intact")
+		concurrency := flags.Int("concurrency", 0, "number of files checked at once")
+		flags.Parse(args[1:])
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+		storageManager := newStorageManager(cfg.Storage)
+		defer storageManager.Close()
+
+		report, err := service.NewFsckService(repository, storageManager).Fsck(context.Background(), service.FsckOptions{
+			Repair:      *repair,
+			Concurrency: *concurrency,
+		})
+		if err != nil {
+			logging.Fatal("fsck failed", "error", err)
 		}
 
-		next.ServeHTTP(w, r)
-	})
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			logging.Fatal("error writing report", "error", err)
+		}
+
+		slog.Info("fsck finished",
+			"checked", report.Checked, "healthy", report.Healthy, "degraded", report.Degraded, "lost", report.Lost, "repaired", report.Repaired)
+		if report.Lost > 0 {
+			os.Exit(1)
+		}
+	case "recover":
+		flags := flag.NewFlagSet("recover", flag.ExitOnError)
+		apply := flags.Bool("apply", false, "record the recoverable files instead of only reporting them")
+		tenantID := flags.String("tenant", auth.DefaultTenant, "tenant the recovered files are charged to")
+		flags.Parse(args[1:])
+
+		storageManager := newStorageManager(cfg.Storage)
+		defer storageManager.Close()
+
+		report, err := service.NewRecoveryService(repository, storageManager, keyWrapper).Recover(context.Background(), service.RecoveryOptions{
+			Apply:    *apply,
+			TenantID: *tenantID,
+		})
+		if err != nil {
+			logging.Fatal("recovery failed", "error", err)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			logging.Fatal("error writing report", "error", err)
+		}
+
+		slog.Info("recovery finished",
+			"chunks", report.Chunks, "recoverable", report.Recoverable, "incomplete", report.Incomplete,
+			"conflicting", report.Conflicting, "existing", report.Existing, "restored", report.Restored)
+	case "rotate-keys":
+		if keyWrapper == nil {
+			logging.Fatal("rotate-keys requires ENCRYPTION_KEYFILE to be set")
+		}
+
+		rotated, err := service.NewKeyService(repository, keyWrapper).RotateKeys(context.Background())
+		if err != nil {
+			logging.Fatal("key rotation stopped", "rotated", rotated, "error", err)
+		}
+
+		slog.Info("re-wrapped data keys", "rotated", rotated, "key_id", keyWrapper.PrimaryKeyID())
+	default:
+		logging.Fatal("unknown command", "command", args[0])
+	}
+}
+
+// getAuthenticators builds the authenticators configured for the API. Without
+// any, every request is treated as an anonymous admin.
+func getAuthenticators(cfg config.AuthConfig) []auth.Authenticator {
+	var authenticators []auth.Authenticator
+
+	if path := cfg.APIKeysFile; path != "" {
+		apiKeys, err := auth.LoadAPIKeys(path)
+		if err != nil {
+			logging.Fatal("error loading API keys", "error", err)
+		}
+		authenticators = append(authenticators, apiKeys)
+	}
+
+	if path := cfg.JWTJWKSFile; path != "" {
+		jwtAuthenticator, err := auth.NewJWTAuthenticator(auth.JWTConfig{
+			JWKSFile:    path,
+			Issuer:      cfg.JWTIssuer,
+			Audience:    cfg.JWTAudience,
+			RolesClaim:  cfg.JWTRolesClaim,
+			TenantClaim: cfg.JWTTenantClaim,
+		})
+		if err != nil {
+			logging.Fatal("error loading JWKS", "error", err)
+		}
+		authenticators = append(authenticators, jwtAuthenticator)
+	}
+
+	if len(authenticators) == 0 {
+		slog.Warn("no authentication configured, the API is open to anyone")
+		authenticators = append(authenticators, auth.Anonymous{})
+	}
+
+	return authenticators
+}
+
+// getPresigner returns the signer of presigned URLs, or nil if no presign
+// secret is set.
+func getPresigner(cfg config.AuthConfig) *auth.Presigner {
+	if cfg.PresignSecret == "" {
+		return nil
+	}
+
+	presigner, err := auth.NewPresigner([]byte(cfg.PresignSecret))
+	if err != nil {
+		logging.Fatal("error creating presigner", "error", err)
+	}
+
+	return presigner
+}
+
+// corsMiddleware only answers origins from the allow list. Credentials are
+// never offered to the wildcard origin.
+func corsMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" {
+				w.Header().Add("Vary", "Origin")
+
+				if slices.Contains(allowedOrigins, origin) {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+					w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range, If-Match, If-None-Match, If-Modified-Since, "+auth.APIKeyHeader+", "+logging.RequestIDHeader)
+					w.Header().Set("Access-Control-Expose-Headers", "Content-Range, ETag, Last-Modified, "+logging.RequestIDHeader)
+				} else if slices.Contains(allowedOrigins, "*") {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+					w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+					w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+				}
+			}
+
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-func initDB() *sqlx.DB {
-	dsn := os.Getenv("DSN")
+func initDB(dsn string) *sqlx.DB {
 	var db *sqlx.DB
 	var err error
 
@@ -112,7 +458,7 @@ func initDB() *sqlx.DB {
 	for i := 0; i < maxRetries; i++ {
 		db, err = sqlx.Open("pgx", dsn)
 		if err != nil {
-			log.Printf("Error opening database (attempt %d/%d): %v", i+1, maxRetries, err)
+			slog.Warn("error opening database", "attempt", i+1, "max_attempts", maxRetries, "error", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
@@ -122,11 +468,11 @@ func initDB() *sqlx.DB {
 			return db
 		}
 
-		log.Printf("Database ping failed (attempt %d/%d): %v", i+1, maxRetries, pingErr)
+		slog.Warn("database ping failed", "attempt", i+1, "max_attempts", maxRetries, "error", pingErr)
 		db.Close()
 		time.Sleep(2 * time.Second)
 	}
 
-	log.Fatal("Could not connect to database after retries:", err)
+	logging.Fatal("could not connect to database after retries", "error", err)
 	return nil
 }
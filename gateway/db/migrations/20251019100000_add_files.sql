@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+create table files (
+    uuid text not null,
+    name text not null default '',
+    size bigint not null default 0,
+    encrypted_key bytea,
+    key_id text,
+    created_at timestamp not null default now(),
+    constraint files_pkey primary key (uuid)
+);
+
+insert into files (uuid, created_at)
+select uuid, min(updated_at) from chunks group by uuid;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table files;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table chunks add column codec text not null default 'none';
+alter table chunks add column logical_size bigint;
+alter table chunks add column compressed_size bigint;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table chunks drop column compressed_size;
+alter table chunks drop column logical_size;
+alter table chunks drop column codec;
+-- +goose StatementEnd
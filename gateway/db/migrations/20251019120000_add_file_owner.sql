@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table files add column owner text not null default '';
+create index files_owner_idx on files (owner);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index files_owner_idx;
+alter table files drop column owner;
+-- +goose StatementEnd
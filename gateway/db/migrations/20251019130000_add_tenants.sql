@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+create table tenants (
+    id text not null,
+    name text not null default '',
+    quota_bytes bigint,
+    quota_objects bigint,
+    used_bytes bigint not null default 0,
+    used_objects bigint not null default 0,
+    created_at timestamp not null default now(),
+    constraint tenants_pkey primary key (id)
+);
+
+insert into tenants (id, name, used_bytes, used_objects)
+select 'default', 'Default', coalesce(sum(size), 0), count(*) from files;
+
+alter table files add column tenant_id text not null default 'default' references tenants (id);
+create index files_tenant_id_idx on files (tenant_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index files_tenant_id_idx;
+alter table files drop column tenant_id;
+drop table tenants;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table files add column status text not null default 'complete';
+alter table files alter column status set default 'uploading';
+create index files_uploading_idx on files (created_at) where status = 'uploading';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index files_uploading_idx;
+alter table files drop column status;
+-- +goose StatementEnd
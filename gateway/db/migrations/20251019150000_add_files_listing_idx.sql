@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+create index files_tenant_uuid_idx on files (tenant_id, uuid) where status = 'complete';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index files_tenant_uuid_idx;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+create table paths (
+    tenant_id text not null references tenants (id),
+    bucket text not null,
+    key text collate "C" not null,
+    file_uuid text not null references files (uuid) on delete cascade,
+    updated_at timestamp not null default now(),
+    constraint paths_pkey primary key (tenant_id, bucket, key)
+);
+
+create unique index paths_file_uuid_idx on paths (file_uuid);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table paths;
+-- +goose StatementEnd
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyAuthenticator accepts static API keys sent in the X-API-Key header.
+type APIKeyAuthenticator struct {
+	// Keys are indexed by their SHA-256 so that lookups do not depend on
+	// how much of a guessed key matches.
+	keys map[[sha256.Size]byte]*Principal
+}
+
+// LoadAPIKeys reads API keys from a file. Each non-empty line that does not
+// start with '#' holds a key, the subject it authenticates as, a
+// comma-separated list of roles and optionally the tenant, separated by
+// whitespace.
+func LoadAPIKeys(path string) (*APIKeyAuthenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open api keys file")
+	}
+	defer file.Close()
+
+	authenticator := &APIKeyAuthenticator{
+		keys: make(map[[sha256.Size]byte]*Principal),
+	}
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("api keys line %d: expected key, subject, roles and optional tenant", lineNum)
+		}
+
+		tenantID := DefaultTenant
+		if len(fields) == 4 {
+			tenantID = fields[3]
+		}
+
+		roles := parseRoles(strings.Split(fields[2], ","))
+		if len(roles) == 0 {
+			return nil, fmt.Errorf("api keys line %d: no known roles in %q", lineNum, fields[2])
+		}
+
+		authenticator.keys[sha256.Sum256([]byte(fields[0]))] = &Principal{
+			Subject:  fields[1],
+			TenantID: tenantID,
+			Roles:    roles,
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read api keys file")
+	}
+
+	return authenticator, nil
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	principal, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errors.New("unknown api key")
+	}
+
+	return principal, nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_keys")
+	content := "# key subject roles [tenant]\nsecret-1 alice writer team-a\nsecret-2 ops admin,reader\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write api keys: %v", err)
+	}
+
+	authenticator, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatalf("load api keys: %v", err)
+	}
+
+	tests := []struct {
+		key         string
+		wantSubject string
+		wantTenant  string
+		wantErr     bool
+	}{
+		{"secret-1", "alice", "team-a", false},
+		{"secret-2", "ops", DefaultTenant, false},
+		{"secret-3", "", "", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/files/get", nil)
+		r.Header.Set(APIKeyHeader, tt.key)
+
+		principal, err := authenticator.Authenticate(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("key %s: unexpected error %v", tt.key, err)
+			continue
+		}
+
+		if err == nil && (principal.Subject != tt.wantSubject || principal.TenantID != tt.wantTenant) {
+			t.Errorf("key %s: expected %s in %s, got %s in %s", tt.key, tt.wantSubject, tt.wantTenant, principal.Subject, principal.TenantID)
+		}
+	}
+
+	if _, err := authenticator.Authenticate(httptest.NewRequest("GET", "/", nil)); err != ErrNoCredentials {
+		t.Errorf("Expected ErrNoCredentials without a key, got %v", err)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"k1","x":%q}]}`, base64.RawURLEncoding.EncodeToString(publicKey))
+	if err := os.WriteFile(path, []byte(jwks), 0o600); err != nil {
+		t.Fatalf("write jwks: %v", err)
+	}
+
+	authenticator, err := NewJWTAuthenticator(JWTConfig{JWKSFile: path, Issuer: "karma8-test"})
+	if err != nil {
+		t.Fatalf("new jwt authenticator: %v", err)
+	}
+
+	sign := func(key ed25519.PrivateKey, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("sign token: %v", err)
+		}
+		return signed
+	}
+
+	valid := jwt.MapClaims{"sub": "bob", "iss": "karma8-test", "roles": []string{"reader"}, "exp": time.Now().Add(time.Hour).Unix()}
+	expired := jwt.MapClaims{"sub": "bob", "iss": "karma8-test", "exp": time.Now().Add(-time.Hour).Unix()}
+	wrongIssuer := jwt.MapClaims{"sub": "bob", "iss": "someone-else", "exp": time.Now().Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", sign(privateKey, valid), false},
+		{"expired", sign(privateKey, expired), true},
+		{"wrong issuer", sign(privateKey, wrongIssuer), true},
+		{"wrong key", sign(otherKey, valid), true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/files/get", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+
+		principal, err := authenticator.Authenticate(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+
+		if err == nil && (principal.Subject != "bob" || !principal.Can(PermissionRead) || principal.Can(PermissionWrite)) {
+			t.Errorf("%s: unexpected principal %+v", tt.name, principal)
+		}
+	}
+}
+
+func TestPrincipal_CanAccess(t *testing.T) {
+	tests := []struct {
+		principal Principal
+		owner     string
+		tenantID  string
+		want      bool
+	}{
+		{Principal{Subject: "alice", TenantID: "a", Roles: []Role{RoleReader}}, "alice", "a", true},
+		{Principal{Subject: "alice", TenantID: "a", Roles: []Role{RoleReader}}, "alice", "b", false},
+		{Principal{Subject: "alice", TenantID: "a", Roles: []Role{RoleWriter}}, "bob", "a", false},
+		{Principal{Subject: "alice", TenantID: "a"}, "alice", "a", false},
+		{Principal{Subject: "ops", TenantID: "a", Roles: []Role{RoleAdmin}}, "bob", "b", true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.principal.CanAccess("file", tt.owner, tt.tenantID); got != tt.want {
+			t.Errorf("%+v accessing file of %q in %q: expected %v, got %v", tt.principal, tt.owner, tt.tenantID, tt.want, got)
+		}
+	}
+}
+
+func TestPrincipal_CanDelete(t *testing.T) {
+	tests := []struct {
+		principal Principal
+		owner     string
+		want      bool
+	}{
+		{Principal{Subject: "alice", TenantID: "a", Roles: []Role{RoleWriter}}, "alice", true},
+		{Principal{Subject: "alice", TenantID: "a", Roles: []Role{RoleReader}}, "alice", false},
+		{Principal{Subject: "alice", TenantID: "a", Roles: []Role{RoleWriter}}, "bob", false},
+		{Principal{Subject: "ops", TenantID: "a", Roles: []Role{RoleAdmin}}, "bob", true},
+		{Principal{Subject: "alice", TenantID: "a", Presigned: &Presigned{Method: "POST"}}, "alice", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.principal.CanDelete(tt.owner, "a"); got != tt.want {
+			t.Errorf("%+v deleting file of %q: expected %v, got %v", tt.principal, tt.owner, tt.want, got)
+		}
+	}
+}
+
+func TestPresigner(t *testing.T) {
+	presigner, err := NewPresigner([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("new presigner: %v", err)
+	}
+
+	download := Presigned{
+		Method:   "GET",
+		FileUUID: "file-1",
+		Subject:  "alice",
+		TenantID: "a",
+		Expires:  time.Now().Add(time.Hour),
+	}
+	expired := download
+	expired.Expires = time.Now().Add(-time.Minute)
+
+	signed := presigner.SignURL("/api/files/get", download)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		wantErr error
+	}{
+		{"valid", "GET", signed, nil},
+		{"wrong method", "POST", signed, ErrPresignSignature},
+		{"wrong path", "GET", strings.Replace(signed, "/get", "/upload", 1), ErrPresignSignature},
+		{"tampered file", "GET", strings.Replace(signed, "file-1", "file-2", 1), ErrPresignSignature},
+		{"expired", "GET", presigner.SignURL("/api/files/get", expired), ErrPresignExpired},
+		{"unsigned", "GET", "/api/files/get?file_uuid=file-1", ErrNoCredentials},
+	}
+
+	for _, tt := range tests {
+		principal, err := presigner.Authenticate(httptest.NewRequest(tt.method, tt.target, nil))
+		if err != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+
+		if err == nil && (!principal.CanAccess("file-1", "bob", "b") || principal.CanAccess("file-2", "alice", "a") || principal.Can(PermissionWrite)) {
+			t.Errorf("%s: presigned principal exceeds its grant: %+v", tt.name, principal.Presigned)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"karma8/common/apierror"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request carries
+// no credentials it understands, so that the next one can be tried.
+var ErrNoCredentials = errors.New("no credentials")
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Middleware authenticates every request with the first authenticator that
+// finds credentials in it and rejects requests none of them accept.
+func Middleware(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, authenticator := range authenticators {
+				principal, err := authenticator.Authenticate(r)
+				if errors.Is(err, ErrNoCredentials) {
+					continue
+				}
+				if err != nil {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication failed: "+err.Error())
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+				return
+			}
+
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		})
+	}
+}
+
+// Require rejects requests whose principal lacks the permission.
+func Require(permission Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+				return
+			}
+
+			if !principal.Can(permission) {
+				apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Anonymous authenticates every request as an admin without a subject. It
+// is used when no authentication is configured.
+type Anonymous struct{}
+
+func (Anonymous) Authenticate(*http.Request) (*Principal, error) {
+	return &Principal{TenantID: DefaultTenant, Roles: []Role{RoleAdmin}}, nil
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Query parameters of a presigned URL.
+const (
+	presignFileParam      = "file_uuid"
+	presignExpiresParam   = "expires"
+	presignSubjectParam   = "subject"
+	presignTenantParam    = "tenant"
+	presignMaxSizeParam   = "max_size"
+	presignSignatureParam = "signature"
+)
+
+var (
+	ErrPresignExpired   = errors.New("presigned url expired")
+	ErrPresignSignature = errors.New("presigned url signature mismatch")
+)
+
+// Presigned is the grant carried by a presigned URL: the holder may perform
+// Method on the file until Expires, on behalf of Subject in TenantID.
+type Presigned struct {
+	Method   string
+	FileUUID string
+	Subject  string
+	TenantID string
+	Expires  time.Time
+	// MaxSize limits the size of an uploaded file. Zero means no limit.
+	MaxSize int64
+}
+
+// Presigner issues and verifies URLs signed with an HMAC-SHA256 over the
+// method, path, file, expiry and constraints of the request.
+type Presigner struct {
+	secret []byte
+}
+
+func NewPresigner(secret []byte) (*Presigner, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("presign secret must be at least 32 bytes")
+	}
+
+	return &Presigner{secret: secret}, nil
+}
+
+// SignURL returns path with the query parameters that grant presigned.
+func (p *Presigner) SignURL(path string, presigned Presigned) string {
+	query := url.Values{}
+	query.Set(presignFileParam, presigned.FileUUID)
+	query.Set(presignExpiresParam, strconv.FormatInt(presigned.Expires.Unix(), 10))
+	query.Set(presignSubjectParam, presigned.Subject)
+	query.Set(presignTenantParam, presigned.TenantID)
+	if presigned.MaxSize > 0 {
+		query.Set(presignMaxSizeParam, strconv.FormatInt(presigned.MaxSize, 10))
+	}
+	query.Set(presignSignatureParam, p.sign(path, presigned))
+
+	return path + "?" + query.Encode()
+}
+
+// Authenticate accepts requests to a presigned URL. The principal it returns
+// is limited to the grant of the URL.
+func (p *Presigner) Authenticate(r *http.Request) (*Principal, error) {
+	query := r.URL.Query()
+	signature := query.Get(presignSignatureParam)
+	if signature == "" {
+		return nil, ErrNoCredentials
+	}
+
+	expires, err := strconv.ParseInt(query.Get(presignExpiresParam), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse expires")
+	}
+
+	var maxSize int64
+	if value := query.Get(presignMaxSizeParam); value != "" {
+		maxSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse max_size")
+		}
+	}
+
+	presigned := &Presigned{
+		Method:   r.Method,
+		FileUUID: query.Get(presignFileParam),
+		Subject:  query.Get(presignSubjectParam),
+		TenantID: query.Get(presignTenantParam),
+		Expires:  time.Unix(expires, 0),
+		MaxSize:  maxSize,
+	}
+
+	expected := p.sign(r.URL.Path, *presigned)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrPresignSignature
+	}
+
+	if time.Now().After(presigned.Expires) {
+		return nil, ErrPresignExpired
+	}
+
+	return &Principal{
+		Subject:   presigned.Subject,
+		TenantID:  presigned.TenantID,
+		Presigned: presigned,
+	}, nil
+}
+
+func (p *Presigner) sign(path string, presigned Presigned) string {
+	canonical := strings.Join([]string{
+		presigned.Method,
+		path,
+		presigned.FileUUID,
+		strconv.FormatInt(presigned.Expires.Unix(), 10),
+		presigned.Subject,
+		presigned.TenantID,
+		strconv.FormatInt(presigned.MaxSize, 10),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+type Role string
+
+const (
+	RoleReader Role = "reader"
+	RoleWriter Role = "writer"
+	RoleAdmin  Role = "admin"
+)
+
+type Permission string
+
+const (
+	PermissionRead  Permission = "files:read"
+	PermissionWrite Permission = "files:write"
+	// PermissionReadAny grants access to files owned by anyone.
+	PermissionReadAny       Permission = "files:read_any"
+	PermissionManageTenants Permission = "tenants:manage"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleReader: {PermissionRead},
+	RoleWriter: {PermissionRead, PermissionWrite},
+	RoleAdmin:  {PermissionRead, PermissionWrite, PermissionReadAny, PermissionManageTenants},
+}
+
+// DefaultTenant is the tenant of callers whose credentials name none.
+const DefaultTenant = "default"
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject  string
+	TenantID string
+	Roles    []Role
+	// Presigned is set for requests authenticated by a presigned URL, which
+	// only grant the signed method on the signed file.
+	Presigned *Presigned
+}
+
+func (p *Principal) Can(permission Permission) bool {
+	if p.Presigned != nil {
+		switch p.Presigned.Method {
+		case http.MethodGet:
+			return permission == PermissionRead
+		case http.MethodPost:
+			return permission == PermissionWrite
+		}
+		return false
+	}
+
+	for _, role := range p.Roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CanAccess reports whether the principal may read the file with the given
+// owner and tenant.
+func (p *Principal) CanAccess(fileUUID string, owner string, tenantID string) bool {
+	if p.Presigned != nil {
+		return p.Presigned.Method == http.MethodGet && p.Presigned.FileUUID == fileUUID
+	}
+
+	if p.Can(PermissionReadAny) {
+		return true
+	}
+
+	return p.Can(PermissionRead) && p.Subject == owner && p.TenantID == tenantID
+}
+
+// CanDelete reports whether the principal may delete the file with the given
+// owner and tenant. Presigned URLs never grant deletion.
+func (p *Principal) CanDelete(owner string, tenantID string) bool {
+	if p.Presigned != nil || !p.Can(PermissionWrite) {
+		return false
+	}
+
+	return p.Can(PermissionReadAny) || (p.Subject == owner && p.TenantID == tenantID)
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+func parseRoles(names []string) []Role {
+	roles := make([]Role, 0, len(names))
+	for _, name := range names {
+		if _, ok := rolePermissions[Role(name)]; ok {
+			roles = append(roles, Role(name))
+		}
+	}
+
+	return roles
+}
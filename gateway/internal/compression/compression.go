@@ -0,0 +1,172 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+type Codec string
+
+func (c Codec) String() string {
+	return string(c)
+}
+
+const (
+	CodecNone Codec = "none"
+	CodecZstd Codec = "zstd"
+	CodecGzip Codec = "gzip"
+)
+
+const (
+	// SampleSize is how much of a chunk is test-compressed to decide whether
+	// the chunk is worth compressing.
+	SampleSize = 64 << 10
+	// minSize is the smallest chunk that is compressed at all; below it the
+	// codec framing outweighs any savings.
+	minSize = 512
+)
+
+func ParseCodec(s string) (Codec, error) {
+	switch Codec(s) {
+	case "", CodecNone:
+		return CodecNone, nil
+	case CodecZstd, CodecGzip:
+		return Codec(s), nil
+	default:
+		return "", fmt.Errorf("unknown compression codec %q", s)
+	}
+}
+
+// NewWriter returns a writer that compresses into w. Close flushes the codec
+// but does not close w.
+func NewWriter(codec Codec, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CodecNone:
+		return nopWriteCloser{w}, nil
+	case CodecZstd:
+		encoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "new zstd writer")
+		}
+		return encoder, nil
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+}
+
+// NewReader returns a reader that decompresses r.
+func NewReader(codec Codec, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CodecNone:
+		return io.NopCloser(r), nil
+	case CodecZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "new zstd reader")
+		}
+		return decoder.IOReadCloser(), nil
+	case CodecGzip:
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "new gzip reader")
+		}
+		return reader, nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+}
+
+// NewDecompressWriter returns a writer that decompresses what is written to
+// it into w. Close must be called to finish decompression; it reports any
+// error from the codec.
+func NewDecompressWriter(codec Codec, w io.Writer) io.WriteCloser {
+	if codec == CodecNone {
+		return nopWriteCloser{w}
+	}
+
+	pr, pw := io.Pipe()
+	d := &decompressWriter{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		reader, err := NewReader(codec, pr)
+		if err == nil {
+			_, err = io.Copy(w, reader)
+			reader.Close()
+		}
+
+		// Unblock the writer if decompression stopped early.
+		pr.CloseWithError(err)
+		d.done <- err
+	}()
+
+	return d
+}
+
+type decompressWriter struct {
+	pw     *io.PipeWriter
+	done   chan error
+	closed bool
+	err    error
+}
+
+func (d *decompressWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+func (d *decompressWriter) Close() error {
+	if d.closed {
+		return d.err
+	}
+	d.closed = true
+
+	d.pw.Close()
+	d.err = <-d.done
+
+	return d.err
+}
+
+// Choose returns codec if compressing sample with it saves at least a tenth
+// of the space, and CodecNone otherwise.
+func Choose(codec Codec, sample []byte) Codec {
+	if codec == "" || codec == CodecNone || len(sample) < minSize {
+		return CodecNone
+	}
+
+	var compressed bytes.Buffer
+	writer, err := NewWriter(codec, &compressed)
+	if err != nil {
+		return CodecNone
+	}
+
+	if _, err := writer.Write(sample); err != nil {
+		return CodecNone
+	}
+
+	if err := writer.Close(); err != nil {
+		return CodecNone
+	}
+
+	if compressed.Len() >= len(sample)*9/10 {
+		return CodecNone
+	}
+
+	return codec
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
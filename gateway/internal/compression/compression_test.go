@@ -0,0 +1,73 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"level":"info","msg":"chunk uploaded"}`+"\n"), 10000)
+
+	for _, codec := range []Codec{CodecNone, CodecZstd, CodecGzip} {
+		var compressed bytes.Buffer
+		writer, err := NewWriter(codec, &compressed)
+		if err != nil {
+			t.Fatalf("%s: new writer: %v", codec, err)
+		}
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("%s: close writer: %v", codec, err)
+		}
+
+		if codec != CodecNone && compressed.Len() >= len(data) {
+			t.Errorf("%s: expected data to shrink, got %d of %d bytes", codec, compressed.Len(), len(data))
+		}
+
+		var decompressed bytes.Buffer
+		decompressor := NewDecompressWriter(codec, &decompressed)
+		if _, err := decompressor.Write(compressed.Bytes()); err != nil {
+			t.Fatalf("%s: decompress: %v", codec, err)
+		}
+		if err := decompressor.Close(); err != nil {
+			t.Fatalf("%s: close decompressor: %v", codec, err)
+		}
+
+		if !bytes.Equal(decompressed.Bytes(), data) {
+			t.Errorf("%s: decompressed data does not match", codec)
+		}
+	}
+}
+
+func TestDecompressWriter_Corrupted(t *testing.T) {
+	decompressor := NewDecompressWriter(CodecZstd, &bytes.Buffer{})
+	decompressor.Write([]byte("definitely not zstd"))
+
+	if err := decompressor.Close(); err == nil {
+		t.Errorf("Expected an error for corrupted input")
+	}
+}
+
+func TestChoose(t *testing.T) {
+	random := make([]byte, SampleSize)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("karma8 "), SampleSize/7)
+
+	tests := []struct {
+		name   string
+		codec  Codec
+		sample []byte
+		want   Codec
+	}{
+		{"compressible", CodecZstd, text, CodecZstd},
+		{"incompressible", CodecZstd, random, CodecNone},
+		{"too small", CodecGzip, text[:100], CodecNone},
+		{"disabled", CodecNone, text, CodecNone},
+	}
+
+	for _, tt := range tests {
+		if got := Choose(tt.codec, tt.sample); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gateway/internal/compression"
+	"gateway/internal/ratelimit"
+	"gateway/internal/storage"
+	"karma8/common/configload"
+	"karma8/common/server"
+
+	"github.com/pkg/errors"
+)
+
+// maxStorageInstances bounds NUM_STORAGE_INSTANCES, the node count of the
+// default docker-compose naming scheme. Nodes listed by address are not
+// bounded.
+const maxStorageInstances = 20
+
+type Config struct {
+	HTTP       HTTPConfig       `yaml:"http"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Storage    StorageConfig    `yaml:"storage"`
+	Upload     UploadConfig     `yaml:"upload"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Auth       AuthConfig       `yaml:"auth"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	Log        LogConfig        `yaml:"log"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+}
+
+type HTTPConfig struct {
+	Port               string        `yaml:"port" env:"PORT"`
+	ReadHeaderTimeout  time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	ReadTimeout        time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout       time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout        time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	DrainDelay         time.Duration `yaml:"drain_delay" env:"SHUTDOWN_DRAIN_DELAY"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	PublicURL          string        `yaml:"public_url" env:"PUBLIC_URL"`
+	CORSAllowedOrigins []string      `yaml:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+}
+
+type DatabaseConfig struct {
+	DSN string `yaml:"dsn" env:"DSN" secret:"true"`
+}
+
+type StorageConfig struct {
+	// Addresses lists the storage nodes. Their order defines the storage IDs
+	// recorded for chunks, so nodes may only be appended.
+	Addresses []string `yaml:"addresses" env:"STORAGE_ADDRESSES"`
+	// Address is a single node, used when Addresses is empty.
+	Address string `yaml:"address" env:"STORAGE_HTTP_ADDR"`
+	// NumInstances nodes named storage-1:8081 and on are used when neither
+	// Addresses nor Address is set.
+	NumInstances int `yaml:"num_instances" env:"NUM_STORAGE_INSTANCES"`
+
+	RetryAttempts         int           `yaml:"retry_attempts" env:"STORAGE_RETRY_ATTEMPTS"`
+	RetryBackoff          time.Duration `yaml:"retry_backoff" env:"STORAGE_RETRY_BACKOFF"`
+	RetryMaxBackoff       time.Duration `yaml:"retry_max_backoff" env:"STORAGE_RETRY_MAX_BACKOFF"`
+	ConnectTimeout        time.Duration `yaml:"connect_timeout" env:"STORAGE_CONNECT_TIMEOUT"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout" env:"STORAGE_RESPONSE_HEADER_TIMEOUT"`
+	BaseTimeout           time.Duration `yaml:"base_timeout" env:"STORAGE_BASE_TIMEOUT"`
+	MinThroughput         int64         `yaml:"min_throughput" env:"STORAGE_MIN_THROUGHPUT"`
+	IdleTimeout           time.Duration `yaml:"idle_timeout" env:"STORAGE_IDLE_TIMEOUT"`
+
+	TLSCertFile   string `yaml:"tls_cert_file" env:"STORAGE_TLS_CERT_FILE"`
+	TLSKeyFile    string `yaml:"tls_key_file" env:"STORAGE_TLS_KEY_FILE"`
+	TLSCAFile     string `yaml:"tls_ca_file" env:"STORAGE_TLS_CA_FILE"`
+	TLSServerName string `yaml:"tls_server_name" env:"STORAGE_TLS_SERVER_NAME"`
+	SigningSecret string `yaml:"signing_secret" env:"STORAGE_SIGNING_SECRET" secret:"true"`
+}
+
+// NodeAddresses returns the storage nodes to use.
+func (c StorageConfig) NodeAddresses() []string {
+	if len(c.Addresses) > 0 {
+		return c.Addresses
+	}
+
+	if c.Address != "" {
+		return []string{c.Address}
+	}
+
+	addrs := make([]string, 0, c.NumInstances)
+	for i := 1; i <= c.NumInstances; i++ {
+		addrs = append(addrs, fmt.Sprintf("storage-%d:8081", i))
+	}
+
+	return addrs
+}
+
+type UploadConfig struct {
+	Dir             string        `yaml:"dir" env:"UPLOAD_DIR"`
+	MemoryBuffer    int64         `yaml:"memory_buffer" env:"UPLOAD_MEMORY_BUFFER"`
+	Compression     string        `yaml:"compression" env:"COMPRESSION"`
+	CleanupInterval time.Duration `yaml:"cleanup_interval" env:"UPLOAD_CLEANUP_INTERVAL"`
+	AbortAfter      time.Duration `yaml:"abort_after" env:"UPLOAD_ABORT_AFTER"`
+}
+
+type EncryptionConfig struct {
+	Keyfile string `yaml:"keyfile" env:"ENCRYPTION_KEYFILE"`
+}
+
+type AuthConfig struct {
+	APIKeysFile    string `yaml:"api_keys_file" env:"API_KEYS_FILE"`
+	JWTJWKSFile    string `yaml:"jwt_jwks_file" env:"JWT_JWKS_FILE"`
+	JWTIssuer      string `yaml:"jwt_issuer" env:"JWT_ISSUER"`
+	JWTAudience    string `yaml:"jwt_audience" env:"JWT_AUDIENCE"`
+	JWTRolesClaim  string `yaml:"jwt_roles_claim" env:"JWT_ROLES_CLAIM"`
+	JWTTenantClaim string `yaml:"jwt_tenant_claim" env:"JWT_TENANT_CLAIM"`
+	PresignSecret  string `yaml:"presign_secret" env:"PRESIGN_SECRET" secret:"true"`
+}
+
+type RateLimitConfig struct {
+	By                string  `yaml:"by" env:"RATE_LIMIT_BY"`
+	RequestsPerSecond float64 `yaml:"requests_per_second" env:"RATE_LIMIT_RPS"`
+	Burst             int     `yaml:"burst" env:"RATE_LIMIT_BURST"`
+	BytesPerSecond    int64   `yaml:"bytes_per_second" env:"RATE_LIMIT_BYTES_PER_SECOND"`
+	// File holds per-key overrides, see ratelimit.LoadOverrides.
+	File string `yaml:"file" env:"RATE_LIMITS_FILE"`
+	// IPRequestsPerSecond and IPBurst limit every client IP before
+	// authentication.
+	IPRequestsPerSecond float64 `yaml:"ip_requests_per_second" env:"RATE_LIMIT_IP_RPS"`
+	IPBurst             int     `yaml:"ip_burst" env:"RATE_LIMIT_IP_BURST"`
+	// TrustedProxies are the IPs or CIDR ranges of the proxies whose
+	// X-Forwarded-For entries are believed.
+	TrustedProxies []string `yaml:"trusted_proxies" env:"RATE_LIMIT_TRUSTED_PROXIES"`
+}
+
+// Limiter returns the rate limiter config, loading the overrides file.
+func (c RateLimitConfig) Limiter() (ratelimit.Config, error) {
+	keyBy, err := ratelimit.ParseKeyBy(c.By)
+	if err != nil {
+		return ratelimit.Config{}, err
+	}
+
+	trustedProxies, err := ratelimit.ParseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return ratelimit.Config{}, err
+	}
+
+	config := ratelimit.Config{
+		KeyBy: keyBy,
+		Default: ratelimit.Limits{
+			RequestsPerSecond: c.RequestsPerSecond,
+			RequestBurst:      c.Burst,
+			BytesPerSecond:    c.BytesPerSecond,
+		},
+		PerIP: ratelimit.Limits{
+			RequestsPerSecond: c.IPRequestsPerSecond,
+			RequestBurst:      c.IPBurst,
+		},
+		TrustedProxies: trustedProxies,
+	}
+
+	if c.File != "" {
+		config.Overrides, err = ratelimit.LoadOverrides(c.File)
+		if err != nil {
+			return ratelimit.Config{}, err
+		}
+	}
+
+	return config, nil
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type TracingConfig struct {
+	Exporter string `yaml:"exporter" env:"TRACING_EXPORTER"`
+	File     string `yaml:"file" env:"TRACING_FILE"`
+}
+
+func Default() Config {
+	serverDefaults := server.DefaultConfig()
+	storageDefaults := storage.DefaultConfig()
+
+	return Config{
+		HTTP: HTTPConfig{
+			Port:              "8080",
+			ReadHeaderTimeout: serverDefaults.ReadHeaderTimeout,
+			ReadTimeout:       serverDefaults.ReadTimeout,
+			WriteTimeout:      serverDefaults.WriteTimeout,
+			IdleTimeout:       serverDefaults.IdleTimeout,
+			DrainDelay:        serverDefaults.DrainDelay,
+			ShutdownTimeout:   serverDefaults.ShutdownTimeout,
+		},
+		Storage: StorageConfig{
+			NumInstances:          10,
+			RetryAttempts:         storageDefaults.RetryAttempts,
+			RetryBackoff:          storageDefaults.RetryBackoff,
+			RetryMaxBackoff:       storageDefaults.RetryMaxBackoff,
+			ConnectTimeout:        storageDefaults.ConnectTimeout,
+			ResponseHeaderTimeout: storageDefaults.ResponseHeaderTimeout,
+			BaseTimeout:           storageDefaults.BaseTimeout,
+			MinThroughput:         storageDefaults.MinThroughput,
+			IdleTimeout:           storageDefaults.IdleTimeout,
+		},
+		Upload: UploadConfig{
+			Dir:             "./uploads",
+			MemoryBuffer:    8 << 20,
+			CleanupInterval: 10 * time.Minute,
+			AbortAfter:      24 * time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			By:      "ip",
+			Burst:   1,
+			IPBurst: 1,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+	}
+}
+
+// Load builds the config from the defaults, the YAML file named by -config
+// or CONFIG_FILE, the environment and the flags in args, and validates it.
+// It returns the arguments left after the flags.
+func Load(args []string) (Config, []string, error) {
+	cfg := Default()
+
+	rest, err := configload.Load(&cfg, args, os.Getenv)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, nil, err
+	}
+
+	return cfg, rest, nil
+}
+
+// Validate reports every invalid value at once.
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Database.DSN != "", "database.dsn (DSN) is required")
+
+	if len(c.Storage.Addresses) == 0 && c.Storage.Address == "" {
+		check(c.Storage.NumInstances >= 1 && c.Storage.NumInstances <= maxStorageInstances,
+			"storage.num_instances (NUM_STORAGE_INSTANCES) must be between 1 and %d, got %d", maxStorageInstances, c.Storage.NumInstances)
+	}
+	check(c.Storage.RetryAttempts >= 1, "storage.retry_attempts must be at least 1, got %d", c.Storage.RetryAttempts)
+	check(c.Storage.MinThroughput > 0, "storage.min_throughput must be positive, got %d", c.Storage.MinThroughput)
+	check((c.Storage.TLSCertFile == "") == (c.Storage.TLSKeyFile == "") && (c.Storage.TLSCertFile == "" || c.Storage.TLSCAFile != ""),
+		"storage: tls_cert_file, tls_key_file and tls_ca_file must be set together")
+
+	check(c.Upload.Dir != "", "upload.dir is required")
+	check(c.Upload.MemoryBuffer >= 0, "upload.memory_buffer must not be negative")
+	check(c.Upload.CleanupInterval > 0, "upload.cleanup_interval must be positive")
+	check(c.Upload.AbortAfter > 0, "upload.abort_after must be positive")
+	if _, err := compression.ParseCodec(c.Upload.Compression); err != nil {
+		problems = append(problems, "upload.compression: "+err.Error())
+	}
+
+	check(c.Auth.PresignSecret == "" || len(c.Auth.PresignSecret) >= 32, "auth.presign_secret must be at least 32 bytes")
+	check(c.Storage.SigningSecret == "" || len(c.Storage.SigningSecret) >= 32, "storage.signing_secret must be at least 32 bytes")
+
+	if _, err := ratelimit.ParseKeyBy(c.RateLimit.By); err != nil {
+		problems = append(problems, "rate_limit.by: "+err.Error())
+	}
+	check(c.RateLimit.RequestsPerSecond >= 0, "rate_limit.requests_per_second must not be negative")
+	check(c.RateLimit.BytesPerSecond >= 0, "rate_limit.bytes_per_second must not be negative")
+	check(c.RateLimit.IPRequestsPerSecond >= 0, "rate_limit.ip_requests_per_second must not be negative")
+	if _, err := ratelimit.ParseTrustedProxies(c.RateLimit.TrustedProxies); err != nil {
+		problems = append(problems, "rate_limit.trusted_proxies: "+err.Error())
+	}
+
+	check(c.HTTP.Port != "", "http.port is required")
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout must be positive")
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("log.level must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format must be json or text, got %q", c.Log.Format)
+
+	switch c.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	case "file":
+		check(c.Tracing.File != "", "tracing.file is required by the file exporter")
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter must be otlp, stdout, file or empty, got %q", c.Tracing.Exporter))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// Redacted renders the config as YAML with secrets hidden, for logging the
+// effective config.
+func (c Config) Redacted() string {
+	return configload.Redacted(&c)
+}
+
+// RestartRequired reports whether next differs from c in settings that are
+// not applied on reload. Only the storage node list, the rate limits and the
+// log level are reloaded.
+func (c Config) RestartRequired(next Config) bool {
+	return !reflect.DeepEqual(c.withoutReloadable(), next.withoutReloadable())
+}
+
+func (c Config) withoutReloadable() Config {
+	c.Storage.Addresses = nil
+	c.Storage.Address = ""
+	c.Storage.NumInstances = 0
+	c.RateLimit = RateLimitConfig{}
+	c.Log.Level = ""
+	return c
+}
@@ -0,0 +1,164 @@
+package encryption
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const DataKeySize = 32
+
+var ErrUnknownKey = errors.New("unknown master key")
+
+// KeyWrapper protects per-file data keys with a master key. The local keyfile
+// implementation is LocalKeyring; a KMS can be plugged in by implementing the
+// same interface.
+type KeyWrapper interface {
+	// PrimaryKeyID is the ID of the master key new data keys are wrapped with.
+	PrimaryKeyID() string
+	// WrapKey and UnwrapKey bind the wrapped key to the file it belongs to,
+	// so that a data key copied to another file's record cannot be
+	// unwrapped there.
+	WrapKey(ctx context.Context, dataKey []byte, fileUUID string) (wrapped []byte, keyID string, err error)
+	UnwrapKey(ctx context.Context, wrapped []byte, keyID string, fileUUID string) ([]byte, error)
+}
+
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "read random")
+	}
+
+	return key, nil
+}
+
+// LocalKeyring wraps data keys with AES-256-GCM master keys read from a
+// keyfile. Each non-empty line that does not start with '#' holds a key ID
+// and a base64-encoded 32-byte key separated by whitespace. The first key is
+// the primary one; older keys stay in the file until every data key has
+// been re-wrapped with the primary key.
+type LocalKeyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+func LoadKeyfile(path string) (*LocalKeyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open keyfile")
+	}
+	defer file.Close()
+
+	keyring := &LocalKeyring{
+		keys: make(map[string]cipher.AEAD),
+	}
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("keyfile line %d: expected key id and key", lineNum)
+		}
+
+		keyID := fields[0]
+		if _, ok := keyring.keys[keyID]; ok {
+			return nil, fmt.Errorf("keyfile line %d: duplicate key id %q", lineNum, keyID)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("keyfile line %d: key must be 32 base64-encoded bytes", lineNum)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		keyring.keys[keyID] = aead
+		if keyring.primary == "" {
+			keyring.primary = keyID
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read keyfile")
+	}
+
+	if keyring.primary == "" {
+		return nil, errors.New("keyfile contains no keys")
+	}
+
+	return keyring, nil
+}
+
+func (k *LocalKeyring) PrimaryKeyID() string {
+	return k.primary
+}
+
+func (k *LocalKeyring) WrapKey(_ context.Context, dataKey []byte, fileUUID string) ([]byte, string, error) {
+	aead := k.keys[k.primary]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", errors.Wrap(err, "read random")
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, associatedData(k.primary, fileUUID)), k.primary, nil
+}
+
+func (k *LocalKeyring) UnwrapKey(_ context.Context, wrapped []byte, keyID string, fileUUID string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownKey, keyID)
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, ciphertext, associatedData(keyID, fileUUID))
+	if err != nil {
+		return nil, errors.Wrap(err, "unwrap data key")
+	}
+
+	return dataKey, nil
+}
+
+// associatedData authenticates a wrapped key together with the master key ID
+// and the file UUID. The key ID is length-prefixed so that no two pairs
+// yield the same bytes.
+func associatedData(keyID string, fileUUID string) []byte {
+	data := binary.AppendUvarint(nil, uint64(len(keyID)))
+	data = append(data, keyID...)
+	return append(data, fileUUID...)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "new cipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "new gcm")
+	}
+
+	return aead, nil
+}
@@ -0,0 +1,185 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Chunks are encrypted as a sequence of independently sealed AES-GCM
+// segments. Every segment but the last holds exactly SegmentSize bytes of
+// plaintext, so the ciphertext offset of any plaintext position can be
+// computed without reading the chunk, which keeps the format seekable.
+//
+// The 12-byte nonce of a segment is built from the chunk index (7 bytes), the
+// segment counter (4 bytes) and a flag marking the final segment (1 byte).
+// Nonces therefore never repeat under one data key, segments cannot be
+// reordered or moved between chunks, and truncating a chunk at a segment
+// boundary is detected. The file UUID is authenticated as additional data.
+const (
+	SegmentSize = 64 << 10
+	Overhead    = 16
+
+	encryptedSegmentSize = SegmentSize + Overhead
+)
+
+var ErrCorrupted = errors.New("encrypted chunk is corrupted")
+
+// EncryptedSize is the size of a chunk of plainSize bytes once encrypted.
+func EncryptedSize(plainSize int64) int64 {
+	segments := (plainSize + SegmentSize - 1) / SegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+
+	return plainSize + segments*Overhead
+}
+
+// SegmentOffset maps a plaintext offset to the segment that holds it, the
+// ciphertext offset that segment starts at, and the number of plaintext
+// bytes to skip inside it.
+func SegmentOffset(plainOffset int64) (segment int64, cipherOffset int64, skip int64) {
+	segment = plainOffset / SegmentSize
+	return segment, segment * encryptedSegmentSize, plainOffset % SegmentSize
+}
+
+type ChunkCipher struct {
+	aead       cipher.AEAD
+	fileUUID   []byte
+	chunkIndex int64
+}
+
+func NewChunkCipher(dataKey []byte, fileUUID string, chunkIndex int64) (*ChunkCipher, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "new cipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "new gcm")
+	}
+
+	return &ChunkCipher{
+		aead:       aead,
+		fileUUID:   []byte(fileUUID),
+		chunkIndex: chunkIndex,
+	}, nil
+}
+
+func (c *ChunkCipher) nonce(segment int64, last bool) []byte {
+	nonce := make([]byte, 12)
+
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], uint64(c.chunkIndex))
+	copy(nonce[:7], index[1:])
+
+	binary.BigEndian.PutUint32(nonce[7:11], uint32(segment))
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// EncryptWriter returns a writer that encrypts everything written to it into
+// w. Close must be called to seal the final segment.
+func (c *ChunkCipher) EncryptWriter(w io.Writer) io.WriteCloser {
+	return &segmentWriter{
+		cipher:      c,
+		w:           w,
+		segmentSize: SegmentSize,
+		seal:        true,
+		buf:         make([]byte, 0, SegmentSize),
+	}
+}
+
+// DecryptWriter returns a writer that decrypts ciphertext written to it into
+// w, starting at firstSegment. Close must be called to authenticate the final
+// segment; until then the plaintext already written to w must not be
+// trusted to be complete.
+func (c *ChunkCipher) DecryptWriter(w io.Writer, firstSegment int64) io.WriteCloser {
+	return &segmentWriter{
+		cipher:      c,
+		w:           w,
+		segmentSize: encryptedSegmentSize,
+		segment:     firstSegment,
+		buf:         make([]byte, 0, encryptedSegmentSize),
+	}
+}
+
+// segmentWriter collects input into segments and seals or opens each of them.
+// A full segment is only processed once more input arrives, because whether
+// it is the final one decides its nonce.
+type segmentWriter struct {
+	cipher      *ChunkCipher
+	w           io.Writer
+	segmentSize int
+	seal        bool
+
+	buf     []byte
+	segment int64
+	closed  bool
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed segment writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == s.segmentSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := min(len(p), s.segmentSize-len(s.buf))
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (s *segmentWriter) flush(last bool) error {
+	nonce := s.cipher.nonce(s.segment, last)
+
+	var out []byte
+	if s.seal {
+		out = s.cipher.aead.Seal(nil, nonce, s.buf, s.cipher.fileUUID)
+	} else {
+		var err error
+		out, err = s.cipher.aead.Open(nil, nonce, s.buf, s.cipher.fileUUID)
+		if err != nil {
+			return errors.Wrapf(ErrCorrupted, "segment %d", s.segment)
+		}
+	}
+
+	if _, err := s.w.Write(out); err != nil {
+		return err
+	}
+
+	s.buf = s.buf[:0]
+	s.segment++
+
+	return nil
+}
+
+func (s *segmentWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if !s.seal && len(s.buf) < Overhead {
+		return errors.Wrap(ErrCorrupted, "truncated final segment")
+	}
+
+	return s.flush(true)
+}
@@ -0,0 +1,165 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func encryptChunk(t *testing.T, key []byte, fileUUID string, chunkIndex int64, plaintext []byte) []byte {
+	t.Helper()
+
+	chunkCipher, err := NewChunkCipher(key, fileUUID, chunkIndex)
+	if err != nil {
+		t.Fatalf("new chunk cipher: %v", err)
+	}
+
+	var ciphertext bytes.Buffer
+	writer := chunkCipher.EncryptWriter(&ciphertext)
+	if _, err := writer.Write(plaintext); err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("close encryptor: %v", err)
+	}
+
+	return ciphertext.Bytes()
+}
+
+func decryptChunk(key []byte, fileUUID string, chunkIndex int64, ciphertext []byte) ([]byte, error) {
+	chunkCipher, err := NewChunkCipher(key, fileUUID, chunkIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext bytes.Buffer
+	writer := chunkCipher.DecryptWriter(&plaintext, 0)
+
+	// Feed the ciphertext in uneven pieces to exercise segment reassembly.
+	for len(ciphertext) > 0 {
+		n := min(len(ciphertext), 7919)
+		if _, err := writer.Write(ciphertext[:n]); err != nil {
+			return nil, err
+		}
+		ciphertext = ciphertext[n:]
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return plaintext.Bytes(), nil
+}
+
+func TestChunkCipher_RoundTrip(t *testing.T) {
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("new data key: %v", err)
+	}
+
+	sizes := []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 17}
+	for _, size := range sizes {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext := encryptChunk(t, key, "file", 3, plaintext)
+		if int64(len(ciphertext)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: expected %d ciphertext bytes, got %d", size, EncryptedSize(int64(size)), len(ciphertext))
+		}
+
+		decrypted, err := decryptChunk(key, "file", 3, ciphertext)
+		if err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestChunkCipher_DetectsTampering(t *testing.T) {
+	key, _ := NewDataKey()
+	plaintext := bytes.Repeat([]byte("karma8"), SegmentSize/2)
+	ciphertext := encryptChunk(t, key, "file", 0, plaintext)
+
+	flipped := bytes.Clone(ciphertext)
+	flipped[10] ^= 1
+
+	tests := []struct {
+		name       string
+		fileUUID   string
+		chunkIndex int64
+		ciphertext []byte
+	}{
+		{"flipped bit", "file", 0, flipped},
+		{"truncated at segment boundary", "file", 0, ciphertext[:SegmentSize+Overhead]},
+		{"truncated inside segment", "file", 0, ciphertext[:len(ciphertext)-1]},
+		{"other chunk index", "file", 1, ciphertext},
+		{"other file", "other", 0, ciphertext},
+	}
+
+	for _, tt := range tests {
+		_, err := decryptChunk(key, tt.fileUUID, tt.chunkIndex, tt.ciphertext)
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: expected ErrCorrupted, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestLocalKeyring_WrapUnwrap(t *testing.T) {
+	oldKey := make([]byte, 32)
+	newKey := make([]byte, 32)
+	rand.Read(oldKey)
+	rand.Read(newKey)
+
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# newest first\n" +
+		"v2 " + base64.StdEncoding.EncodeToString(newKey) + "\n" +
+		"v1 " + base64.StdEncoding.EncodeToString(oldKey) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write keyfile: %v", err)
+	}
+
+	keyring, err := LoadKeyfile(path)
+	if err != nil {
+		t.Fatalf("load keyfile: %v", err)
+	}
+
+	if keyring.PrimaryKeyID() != "v2" {
+		t.Errorf("Expected primary key v2, got %s", keyring.PrimaryKeyID())
+	}
+
+	dataKey, _ := NewDataKey()
+	wrapped, keyID, err := keyring.WrapKey(context.Background(), dataKey, "file-a")
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+
+	unwrapped, err := keyring.UnwrapKey(context.Background(), wrapped, keyID, "file-a")
+	if err != nil {
+		t.Fatalf("unwrap: %v", err)
+	}
+
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("Unwrapped key does not match")
+	}
+
+	if _, err := keyring.UnwrapKey(context.Background(), wrapped, "v1", "file-a"); err == nil {
+		t.Errorf("Expected unwrapping with the wrong key to fail")
+	}
+
+	if _, err := keyring.UnwrapKey(context.Background(), wrapped, keyID, "file-b"); err == nil {
+		t.Errorf("Expected unwrapping for another file to fail")
+	}
+
+	if _, err := keyring.UnwrapKey(context.Background(), wrapped, "v3", "file-a"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
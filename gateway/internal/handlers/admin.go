@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+
+	"gateway/internal/repository"
+	"gateway/internal/service"
+	"karma8/common/apierror"
+)
+
+type AdminHandler struct {
+	tenantService *service.TenantService
+	fsckService   *service.FsckService
+}
+
+func NewAdminHandler(tenantService *service.TenantService, fsckService *service.FsckService) *AdminHandler {
+	return &AdminHandler{
+		tenantService: tenantService,
+		fsckService:   fsckService,
+	}
+}
+
+type tenantRequest struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	QuotaBytes   *int64 `json:"quota_bytes"`
+	QuotaObjects *int64 `json:"quota_objects"`
+}
+
+type tenantResponse struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	QuotaBytes   *int64    `json:"quota_bytes"`
+	QuotaObjects *int64    `json:"quota_objects"`
+	UsedBytes    int64     `json:"used_bytes"`
+	UsedObjects  int64     `json:"used_objects"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newTenantResponse(tenant repository.Tenant) tenantResponse {
+	return tenantResponse{
+		ID:           tenant.ID,
+		Name:         tenant.Name,
+		QuotaBytes:   tenant.QuotaBytes,
+		QuotaObjects: tenant.QuotaObjects,
+		UsedBytes:    tenant.UsedBytes,
+		UsedObjects:  tenant.UsedObjects,
+		CreatedAt:    tenant.CreatedAt,
+	}
+}
+
+func (h *AdminHandler) ListTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := h.tenantService.ListTenants(r.Context())
+	if err != nil {
+		writeServiceError(w, r, "Error listing tenants", err)
+		return
+	}
+
+	response := make([]tenantResponse, 0, len(tenants))
+	for _, tenant := range tenants {
+		response = append(response, newTenantResponse(tenant))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *AdminHandler) GetTenant(w http.ResponseWriter, r *http.Request) {
+	tenant, err := h.tenantService.GetTenant(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeServiceError(w, r, "Error getting tenant", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newTenantResponse(tenant))
+}
+
+func (h *AdminHandler) CreateTenant(w http.ResponseWriter, r *http.Request) {
+	var request tenantRequest
+	if err := jsoniter.NewDecoder(r.Body).Decode(&request); err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Error decoding request: "+err.Error())
+		return
+	}
+
+	tenant := repository.Tenant{
+		ID:           request.ID,
+		Name:         request.Name,
+		QuotaBytes:   request.QuotaBytes,
+		QuotaObjects: request.QuotaObjects,
+	}
+	if err := h.tenantService.CreateTenant(r.Context(), tenant); err != nil {
+		writeServiceError(w, r, "Error creating tenant", err)
+		return
+	}
+
+	h.writeTenant(w, r, tenant.ID, http.StatusCreated)
+}
+
+// UpdateTenant replaces the name and quotas of the tenant in the path. Quotas
+// left out of the request are removed.
+func (h *AdminHandler) UpdateTenant(w http.ResponseWriter, r *http.Request) {
+	var request tenantRequest
+	if err := jsoniter.NewDecoder(r.Body).Decode(&request); err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Error decoding request: "+err.Error())
+		return
+	}
+
+	tenant := repository.Tenant{
+		ID:           mux.Vars(r)["id"],
+		Name:         request.Name,
+		QuotaBytes:   request.QuotaBytes,
+		QuotaObjects: request.QuotaObjects,
+	}
+	if err := h.tenantService.UpdateTenant(r.Context(), tenant); err != nil {
+		writeServiceError(w, r, "Error updating tenant", err)
+		return
+	}
+
+	h.writeTenant(w, r, tenant.ID, http.StatusOK)
+}
+
+func (h *AdminHandler) writeTenant(w http.ResponseWriter, r *http.Request, id string, status int) {
+	tenant, err := h.tenantService.GetTenant(r.Context(), id)
+	if err != nil {
+		writeServiceError(w, r, "Error getting tenant", err)
+		return
+	}
+
+	writeJSON(w, status, newTenantResponse(tenant))
+}
+
+// StartFsck starts checking every file against the storage nodes in the
+// background and responds with the running check. With repair=true the
+// metadata of intact chunks is repaired as well.
+func (h *AdminHandler) StartFsck(w http.ResponseWriter, r *http.Request) {
+	repair := false
+	if value := r.URL.Query().Get("repair"); value != "" {
+		var err error
+		repair, err = strconv.ParseBool(value)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid repair parameter")
+			return
+		}
+	}
+
+	job, err := h.fsckService.StartFsck(r.Context(), service.FsckOptions{Repair: repair})
+	if err != nil {
+		writeServiceError(w, r, "Error starting check", err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// GetFsck responds with the running check or the last one, including its
+// report once it finished.
+func (h *AdminHandler) GetFsck(w http.ResponseWriter, r *http.Request) {
+	job, err := h.fsckService.FsckStatus()
+	if err != nil {
+		writeServiceError(w, r, "Error getting check", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// CancelFsck stops the running check.
+func (h *AdminHandler) CancelFsck(w http.ResponseWriter, r *http.Request) {
+	job, err := h.fsckService.CancelFsck(r.Context())
+	if err != nil {
+		writeServiceError(w, r, "Error cancelling check", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notModified reports whether the conditions of a GET request allow it to be
+// answered with 304. If-Modified-Since is only considered without
+// If-None-Match, as RFC 9110 asks.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etag != "" && matchETag(header, etag, true)
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" && !modTime.IsZero() {
+		since, err := http.ParseTime(header)
+		if err != nil {
+			return false
+		}
+
+		// Last-Modified only has a resolution of seconds.
+		return !modTime.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// preconditionFailed reports whether the If-Match header of a write rules
+// it out, because the resource's current ETag is not among those listed. "*"
+// matches any existing resource.
+func preconditionFailed(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return false
+	}
+
+	// A resource without a known ETag matches no listed one.
+	return etag == "" || !matchETag(header, etag, false)
+}
+
+// matchETag reports whether the list of entity tags in header holds etag or
+// is "*". Weak tags only match with the weak comparison.
+func matchETag(header string, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if strings.HasPrefix(candidate, "W/") || strings.HasPrefix(etag, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	etag := `"abc-6"`
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		etag    string
+		want    bool
+	}{
+		{"no conditions", nil, etag, false},
+		{"matching etag", map[string]string{"If-None-Match": etag}, etag, true},
+		{"etag in list", map[string]string{"If-None-Match": `"x", ` + etag}, etag, true},
+		{"weak match", map[string]string{"If-None-Match": "W/" + etag}, etag, true},
+		{"wildcard", map[string]string{"If-None-Match": "*"}, etag, true},
+		{"other etag", map[string]string{"If-None-Match": `"x"`}, etag, false},
+		{"unknown etag", map[string]string{"If-None-Match": etag}, "", false},
+		{"not modified since", map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)}, etag, true},
+		{"modified since", map[string]string{"If-Modified-Since": modTime.Add(-time.Second).Format(http.TimeFormat)}, etag, false},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, etag, false},
+		{"etag wins over date", map[string]string{
+			"If-None-Match":     `"x"`,
+			"If-Modified-Since": modTime.Format(http.TimeFormat),
+		}, etag, false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/files/get", nil)
+		for key, value := range tt.headers {
+			r.Header.Set(key, value)
+		}
+
+		if got := notModified(r, tt.etag, modTime); got != tt.want {
+			t.Errorf("%s: notModified = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	etag := `"abc-6"`
+
+	tests := []struct {
+		ifMatch string
+		etag    string
+		want    bool
+	}{
+		{"", etag, false},
+		{etag, etag, false},
+		{`"x", ` + etag, etag, false},
+		{"*", etag, false},
+		{`"x"`, etag, true},
+		{"W/" + etag, etag, true},
+		{"*", "", false},
+		{etag, "", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodDelete, "/api/files/delete", nil)
+		if tt.ifMatch != "" {
+			r.Header.Set("If-Match", tt.ifMatch)
+		}
+
+		if got := preconditionFailed(r, tt.etag); got != tt.want {
+			t.Errorf("preconditionFailed(If-Match %q, %q) = %v, want %v", tt.ifMatch, tt.etag, got, tt.want)
+		}
+	}
+}
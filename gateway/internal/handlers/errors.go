@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"gateway/internal/service"
+	"karma8/common/apierror"
+	"karma8/common/logging"
+)
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	jsoniter.NewEncoder(w).Encode(value)
+}
+
+// writeServiceError maps the service's sentinel errors to HTTP statuses.
+// Unexpected errors are logged and answered with a fixed message.
+func writeServiceError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	status, code := http.StatusInternalServerError, apierror.CodeInternal
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		status, code = http.StatusNotFound, apierror.CodeNotFound
+	case errors.Is(err, service.ErrInvalidArgument):
+		status, code = http.StatusBadRequest, apierror.CodeInvalidArgument
+	case errors.Is(err, service.ErrAlreadyExists):
+		status, code = http.StatusConflict, apierror.CodeAlreadyExists
+	case errors.Is(err, service.ErrIncomplete):
+		status, code = http.StatusConflict, apierror.CodeFileIncomplete
+		logging.FromContext(r.Context()).Warn(strings.ToLower(message), "error", err)
+	case errors.Is(err, service.ErrPreconditionFailed):
+		status, code = http.StatusPreconditionFailed, apierror.CodePreconditionFailed
+	case errors.Is(err, service.ErrQuotaExceeded):
+		status, code = http.StatusRequestEntityTooLarge, apierror.CodeQuotaExceeded
+	case errors.Is(err, service.ErrUnavailable):
+		status, code = http.StatusServiceUnavailable, apierror.CodeUnavailable
+		logging.FromContext(r.Context()).Error(strings.ToLower(message), "error", err)
+	default:
+		logging.FromContext(r.Context()).Error(strings.ToLower(message), "error", err)
+	}
+
+	if status >= http.StatusInternalServerError {
+		apierror.WriteServerError(w, status, code)
+		return
+	}
+
+	apierror.Write(w, status, code, message+": "+err.Error())
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"gateway/internal/service"
+	"karma8/common/apierror"
+)
+
+func TestWriteServiceError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{
+			name:        "not found",
+			err:         errors.Wrap(service.ErrNotFound, "file abc"),
+			wantStatus:  http.StatusNotFound,
+			wantCode:    apierror.CodeNotFound,
+			wantMessage: "Error getting file: file abc: not found",
+		},
+		{
+			name:        "unavailable",
+			err:         errors.Wrap(service.ErrUnavailable, "dial tcp 10.0.0.7:8081"),
+			wantStatus:  http.StatusServiceUnavailable,
+			wantCode:    apierror.CodeUnavailable,
+			wantMessage: "Service unavailable",
+		},
+		{
+			name:        "unexpected",
+			err:         errors.New(`pq: relation "files" does not exist`),
+			wantStatus:  http.StatusInternalServerError,
+			wantCode:    apierror.CodeInternal,
+			wantMessage: "Internal server error",
+		},
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		writeServiceError(recorder, httptest.NewRequest(http.MethodGet, "/api/files/get", nil), "Error getting file", tt.err)
+
+		var body apierror.Error
+		if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: decode body: %v", tt.name, err)
+		}
+
+		if recorder.Code != tt.wantStatus || body.Code != tt.wantCode {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, recorder.Code, body.Code, tt.wantStatus, tt.wantCode)
+		}
+		if body.Message != tt.wantMessage {
+			t.Errorf("%s: message = %q, want %q", tt.name, body.Message, tt.wantMessage)
+		}
+	}
+}
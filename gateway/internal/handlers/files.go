@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"gateway/internal/auth"
+	"gateway/internal/repository"
+	"karma8/common/apierror"
+)
+
+type fileResponse struct {
+	FileUUID  string    `json:"file_uuid"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Owner     string    `json:"owner"`
+	TenantID  string    `json:"tenant_id"`
+	Encrypted bool      `json:"encrypted"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newFileResponse(file repository.File) fileResponse {
+	return fileResponse{
+		FileUUID:  file.UUID,
+		Name:      file.Name,
+		Size:      file.Size,
+		Owner:     file.Owner,
+		TenantID:  file.TenantID,
+		Encrypted: file.KeyID != nil,
+		CreatedAt: file.CreatedAt,
+	}
+}
+
+type listFilesResponse struct {
+	Files []fileResponse `json:"files"`
+	// NextAfter is passed as the after parameter to get the next page. It
+	// is empty on the last page.
+	NextAfter string `json:"next_after,omitempty"`
+}
+
+// StatFile returns the metadata of the file named by file_uuid or path.
+func (s *GatewayHandler) StatFile(w http.ResponseWriter, r *http.Request) {
+	if !hasFileParam(w, r) {
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		return
+	}
+
+	file, err := s.requestedFile(r, principal)
+	if err != nil {
+		writeServiceError(w, r, "Error getting file", err)
+		return
+	}
+
+	if !principal.CanAccess(file.UUID, file.Owner, file.TenantID) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newFileResponse(file))
+}
+
+// ListFiles lists the files of the caller's tenant ordered by UUID, a page at
+// a time. Callers who may read any file see those of every owner in the
+// tenant, others only their own.
+func (s *GatewayHandler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		return
+	}
+
+	if principal.Presigned != nil {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := repository.FileFilter{
+		TenantID:   principal.TenantID,
+		NamePrefix: query.Get("prefix"),
+		After:      query.Get("after"),
+	}
+	if !principal.Can(auth.PermissionReadAny) {
+		filter.Owner = principal.Subject
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid limit parameter")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	files, next, err := s.chunkerService.ListFiles(r.Context(), filter)
+	if err != nil {
+		writeServiceError(w, r, "Error listing files", err)
+		return
+	}
+
+	response := listFilesResponse{
+		Files:     make([]fileResponse, 0, len(files)),
+		NextAfter: next,
+	}
+	for _, file := range files {
+		response.Files = append(response.Files, newFileResponse(file))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// DeleteFile removes the file named by file_uuid or path, its chunks and its
+// path. With If-Match, only a file with one of the listed ETags is removed.
+func (s *GatewayHandler) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	if !hasFileParam(w, r) {
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		return
+	}
+
+	file, err := s.requestedFile(r, principal)
+	if err != nil {
+		writeServiceError(w, r, "Error getting file", err)
+		return
+	}
+
+	if !principal.CanDelete(file.Owner, file.TenantID) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+		return
+	}
+
+	// Files never change, so only a concurrent deletion can slip in between
+	// the check and the deletion, which then fails as not found.
+	if r.Header.Get("If-Match") != "" {
+		etag, err := s.chunkerService.FileETag(r.Context(), file.UUID)
+		if err != nil {
+			writeServiceError(w, r, "Error getting file", err)
+			return
+		}
+
+		if preconditionFailed(r, etag) {
+			apierror.Write(w, http.StatusPreconditionFailed, apierror.CodePreconditionFailed, "File does not match If-Match")
+			return
+		}
+	}
+
+	if err := s.chunkerService.DeleteFile(r.Context(), file.UUID); err != nil {
+		writeServiceError(w, r, "Error deleting file", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
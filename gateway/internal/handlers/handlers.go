@@ -1,71 +1,256 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
 
+	"gateway/internal/auth"
 	"gateway/internal/service"
+	"karma8/common/apierror"
+	"karma8/common/logging"
+)
+
+// Trailers sent with downloads to clients that accept them. The status is
+// "complete" or "failed" and the checksum is the SHA-256 of the file.
+const (
+	DownloadStatusTrailer = "X-Download-Status"
+	ChecksumTrailer       = "X-Checksum-SHA256"
 )
 
 type GatewayHandler struct {
-	chunkerService *service.ChunkerService
+	chunkerService   *service.ChunkerService
+	namespaceService *service.NamespaceService
 }
 
-func NewGatewayHandler(chunkerService *service.ChunkerService) *GatewayHandler {
+func NewGatewayHandler(chunkerService *service.ChunkerService, namespaceService *service.NamespaceService) *GatewayHandler {
 	return &GatewayHandler{
-		chunkerService: chunkerService,
+		chunkerService:   chunkerService,
+		namespaceService: namespaceService,
 	}
 }
 
+// UploadFile stores the file of a multipart form. With a path parameter the
+// file is also stored at that path, replacing the file there.
 func (s *GatewayHandler) UploadFile(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		return
+	}
+
+	var upload *pathUpload
+	if value := r.URL.Query().Get("path"); value != "" {
+		checked, ok := s.checkPathUpload(w, r, principal, value)
+		if !ok {
+			return
+		}
+		upload = &checked
+	}
+
+	var maxSize int64
+	if principal.Presigned != nil && principal.Presigned.MaxSize > 0 {
+		maxSize = principal.Presigned.MaxSize
+		// Leave room for the multipart framing around the file.
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	}
+
 	err := r.ParseMultipartForm(32 << 20)
 	if err != nil {
-		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Error parsing form")
 		return
 	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "Error getting file from form: "+err.Error(), http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Error getting file from form: "+err.Error())
 		return
 	}
 
 	defer file.Close()
 
-	fileUUID, err := s.chunkerService.InsertStream(r.Context(), file, header)
-	if err != nil {
-		http.Error(w, "Error loading file: "+err.Error(), http.StatusInternalServerError)
+	if maxSize > 0 && header.Size > maxSize {
+		apierror.Write(w, http.StatusRequestEntityTooLarge, apierror.CodeTooLarge, fmt.Sprintf("File exceeds the presigned size limit of %d bytes", maxSize))
 		return
 	}
 
+	opts := service.UploadOptions{
+		Owner:    principal.Subject,
+		TenantID: principal.TenantID,
+	}
+	if principal.Presigned != nil {
+		opts.FileUUID = principal.Presigned.FileUUID
+	}
+
+	var fileUUID string
+	if upload != nil {
+		fileUUID, err = s.namespaceService.Upload(r.Context(), upload.path, file, header, opts, upload.expected)
+	} else {
+		fileUUID, err = s.chunkerService.InsertStream(r.Context(), file, header, opts)
+	}
+	switch {
+	case errors.Is(err, service.ErrTenantNotFound):
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Unknown tenant: "+err.Error())
+		return
+	case err != nil:
+		writeServiceError(w, r, "Error loading file", err)
+		return
+	}
+
+	response := map[string]string{"file_uuid": fileUUID}
+	if upload != nil {
+		response["path"] = upload.path.String()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	err = jsoniter.NewEncoder(w).Encode(map[string]string{"file_uuid": fileUUID})
+	err = jsoniter.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, r, "Error encoding response", err)
 		return
 	}
 }
 
+// GetFile downloads the file named by file_uuid or path.
 func (s *GatewayHandler) GetFile(w http.ResponseWriter, r *http.Request) {
-	fileUUID := r.URL.Query().Get("file_uuid")
-	if fileUUID == "" {
-		http.Error(w, "Missing file_uuid parameter", http.StatusBadRequest)
+	if !hasFileParam(w, r) {
 		return
 	}
 
-	fmt.Printf("DEBUG: Getting file with UUID: %s\n", fileUUID)
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		return
+	}
 
-	err := s.chunkerService.SelectStream(r.Context(), fileUUID, w)
+	file, err := s.requestedFile(r, principal)
 	if err != nil {
-		fmt.Printf("DEBUG: Error in SelectStream: %v\n", err)
-		http.Error(w, "Error downloading file: "+err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, r, "Error getting file", err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
+	if !principal.CanAccess(file.UUID, file.Owner, file.TenantID) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+		return
+	}
+
+	etag, err := s.chunkerService.FileETag(r.Context(), file.UUID)
+	if err != nil {
+		writeServiceError(w, r, "Error getting file", err)
+		return
+	}
+
+	// Files never change, so the ETag and upload time stay valid until the
+	// file is deleted.
 	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Last-Modified", file.CreatedAt.UTC().Format(http.TimeFormat))
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	// A client that has the file is answered before its chunks are checked
+	// and its data key unwrapped.
+	if notModified(r, etag, file.CreatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	download, err := s.chunkerService.PrepareDownload(r.Context(), file)
+	if err != nil {
+		writeServiceError(w, r, "Error downloading file", err)
+		return
+	}
+
+	serveDownload(w, r, file.UUID, download)
+}
+
+// fileDownload is what serveDownload needs of a service.Download.
+type fileDownload interface {
+	Size() (int64, bool)
+	WriteRange(ctx context.Context, offset int64, length int64, writer io.Writer) error
+}
+
+// serveDownload streams a prepared download. Files of unknown size are
+// always sent whole, without a length or support for ranges.
+func serveDownload(w http.ResponseWriter, r *http.Request, fileUUID string, download fileDownload) {
+	size, sizeKnown := download.Size()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if sizeKnown {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	if header := r.Header.Get("Range"); header != "" && sizeKnown {
+		byteRange, ok, err := parseRange(header, size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			apierror.Write(w, http.StatusRequestedRangeNotSatisfiable, apierror.CodeRangeNotSatisfiable, "Range not satisfiable")
+			return
+		}
+
+		if ok {
+			getFileRange(w, r, fileUUID, download, size, byteRange)
+			return
+		}
+	}
+
+	// Clients that accept trailers are told the outcome and checksum of the
+	// download at its end. The others get the length up front, if it is
+	// known, and a cut connection if the download fails.
+	withTrailers := acceptsTrailers(r)
+	if withTrailers {
+		w.Header().Set("Trailer", DownloadStatusTrailer+", "+ChecksumTrailer)
+	} else if sizeKnown {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	hash := sha256.New()
+	err := download.WriteRange(r.Context(), 0, -1, io.MultiWriter(w, hash))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("download failed", "file_uuid", fileUUID, "error", err)
+		if !withTrailers {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set(DownloadStatusTrailer, "failed")
+		return
+	}
+
+	if withTrailers {
+		w.Header().Set(DownloadStatusTrailer, "complete")
+		w.Header().Set(ChecksumTrailer, hex.EncodeToString(hash.Sum(nil)))
+	}
+}
+
+// getFileRange answers a range request. Once the headers are sent a failure
+// can only cut the response short, which is done by aborting the connection.
+func getFileRange(w http.ResponseWriter, r *http.Request, fileUUID string, download fileDownload, size int64, byteRange byteRange) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", byteRange.offset, byteRange.offset+byteRange.length-1, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(byteRange.length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	err := download.WriteRange(r.Context(), byteRange.offset, byteRange.length, w)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("range download failed", "file_uuid", fileUUID, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// acceptsTrailers reports whether the client announced with TE that it
+// accepts trailers.
+func acceptsTrailers(r *http.Request) bool {
+	for _, value := range strings.Split(r.Header.Get("TE"), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), "trailers") {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeDownload serves data as a prepared download. Files backfilled before
+// sizes were recorded have an unknown size.
+type fakeDownload struct {
+	data      string
+	sizeKnown bool
+}
+
+func (d fakeDownload) Size() (int64, bool) {
+	if !d.sizeKnown {
+		return 0, false
+	}
+	return int64(len(d.data)), true
+}
+
+func (d fakeDownload) WriteRange(_ context.Context, offset int64, length int64, writer io.Writer) error {
+	end := int64(len(d.data))
+	if length >= 0 {
+		end = offset + length
+	}
+	_, err := io.WriteString(writer, d.data[offset:end])
+	return err
+}
+
+func TestServeDownload(t *testing.T) {
+	tests := []struct {
+		name              string
+		download          fakeDownload
+		rangeHeader       string
+		wantStatus        int
+		wantBody          string
+		wantContentLength string
+		wantAcceptRanges  string
+	}{
+		{"whole file", fakeDownload{"0123456789", true}, "", http.StatusOK, "0123456789", "10", "bytes"},
+		{"range", fakeDownload{"0123456789", true}, "bytes=2-4", http.StatusPartialContent, "234", "3", "bytes"},
+		{"backfilled file", fakeDownload{"0123456789", false}, "", http.StatusOK, "0123456789", "", ""},
+		{"range of a backfilled file", fakeDownload{"0123456789", false}, "bytes=2-4", http.StatusOK, "0123456789", "", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/files/get?file_uuid=file", nil)
+		if tt.rangeHeader != "" {
+			r.Header.Set("Range", tt.rangeHeader)
+		}
+		w := httptest.NewRecorder()
+
+		serveDownload(w, r, "file", tt.download)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantStatus, w.Code)
+		}
+		if w.Body.String() != tt.wantBody {
+			t.Errorf("%s: expected body %q, got %q", tt.name, tt.wantBody, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Length"); got != tt.wantContentLength {
+			t.Errorf("%s: expected Content-Length %q, got %q", tt.name, tt.wantContentLength, got)
+		}
+		if got := w.Header().Get("Accept-Ranges"); got != tt.wantAcceptRanges {
+			t.Errorf("%s: expected Accept-Ranges %q, got %q", tt.name, tt.wantAcceptRanges, got)
+		}
+	}
+}
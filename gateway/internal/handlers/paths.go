@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"gateway/internal/auth"
+	"gateway/internal/repository"
+	"gateway/internal/service"
+	"karma8/common/apierror"
+)
+
+type pathResponse struct {
+	Path string `json:"path"`
+	fileResponse
+}
+
+type listPathsResponse struct {
+	Files []pathResponse `json:"files"`
+	// CommonPrefixes are the keys rolled up by the delimiter, as
+	// directories.
+	CommonPrefixes []string `json:"common_prefixes"`
+	// NextAfter is passed as the after parameter to get the next page. It
+	// is empty on the last page.
+	NextAfter string `json:"next_after,omitempty"`
+}
+
+type renamePathRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// requestedFile returns the complete file a request names by its file_uuid
+// parameter or, within the caller's tenant, by its path parameter.
+func (s *GatewayHandler) requestedFile(r *http.Request, principal *auth.Principal) (repository.File, error) {
+	query := r.URL.Query()
+	if value := query.Get("path"); value != "" {
+		path, err := service.ParsePath(value)
+		if err != nil {
+			return repository.File{}, err
+		}
+
+		return s.namespaceService.Resolve(r.Context(), principal.TenantID, path)
+	}
+
+	return s.chunkerService.GetFile(r.Context(), query.Get("file_uuid"))
+}
+
+// hasFileParam reports whether a request names a file, and writes the error
+// response if it does not.
+func hasFileParam(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	if query.Get("file_uuid") == "" && query.Get("path") == "" {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Missing file_uuid or path parameter")
+		return false
+	}
+
+	return true
+}
+
+// pathUpload is the path an upload is stored at and the UUID of the file
+// the path named when the upload was checked, which is empty if there was
+// none.
+type pathUpload struct {
+	path     service.ObjectPath
+	expected string
+}
+
+// checkPathUpload checks that the principal may store a file at a path,
+// replacing the file there, and that the If-Match and If-None-Match headers
+// hold for that file. It writes the error response and returns false
+// otherwise.
+func (s *GatewayHandler) checkPathUpload(w http.ResponseWriter, r *http.Request, principal *auth.Principal, value string) (pathUpload, bool) {
+	if principal.Presigned != nil {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Presigned URLs cannot upload to paths")
+		return pathUpload{}, false
+	}
+
+	path, err := service.ParsePath(value)
+	if err != nil {
+		writeServiceError(w, r, "Invalid path", err)
+		return pathUpload{}, false
+	}
+
+	upload := pathUpload{path: path}
+	upload.expected, err = s.namespaceService.Lookup(r.Context(), principal.TenantID, path)
+	if err != nil && !errors.Is(err, service.ErrNotFound) {
+		writeServiceError(w, r, "Error looking up path", err)
+		return pathUpload{}, false
+	}
+
+	// A file that is being deleted is replaced as if the path were free.
+	var current *repository.File
+	if upload.expected != "" {
+		file, err := s.chunkerService.GetFile(r.Context(), upload.expected)
+		if err != nil && !errors.Is(err, service.ErrNotFound) {
+			writeServiceError(w, r, "Error getting file", err)
+			return pathUpload{}, false
+		}
+		if err == nil {
+			current = &file
+		}
+	}
+
+	if current != nil && !principal.CanDelete(current.Owner, current.TenantID) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+		return pathUpload{}, false
+	}
+
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return upload, true
+	}
+
+	var etag string
+	if current != nil {
+		etag, err = s.chunkerService.FileETag(r.Context(), current.UUID)
+		if err != nil {
+			writeServiceError(w, r, "Error getting file", err)
+			return pathUpload{}, false
+		}
+	}
+
+	if (ifMatch != "" && (current == nil || preconditionFailed(r, etag))) ||
+		(ifNoneMatch != "" && current != nil && matchETag(ifNoneMatch, etag, true)) {
+		apierror.Write(w, http.StatusPreconditionFailed, apierror.CodePreconditionFailed, "Path does not match the request conditions")
+		return pathUpload{}, false
+	}
+
+	return upload, true
+}
+
+// ListPaths lists the paths of a bucket in the caller's tenant ordered by
+// key, a page at a time. With a delimiter, the keys that contain it after
+// the prefix are listed once as common prefixes. Callers who may read any
+// file see those of every owner, others only their own.
+func (s *GatewayHandler) ListPaths(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		return
+	}
+
+	if principal.Presigned != nil {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+		return
+	}
+
+	query := r.URL.Query()
+	opts := service.PathListOptions{
+		TenantID:  principal.TenantID,
+		Bucket:    query.Get("bucket"),
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		After:     query.Get("after"),
+	}
+	if !principal.Can(auth.PermissionReadAny) {
+		opts.Owner = principal.Subject
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid limit parameter")
+			return
+		}
+		opts.Limit = limit
+	}
+
+	listing, err := s.namespaceService.List(r.Context(), opts)
+	if err != nil {
+		writeServiceError(w, r, "Error listing paths", err)
+		return
+	}
+
+	response := listPathsResponse{
+		Files:          make([]pathResponse, 0, len(listing.Files)),
+		CommonPrefixes: listing.CommonPrefixes,
+		NextAfter:      listing.NextAfter,
+	}
+	if response.CommonPrefixes == nil {
+		response.CommonPrefixes = []string{}
+	}
+	for _, file := range listing.Files {
+		response.Files = append(response.Files, pathResponse{
+			Path:         service.ObjectPath{Bucket: opts.Bucket, Key: file.Key}.String(),
+			fileResponse: newFileResponse(file.File),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// RenamePath moves the path of a file within the caller's tenant. The
+// target must be free; the file itself is not touched.
+func (s *GatewayHandler) RenamePath(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		return
+	}
+
+	var request renamePathRequest
+	if err := jsoniter.NewDecoder(r.Body).Decode(&request); err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Error decoding request: "+err.Error())
+		return
+	}
+
+	from, err := service.ParsePath(request.From)
+	if err != nil {
+		writeServiceError(w, r, "Invalid from path", err)
+		return
+	}
+
+	to, err := service.ParsePath(request.To)
+	if err != nil {
+		writeServiceError(w, r, "Invalid to path", err)
+		return
+	}
+
+	file, err := s.namespaceService.Resolve(r.Context(), principal.TenantID, from)
+	if err != nil {
+		writeServiceError(w, r, "Error getting file", err)
+		return
+	}
+
+	if !principal.CanDelete(file.Owner, file.TenantID) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+		return
+	}
+
+	if err := s.namespaceService.Rename(r.Context(), principal.TenantID, file.UUID, from, to); err != nil {
+		writeServiceError(w, r, "Error renaming path", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pathResponse{
+		Path:         to.String(),
+		fileResponse: newFileResponse(file),
+	})
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+
+	"gateway/internal/auth"
+	"gateway/internal/service"
+	"karma8/common/apierror"
+)
+
+const (
+	defaultPresignTTL = 15 * time.Minute
+	maxPresignTTL     = 7 * 24 * time.Hour
+)
+
+type PresignHandler struct {
+	presigner      *auth.Presigner
+	chunkerService *service.ChunkerService
+	// publicURL is prepended to the signed paths, so that the URLs can be
+	// handed out as they are. Without it the paths are returned relative.
+	publicURL string
+}
+
+func NewPresignHandler(presigner *auth.Presigner, chunkerService *service.ChunkerService, publicURL string) *PresignHandler {
+	return &PresignHandler{
+		presigner:      presigner,
+		chunkerService: chunkerService,
+		publicURL:      publicURL,
+	}
+}
+
+type presignRequest struct {
+	// Method is "GET" to download FileUUID or "POST" to upload a new file.
+	Method    string `json:"method"`
+	FileUUID  string `json:"file_uuid"`
+	ExpiresIn int64  `json:"expires_in"`
+	MaxSize   int64  `json:"max_size"`
+}
+
+type presignResponse struct {
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	FileUUID  string    `json:"file_uuid"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Presign issues a URL that grants the caller's access to one file to
+// whoever holds it until it expires.
+func (h *PresignHandler) Presign(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthenticated, "Authentication required")
+		return
+	}
+
+	if principal.Presigned != nil {
+		apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Presigned URLs cannot issue other presigned URLs")
+		return
+	}
+
+	var request presignRequest
+	if err := jsoniter.NewDecoder(r.Body).Decode(&request); err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Error decoding request: "+err.Error())
+		return
+	}
+
+	ttl := defaultPresignTTL
+	if request.ExpiresIn != 0 {
+		ttl = time.Duration(request.ExpiresIn) * time.Second
+	}
+	if ttl <= 0 || ttl > maxPresignTTL {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "expires_in must be between 1 second and 7 days")
+		return
+	}
+
+	if request.MaxSize < 0 {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "max_size must not be negative")
+		return
+	}
+
+	presigned := auth.Presigned{
+		Method:   request.Method,
+		Subject:  principal.Subject,
+		TenantID: principal.TenantID,
+		Expires:  time.Now().Add(ttl).Truncate(time.Second),
+	}
+
+	var path string
+	switch request.Method {
+	case http.MethodGet:
+		if !principal.Can(auth.PermissionRead) {
+			apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+			return
+		}
+
+		file, err := h.chunkerService.GetFile(r.Context(), request.FileUUID)
+		if err != nil {
+			writeServiceError(w, r, "Error getting file", err)
+			return
+		}
+
+		if !principal.CanAccess(file.UUID, file.Owner, file.TenantID) {
+			apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+			return
+		}
+
+		presigned.FileUUID = file.UUID
+		path = "/api/files/get"
+	case http.MethodPost:
+		if !principal.Can(auth.PermissionWrite) {
+			apierror.Write(w, http.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+			return
+		}
+
+		presigned.FileUUID = uuid.New().String()
+		presigned.MaxSize = request.MaxSize
+		path = "/api/files/upload"
+	default:
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, `method must be "GET" or "POST"`)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, presignResponse{
+		URL:       h.publicURL + h.presigner.SignURL(path, presigned),
+		Method:    presigned.Method,
+		FileUUID:  presigned.FileUUID,
+		ExpiresAt: presigned.Expires,
+	})
+}
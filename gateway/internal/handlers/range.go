@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a range of length bytes starting at offset.
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// parseRange parses a Range header holding a single byte range of a file of
+// the given size. It returns false for headers it does not handle, such as
+// multiple ranges, which are ignored in favour of the whole file, and
+// errRangeNotSatisfiable for ranges outside the file.
+func parseRange(header string, size int64) (byteRange, bool, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+
+	startValue, endValue, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false, nil
+	}
+
+	if startValue == "" {
+		// A suffix range of the last n bytes.
+		n, err := strconv.ParseInt(endValue, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, true, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return byteRange{offset: size - n, length: n}, true, nil
+	}
+
+	start, err := strconv.ParseInt(startValue, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+
+	end := size - 1
+	if endValue != "" {
+		end, err = strconv.ParseInt(endValue, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+		end = min(end, size-1)
+	}
+
+	if start >= size {
+		return byteRange{}, true, errRangeNotSatisfiable
+	}
+
+	return byteRange{offset: start, length: end - start + 1}, true, nil
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header  string
+		size    int64
+		want    byteRange
+		wantOK  bool
+		wantErr bool
+	}{
+		{"bytes=0-99", 1000, byteRange{0, 100}, true, false},
+		{"bytes=500-", 1000, byteRange{500, 500}, true, false},
+		{"bytes=900-2000", 1000, byteRange{900, 100}, true, false},
+		{"bytes=-100", 1000, byteRange{900, 100}, true, false},
+		{"bytes=-5000", 1000, byteRange{0, 1000}, true, false},
+		{"bytes=1000-", 1000, byteRange{}, true, true},
+		{"bytes=0-", 0, byteRange{}, true, true},
+		{"bytes=-0", 1000, byteRange{}, true, true},
+		{"bytes=0-1,5-6", 1000, byteRange{}, false, false},
+		{"bytes=5-1", 1000, byteRange{}, false, false},
+		{"items=0-1", 1000, byteRange{}, false, false},
+		{"bytes=abc", 1000, byteRange{}, false, false},
+	}
+
+	for _, tt := range tests {
+		got, ok, err := parseRange(tt.header, tt.size)
+		if got != tt.want || ok != tt.wantOK || (err != nil) != tt.wantErr {
+			t.Errorf("parseRange(%q, %d) = %v, %v, %v; want %v, %v, error %v",
+				tt.header, tt.size, got, ok, err, tt.want, tt.wantOK, tt.wantErr)
+		}
+	}
+}
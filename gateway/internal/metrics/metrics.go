@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"karma8/common/response"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_http_requests_total",
+		Help: "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_http_request_duration_seconds",
+		Help:    "Time to handle HTTP requests, including streaming the body, by route and method.",
+		Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"route", "method"})
+
+	UploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_uploaded_bytes_total",
+		Help: "Bytes of files uploaded by clients.",
+	})
+
+	DownloadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_downloaded_bytes_total",
+		Help: "Bytes of files downloaded by clients.",
+	})
+
+	UploadsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_uploads_in_flight",
+		Help: "Uploads currently being chunked and sent to storage.",
+	})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_storage_request_duration_seconds",
+		Help:    "Time of requests to storage nodes, by node and operation.",
+		Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"node", "operation"})
+
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_storage_request_errors_total",
+		Help: "Failed requests to storage nodes, by node and operation.",
+	}, []string{"node", "operation"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_db_query_duration_seconds",
+		Help:    "Time of Postgres queries, by query.",
+		Buckets: []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"query"})
+)
+
+// ObserveStorageRequest records a request to a storage node that started at
+// start, counting it as an error if err is set.
+func ObserveStorageRequest(node string, operation string, start time.Time, err error) {
+	storageDuration.WithLabelValues(node, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageErrors.WithLabelValues(node, operation).Inc()
+	}
+}
+
+// ObserveQuery records a database query that started at start. It is meant
+// to be deferred at the top of a repository method.
+func ObserveQuery(query string, start time.Time) {
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// Middleware counts requests and their latency by route template, so that
+// URLs with IDs do not create a series each. Requests whose handler panicked,
+// as with http.ErrAbortHandler, are counted with the code "aborted".
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		recorder := response.NewRecorder(w)
+		start := time.Now()
+
+		defer func() {
+			aborted := recover()
+
+			code := strconv.Itoa(recorder.Status)
+			if aborted != nil {
+				code = "aborted"
+			}
+			httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+			httpRequests.WithLabelValues(route, r.Method, code).Inc()
+
+			if aborted != nil {
+				panic(aborted)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
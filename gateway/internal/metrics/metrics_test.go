@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(Middleware)
+	router.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).Methods("GET")
+	router.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("created"))
+	}).Methods("POST")
+	tests := []struct {
+		method string
+		path   string
+		route  string
+		code   string
+	}{
+		{"GET", "/items/1", "/items/{id}", "404"},
+		{"GET", "/items/2", "/items/{id}", "404"},
+		{"POST", "/items", "/items", "200"},
+	}
+
+	before := make(map[[3]string]float64)
+	for _, tt := range tests {
+		key := [3]string{tt.route, tt.method, tt.code}
+		before[key] = testutil.ToFloat64(httpRequests.WithLabelValues(key[:]...))
+	}
+
+	for _, tt := range tests {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+	}
+
+	want := make(map[[3]string]float64)
+	for _, tt := range tests {
+		want[[3]string{tt.route, tt.method, tt.code}]++
+	}
+
+	for key, count := range want {
+		got := testutil.ToFloat64(httpRequests.WithLabelValues(key[:]...)) - before[key]
+		if got != count {
+			t.Errorf("Expected %v requests for %v, got %v", count, key, got)
+		}
+	}
+}
+
+func TestMiddleware_Flush(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(Middleware)
+	router.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatalf("Expected the response writer to implement http.Flusher")
+		}
+		w.Write([]byte("part"))
+		flusher.Flush()
+	})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/stream", nil))
+
+	if !recorder.Flushed {
+		t.Errorf("Expected the response to be flushed")
+	}
+}
+
+func TestMiddleware_Aborted(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(Middleware)
+	router.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("part"))
+		panic(http.ErrAbortHandler)
+	})
+
+	counter := httpRequests.WithLabelValues("/download", "GET", "aborted")
+	before := testutil.ToFloat64(counter)
+
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Errorf("Expected the middleware to panic with http.ErrAbortHandler again, got %v", recovered)
+			}
+		}()
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+	}()
+
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("Expected 1 aborted request, got %v", got)
+	}
+}
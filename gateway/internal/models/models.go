@@ -10,3 +10,16 @@ const (
 	ChunkStatusPending       ChunkStatus = "pending"
 	ChunkStatusSentToStorage ChunkStatus = "sent_to_storage"
 )
+
+type FileStatus string
+
+func (s FileStatus) String() string {
+	return string(s)
+}
+
+const (
+	FileStatusUploading FileStatus = "uploading"
+	FileStatusComplete  FileStatus = "complete"
+	// FileStatusDeleting marks a file whose chunks are being removed.
+	FileStatusDeleting FileStatus = "deleting"
+)
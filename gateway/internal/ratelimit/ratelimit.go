@@ -0,0 +1,349 @@
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gateway/internal/auth"
+	"karma8/common/apierror"
+	"karma8/common/response"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// KeyBy selects what requests are grouped by when they are limited.
+type KeyBy string
+
+const (
+	// KeyBySubject limits every authenticated subject, such as the holder of
+	// an API key, separately.
+	KeyBySubject KeyBy = "subject"
+	KeyByTenant  KeyBy = "tenant"
+	KeyByIP      KeyBy = "ip"
+)
+
+func ParseKeyBy(s string) (KeyBy, error) {
+	switch KeyBy(s) {
+	case "":
+		return KeyByIP, nil
+	case KeyBySubject, KeyByTenant, KeyByIP:
+		return KeyBy(s), nil
+	default:
+		return "", fmt.Errorf("unknown rate limit key %q", s)
+	}
+}
+
+// Limits are the token buckets of one client. Zero values disable the
+// respective limit.
+type Limits struct {
+	RequestsPerSecond float64
+	RequestBurst      int
+	// BytesPerSecond bounds upload and download bandwidth separately.
+	BytesPerSecond int64
+}
+
+type Config struct {
+	KeyBy   KeyBy
+	Default Limits
+	// Overrides replace the default limits for individual keys.
+	Overrides map[string]Limits
+	// PerIP limits every client IP before authentication, so that failed
+	// authentication attempts are limited too. See IPMiddleware.
+	PerIP Limits
+	// TrustedProxies are the proxies in front of the gateway. The client IP
+	// of a request from one of them is the rightmost X-Forwarded-For entry
+	// that is not a trusted proxy itself.
+	TrustedProxies []netip.Prefix
+}
+
+// ParseTrustedProxies parses proxy addresses, each an IP or a CIDR range.
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// LoadOverrides reads per-key limits from a file. Each non-empty line that
+// does not start with '#' holds a key, requests per second, request burst and
+// bytes per second, separated by whitespace.
+func LoadOverrides(path string) (map[string]Limits, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open rate limits file")
+	}
+	defer file.Close()
+
+	overrides := make(map[string]Limits)
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("rate limits line %d: expected key, requests per second, burst and bytes per second", lineNum)
+		}
+
+		requestsPerSecond, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("rate limits line %d: invalid requests per second %q", lineNum, fields[1])
+		}
+
+		burst, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("rate limits line %d: invalid burst %q", lineNum, fields[2])
+		}
+
+		bytesPerSecond, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("rate limits line %d: invalid bytes per second %q", lineNum, fields[3])
+		}
+
+		overrides[fields[0]] = Limits{
+			RequestsPerSecond: requestsPerSecond,
+			RequestBurst:      burst,
+			BytesPerSecond:    bytesPerSecond,
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read rate limits file")
+	}
+
+	return overrides, nil
+}
+
+// idleTimeout is how long the buckets of a client are kept after its last
+// request. A returning client starts with full buckets.
+const idleTimeout = 10 * time.Minute
+
+type Limiter struct {
+	mu        sync.Mutex
+	config    Config
+	buckets   map[string]*buckets
+	ipBuckets map[string]*buckets
+	lastPrune time.Time
+}
+
+type buckets struct {
+	requests *rate.Limiter
+	upload   *rate.Limiter
+	download *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewLimiter(config Config) *Limiter {
+	return &Limiter{
+		config:    config,
+		buckets:   make(map[string]*buckets),
+		ipBuckets: make(map[string]*buckets),
+	}
+}
+
+// Middleware rejects requests over the request rate with 429 and throttles
+// the request and response bodies of the rest to the byte rate. It must run
+// after authentication unless requests are keyed by IP.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return l.limit(next, l.get)
+}
+
+// IPMiddleware applies the PerIP limits to every client IP. It runs before
+// authentication, so that it also covers requests that fail to authenticate.
+func (l *Limiter) IPMiddleware(next http.Handler) http.Handler {
+	return l.limit(next, l.getByIP)
+}
+
+func (l *Limiter) limit(next http.Handler, get func(*http.Request) *buckets) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := get(r)
+
+		if b.requests != nil {
+			reservation := b.requests.Reserve()
+			if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				apierror.Write(w, http.StatusTooManyRequests, apierror.CodeRateLimited, "Rate limit exceeded")
+				return
+			}
+		}
+
+		if b.upload != nil && r.Body != nil {
+			r.Body = &throttledReader{ReadCloser: r.Body, limiter: b.upload, ctx: r.Context()}
+		}
+
+		if b.download != nil {
+			w = &throttledResponseWriter{Recorder: response.NewRecorder(w), limiter: b.download, ctx: r.Context()}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetConfig replaces the limits. Every client starts over with full buckets.
+func (l *Limiter) SetConfig(config Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.config = config
+	l.buckets = make(map[string]*buckets)
+	l.ipBuckets = make(map[string]*buckets)
+}
+
+// key must be called with mu held.
+func (l *Limiter) key(r *http.Request) string {
+	switch l.config.KeyBy {
+	case KeyBySubject:
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok && principal.Subject != "" {
+			return principal.Subject
+		}
+	case KeyByTenant:
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok && principal.TenantID != "" {
+			return principal.TenantID
+		}
+	}
+
+	// Requests without a principal share the bucket of their IP.
+	return l.clientIP(r)
+}
+
+// clientIP must be called with mu held. X-Forwarded-For is only believed as
+// far as trusted proxies appended to it: anything left of the last entry a
+// trusted proxy added was sent by the client and may be forged.
+func (l *Limiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !l.trusted(host) {
+		return host
+	}
+
+	values := r.Header.Values("X-Forwarded-For")
+	for i := len(values) - 1; i >= 0; i-- {
+		entries := strings.Split(values[i], ",")
+		for j := len(entries) - 1; j >= 0; j-- {
+			entry := strings.TrimSpace(entries[j])
+			if entry == "" {
+				continue
+			}
+			if !l.trusted(entry) {
+				return entry
+			}
+			host = entry
+		}
+	}
+
+	// Every hop is a trusted proxy; the leftmost is the closest to the
+	// client.
+	return host
+}
+
+func (l *Limiter) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range l.config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *Limiter) get(r *http.Request) *buckets {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := l.key(r)
+	limits, ok := l.config.Overrides[key]
+	if !ok {
+		limits = l.config.Default
+	}
+
+	return l.lookup(l.buckets, key, limits)
+}
+
+func (l *Limiter) getByIP(r *http.Request) *buckets {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lookup(l.ipBuckets, l.clientIP(r), l.config.PerIP)
+}
+
+// lookup returns the buckets of key in table, creating them with limits. It
+// must be called with mu held.
+func (l *Limiter) lookup(table map[string]*buckets, key string, limits Limits) *buckets {
+	now := time.Now()
+	if now.Sub(l.lastPrune) > idleTimeout {
+		for _, pruned := range []map[string]*buckets{l.buckets, l.ipBuckets} {
+			for k, b := range pruned {
+				if now.Sub(b.lastSeen) > idleTimeout {
+					delete(pruned, k)
+				}
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := table[key]
+	if !ok {
+		b = newBuckets(limits)
+		table[key] = b
+	}
+	b.lastSeen = now
+
+	return b
+}
+
+func newBuckets(limits Limits) *buckets {
+	b := &buckets{}
+
+	if limits.RequestsPerSecond > 0 {
+		burst := max(limits.RequestBurst, 1)
+		b.requests = rate.NewLimiter(rate.Limit(limits.RequestsPerSecond), burst)
+	}
+
+	if limits.BytesPerSecond > 0 {
+		b.upload = rate.NewLimiter(rate.Limit(limits.BytesPerSecond), byteBurst(limits.BytesPerSecond))
+		b.download = rate.NewLimiter(rate.Limit(limits.BytesPerSecond), byteBurst(limits.BytesPerSecond))
+	}
+
+	return b
+}
+
+// byteBurst allows a second worth of bytes at once, but at least one full
+// read buffer so that reads are not split into tiny waits.
+func byteBurst(bytesPerSecond int64) int {
+	return int(min(max(bytesPerSecond, 32<<10), math.MaxInt32))
+}
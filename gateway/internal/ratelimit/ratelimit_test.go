@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gateway/internal/auth"
+)
+
+func TestLimiter_RequestRate(t *testing.T) {
+	limiter := NewLimiter(Config{
+		KeyBy:     KeyByTenant,
+		Default:   Limits{RequestsPerSecond: 1, RequestBurst: 2},
+		Overrides: map[string]Limits{"bulk": {RequestsPerSecond: 1, RequestBurst: 1}},
+	})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(tenantID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/files/get", nil)
+		r = r.WithContext(auth.WithPrincipal(r.Context(), &auth.Principal{TenantID: tenantID}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		tenantID   string
+		wantStatus int
+	}{
+		{"a", http.StatusOK},
+		{"a", http.StatusOK},
+		{"a", http.StatusTooManyRequests},
+		{"b", http.StatusOK},
+		{"bulk", http.StatusOK},
+		{"bulk", http.StatusTooManyRequests},
+	}
+
+	for i, tt := range tests {
+		w := request(tt.tenantID)
+		if w.Code != tt.wantStatus {
+			t.Errorf("request %d of %s: expected status %d, got %d", i, tt.tenantID, tt.wantStatus, w.Code)
+		}
+
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("request %d of %s: expected Retry-After 1, got %q", i, tt.tenantID, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestLimiter_Bandwidth(t *testing.T) {
+	const bytesPerSecond = 64 << 10
+
+	limiter := NewLimiter(Config{Default: Limits{BytesPerSecond: bytesPerSecond}})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+
+	// A second worth of bytes passes in a burst, the remaining half second
+	// is throttled.
+	body := bytes.Repeat([]byte("x"), bytesPerSecond*3/2)
+	start := time.Now()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/files/upload", bytes.NewReader(body)))
+
+	if w.Body.Len() != len(body) {
+		t.Fatalf("Expected %d bytes echoed, got %d", len(body), w.Body.Len())
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the transfer to be throttled, took %v", elapsed)
+	}
+}
+
+func TestLimiter_ClientIP(t *testing.T) {
+	trustedProxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		trustedProxies []netip.Prefix
+		remoteAddr     string
+		forwardedFor   []string
+		want           string
+	}{
+		{"no proxy", nil, "203.0.113.7:4711", nil, "203.0.113.7"},
+		{"forwarded without trusted proxies", nil, "203.0.113.7:4711", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"forwarded by an untrusted peer", trustedProxies, "203.0.113.7:4711", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"forwarded by a trusted proxy", trustedProxies, "10.1.2.3:4711", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"forged leftmost entry", trustedProxies, "10.1.2.3:4711", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", trustedProxies, "10.1.2.3:4711", []string{"1.2.3.4, 198.51.100.1, 192.0.2.1", "10.9.9.9"}, "198.51.100.1"},
+		{"only trusted proxies", trustedProxies, "10.1.2.3:4711", []string{"10.4.4.4, 192.0.2.1"}, "10.4.4.4"},
+		{"trusted proxy without header", trustedProxies, "10.1.2.3:4711", nil, "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewLimiter(Config{TrustedProxies: tt.trustedProxies})
+
+			r := httptest.NewRequest("GET", "/api/files/get", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := limiter.clientIP(r); got != tt.want {
+				t.Errorf("expected client IP %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLimiter_IPMiddleware(t *testing.T) {
+	limiter := NewLimiter(Config{
+		KeyBy: KeyBySubject,
+		PerIP: Limits{RequestsPerSecond: 1, RequestBurst: 2},
+	})
+
+	// Without authenticators every request fails to authenticate, yet counts
+	// against its IP.
+	handler := limiter.IPMiddleware(auth.Middleware()(limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+
+	request := func(remoteAddr string) int {
+		r := httptest.NewRequest("GET", "/api/files/get", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		remoteAddr string
+		wantStatus int
+	}{
+		{"203.0.113.7:1", http.StatusUnauthorized},
+		{"203.0.113.7:2", http.StatusUnauthorized},
+		{"203.0.113.7:3", http.StatusTooManyRequests},
+		{"198.51.100.1:1", http.StatusUnauthorized},
+	}
+
+	for i, tt := range tests {
+		if got := request(tt.remoteAddr); got != tt.wantStatus {
+			t.Errorf("request %d from %s: expected status %d, got %d", i, tt.remoteAddr, tt.wantStatus, got)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+
+	"karma8/common/response"
+
+	"golang.org/x/time/rate"
+)
+
+// throttledReader waits for tokens before handing out bytes, so that uploads
+// are read no faster than the limit.
+type throttledReader struct {
+	io.ReadCloser
+	limiter *rate.Limiter
+	ctx     context.Context
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// throttledResponseWriter waits for tokens before writing, so that downloads
+// are sent no faster than the limit.
+type throttledResponseWriter struct {
+	*response.Recorder
+	limiter *rate.Limiter
+	ctx     context.Context
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), w.limiter.Burst())
+		if err := w.limiter.WaitN(w.ctx, n); err != nil {
+			return written, err
+		}
+
+		n, err := w.Recorder.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
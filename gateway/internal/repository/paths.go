@@ -0,0 +1,197 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"gateway/internal/models"
+
+	"github.com/pkg/errors"
+)
+
+// Path names a file by a key within a bucket of its tenant. A file has at
+// most one path.
+type Path struct {
+	TenantID  string    `db:"tenant_id"`
+	Bucket    string    `db:"bucket"`
+	Key       string    `db:"key"`
+	FileUUID  string    `db:"file_uuid"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// PathFile is a listed path together with the file it names.
+type PathFile struct {
+	Key string `db:"key"`
+	File
+}
+
+func (r *Repository) GetPath(ctx context.Context, tenantID string, bucket string, key string) (Path, error) {
+	ctx, done := startQuery(ctx, "get_path")
+	defer done()
+
+	var path Path
+	err := r.db.GetContext(ctx, &path, `
+		select * from paths where tenant_id = $1 and bucket = $2 and key = $3
+	`, tenantID, bucket, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Path{}, errors.Wrapf(ErrNotFound, "path /%s/%s", bucket, key)
+	}
+	if err != nil {
+		return Path{}, errors.Wrap(err, "get context")
+	}
+
+	return path, nil
+}
+
+// BindPath points a path at a file, creating the path or replacing the file
+// it named. The path must name the file with UUID expected, or not exist if
+// expected is empty, or BindPath fails with ErrPreconditionFailed. The
+// replaced file is marked deleting in the same transaction, so that it
+// disappears together with the path, and its UUID is returned for the caller
+// to remove it from storage. It fails with ErrAlreadyExists if the file has a
+// path already.
+func (r *Repository) BindPath(ctx context.Context, path Path, expected string) (string, error) {
+	ctx, done := startQuery(ctx, "bind_path")
+	defer done()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "begin tx")
+	}
+	defer tx.Rollback()
+
+	if expected == "" {
+		// A path created concurrently conflicts instead of being locked.
+		res, err := tx.ExecContext(ctx, `
+			insert into paths (tenant_id, bucket, key, file_uuid) values ($1, $2, $3, $4)
+			on conflict (tenant_id, bucket, key) do nothing
+		`, path.TenantID, path.Bucket, path.Key, path.FileUUID)
+		if isUniqueViolation(err) {
+			return "", errors.Wrapf(ErrAlreadyExists, "path of file %s", path.FileUUID)
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "insert path")
+		}
+
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return "", errors.Wrap(err, "rows affected")
+		}
+
+		if inserted == 0 {
+			return "", errors.Wrapf(ErrPreconditionFailed, "path /%s/%s exists", path.Bucket, path.Key)
+		}
+
+		return "", errors.Wrap(tx.Commit(), "commit")
+	}
+
+	var current string
+	err = tx.GetContext(ctx, &current, `
+		select file_uuid from paths where tenant_id = $1 and bucket = $2 and key = $3 for update
+	`, path.TenantID, path.Bucket, path.Key)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", errors.Wrap(err, "get path")
+	}
+
+	if current != expected {
+		return "", errors.Wrapf(ErrPreconditionFailed, "path /%s/%s no longer names file %s", path.Bucket, path.Key, expected)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update paths set file_uuid = $1, updated_at = now() where tenant_id = $2 and bucket = $3 and key = $4
+	`, path.FileUUID, path.TenantID, path.Bucket, path.Key)
+	if isUniqueViolation(err) {
+		return "", errors.Wrapf(ErrAlreadyExists, "path of file %s", path.FileUUID)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "update path")
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		update files set status = $1 where uuid = $2 and status = $3
+	`, models.FileStatusDeleting, current, models.FileStatusComplete)
+	if err != nil {
+		return "", errors.Wrap(err, "mark replaced file deleting")
+	}
+
+	marked, err := res.RowsAffected()
+	if err != nil {
+		return "", errors.Wrap(err, "rows affected")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", errors.Wrap(err, "commit")
+	}
+
+	// A file that was deleting already is removed by whoever deletes it.
+	if marked == 0 {
+		return "", nil
+	}
+
+	return current, nil
+}
+
+// RenamePath moves the path of a file to another bucket or key. It fails
+// with ErrNotFound if from no longer names the file and with
+// ErrAlreadyExists if to is taken.
+func (r *Repository) RenamePath(ctx context.Context, from Path, to Path) error {
+	ctx, done := startQuery(ctx, "rename_path")
+	defer done()
+
+	res, err := r.db.ExecContext(ctx, `
+		update paths set bucket = $1, key = $2, updated_at = now()
+		where tenant_id = $3 and bucket = $4 and key = $5 and file_uuid = $6
+	`, to.Bucket, to.Key, from.TenantID, from.Bucket, from.Key, from.FileUUID)
+	if isUniqueViolation(err) {
+		return errors.Wrapf(ErrAlreadyExists, "path /%s/%s", to.Bucket, to.Key)
+	}
+	if err != nil {
+		return errors.Wrap(err, "exec context")
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "rows affected")
+	}
+
+	if updated == 0 {
+		return errors.Wrapf(ErrNotFound, "path /%s/%s of file %s", from.Bucket, from.Key, from.FileUUID)
+	}
+
+	return nil
+}
+
+// PathFilter selects the paths of complete files in a bucket. Empty Owner
+// and Prefix match any file.
+type PathFilter struct {
+	TenantID string
+	Bucket   string
+	Owner    string
+	Prefix   string
+	// After is the key the page starts after.
+	After string
+	Limit int
+}
+
+// ListPaths returns a page of the paths matching filter ordered by key,
+// bytewise.
+func (r *Repository) ListPaths(ctx context.Context, filter PathFilter) ([]PathFile, error) {
+	ctx, done := startQuery(ctx, "list_paths")
+	defer done()
+
+	var paths []PathFile
+	err := r.db.SelectContext(ctx, &paths, `
+		select p.key, f.* from paths p join files f on f.uuid = p.file_uuid
+		where p.tenant_id = $1 and p.bucket = $2 and f.status = $3
+			and ($4 = '' or f.owner = $4)
+			and starts_with(p.key, $5)
+			and p.key > $6
+		order by p.key limit $7
+	`, filter.TenantID, filter.Bucket, models.FileStatusComplete, filter.Owner, filter.Prefix, filter.After, filter.Limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "select context")
+	}
+
+	return paths, nil
+}
@@ -2,13 +2,19 @@ package repository
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
+	"gateway/internal/metrics"
 	"gateway/internal/models"
+	"karma8/common/tracing"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Chunk struct {
@@ -19,6 +25,59 @@ type Chunk struct {
 	UpdatedAt   time.Time `db:"updated_at"`
 	NumOfChunks int64     `db:"num_of_chunks"`
 	StorageID   int       `db:"storage_id"`
+	Codec       string    `db:"codec"`
+	// LogicalSize is the size of the chunk as uploaded and CompressedSize the
+	// size after compression. Both are unknown for chunks stored before sizes
+	// were recorded.
+	LogicalSize    *int64 `db:"logical_size"`
+	CompressedSize *int64 `db:"compressed_size"`
+}
+
+type File struct {
+	UUID         string    `db:"uuid"`
+	Name         string    `db:"name"`
+	Size         int64     `db:"size"`
+	EncryptedKey []byte    `db:"encrypted_key"`
+	KeyID        *string   `db:"key_id"`
+	CreatedAt    time.Time `db:"created_at"`
+	Owner        string    `db:"owner"`
+	TenantID     string    `db:"tenant_id"`
+	Status       string    `db:"status"`
+}
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrTenantNotFound is returned when a file is charged to a tenant that
+	// does not exist, which is a problem of the caller's credentials rather
+	// than of the file.
+	ErrTenantNotFound = errors.New("tenant not found")
+	// ErrPreconditionFailed is returned when a write is conditioned on
+	// state that has changed.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// isUniqueViolation reports whether err is a Postgres unique constraint
+// violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// startQuery starts the span of a repository call and returns the function
+// that ends it and records the call's duration.
+func startQuery(ctx context.Context, query string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracing.Tracer.Start(ctx, "db."+query,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql")),
+	)
+
+	return ctx, func() {
+		span.End()
+		metrics.ObserveQuery(query, start)
+	}
 }
 
 type Repository struct {
@@ -31,23 +90,22 @@ func NewRepository(db *sqlx.DB) *Repository {
 	}
 }
 
-func (r *Repository) InsertChunk(
-	ctx context.Context,
-	uuid string,
-	chunkIndex int64,
-	chunkHash string,
-	status models.ChunkStatus,
-	numOfChunks int64,
-	storageID int,
-) error {
+func (r *Repository) InsertChunk(ctx context.Context, chunk Chunk) error {
+	ctx, done := startQuery(ctx, "insert_chunk")
+	defer done()
+
 	_, err := r.db.ExecContext(ctx, `
-		insert into chunks (uuid, chunk_index, chunk_hash, status, num_of_chunks, storage_id) values ($1, $2, $3, $4, $5, $6)
+		insert into chunks (uuid, chunk_index, chunk_hash, status, num_of_chunks, storage_id, codec, logical_size, compressed_size)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		on conflict (uuid, chunk_index) do update set
 			chunk_hash = excluded.chunk_hash,
 			status = excluded.status,
 			storage_id = excluded.storage_id,
+			codec = excluded.codec,
+			logical_size = excluded.logical_size,
+			compressed_size = excluded.compressed_size,
 			updated_at = excluded.updated_at
-	`, uuid, chunkIndex, chunkHash, status, numOfChunks, storageID)
+	`, chunk.UUID, chunk.ChunkIndex, chunk.ChunkHash, chunk.Status, chunk.NumOfChunks, chunk.StorageID, chunk.Codec, chunk.LogicalSize, chunk.CompressedSize)
 	if err != nil {
 		return errors.Wrap(err, "exec context")
 	}
@@ -62,6 +120,9 @@ func (r *Repository) UpdateChunkStatus(
 	status models.ChunkStatus,
 	updatedAt time.Time,
 ) error {
+	ctx, done := startQuery(ctx, "update_chunk_status")
+	defer done()
+
 	_, err := r.db.ExecContext(ctx, `
 		update chunks set status = $1, updated_at = $2 where uuid = $3 and chunk_index = $4
 	`, status, updatedAt, uuid, chunkIndex)
@@ -72,7 +133,26 @@ func (r *Repository) UpdateChunkStatus(
 	return nil
 }
 
+// UpdateChunkLocation records that a chunk is stored on the node with the
+// given storage ID and marks it as sent to storage.
+func (r *Repository) UpdateChunkLocation(ctx context.Context, uuid string, chunkIndex int64, storageID int, updatedAt time.Time) error {
+	ctx, done := startQuery(ctx, "update_chunk_location")
+	defer done()
+
+	_, err := r.db.ExecContext(ctx, `
+		update chunks set storage_id = $1, status = $2, updated_at = $3 where uuid = $4 and chunk_index = $5
+	`, storageID, models.ChunkStatusSentToStorage, updatedAt, uuid, chunkIndex)
+	if err != nil {
+		return errors.Wrap(err, "exec context")
+	}
+
+	return nil
+}
+
 func (r *Repository) GetChunksByUUID(ctx context.Context, uuid string) ([]Chunk, error) {
+	ctx, done := startQuery(ctx, "get_chunks_by_uuid")
+	defer done()
+
 	var chunks []Chunk
 	err := r.db.SelectContext(ctx, &chunks, `
 		select * from chunks where uuid = $1 order by chunk_index
@@ -82,3 +162,329 @@ func (r *Repository) GetChunksByUUID(ctx context.Context, uuid string) ([]Chunk,
 	}
 	return chunks, nil
 }
+
+// InsertFile records a new file in the uploading status and charges it to its
+// tenant's usage in the same transaction. It fails with ErrQuotaExceeded if the file does not fit
+// into the tenant's quota, with ErrTenantNotFound if the tenant does not exist and
+// with ErrAlreadyExists if the UUID is taken. If the file replaces the
+// complete file with UUID replaces, the quota is checked as if that file
+// were gone already; it stays charged until it is deleted.
+func (r *Repository) InsertFile(ctx context.Context, file File, replaces string) error {
+	ctx, done := startQuery(ctx, "insert_file")
+	defer done()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		with replaced as (
+			select coalesce(sum(size), 0) as bytes, count(*) as objects
+			from files where uuid = $3 and tenant_id = $2 and status = $4
+		)
+		update tenants set used_bytes = used_bytes + $1, used_objects = used_objects + 1
+		from replaced
+		where id = $2
+			and (quota_bytes is null or used_bytes + $1 - replaced.bytes <= quota_bytes)
+			and (quota_objects is null or used_objects + 1 - replaced.objects <= quota_objects)
+	`, file.Size, file.TenantID, replaces, models.FileStatusComplete)
+	if err != nil {
+		return errors.Wrap(err, "charge tenant usage")
+	}
+
+	charged, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "rows affected")
+	}
+
+	if charged == 0 {
+		var exists bool
+		err = tx.GetContext(ctx, &exists, `select exists (select 1 from tenants where id = $1)`, file.TenantID)
+		if err != nil {
+			return errors.Wrap(err, "check tenant")
+		}
+
+		if !exists {
+			return errors.Wrapf(ErrTenantNotFound, "tenant %s", file.TenantID)
+		}
+
+		return errors.Wrapf(ErrQuotaExceeded, "tenant %s", file.TenantID)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into files (uuid, name, size, encrypted_key, key_id, owner, tenant_id, status)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, file.UUID, file.Name, file.Size, file.EncryptedKey, file.KeyID, file.Owner, file.TenantID, models.FileStatusUploading)
+	if isUniqueViolation(err) {
+		return errors.Wrapf(ErrAlreadyExists, "file %s", file.UUID)
+	}
+	if err != nil {
+		return errors.Wrap(err, "insert file")
+	}
+
+	return errors.Wrap(tx.Commit(), "commit")
+}
+
+// DeleteFile removes a file and its chunks and releases the file's usage
+// from its tenant in one transaction. The chunks are removed even if the file
+// is not recorded, as for an upload that failed before it was, and
+// ErrNotFound is returned only after that.
+func (r *Repository) DeleteFile(ctx context.Context, uuid string) error {
+	ctx, done := startQuery(ctx, "delete_file")
+	defer done()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer tx.Rollback()
+
+	var file File
+	err = tx.GetContext(ctx, &file, `select * from files where uuid = $1 for update`, uuid)
+	found := !errors.Is(err, sql.ErrNoRows)
+	if err != nil && found {
+		return errors.Wrap(err, "get file")
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from chunks where uuid = $1`, uuid)
+	if err != nil {
+		return errors.Wrap(err, "delete chunks")
+	}
+
+	if !found {
+		if err := tx.Commit(); err != nil {
+			return errors.Wrap(err, "commit")
+		}
+		return errors.Wrapf(ErrNotFound, "file %s", uuid)
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from files where uuid = $1`, uuid)
+	if err != nil {
+		return errors.Wrap(err, "delete file")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update tenants set used_bytes = used_bytes - $1, used_objects = used_objects - 1 where id = $2
+	`, file.Size, file.TenantID)
+	if err != nil {
+		return errors.Wrap(err, "release tenant usage")
+	}
+
+	return errors.Wrap(tx.Commit(), "commit")
+}
+
+// RestoreFile records a complete file and its chunks, as rebuilt from the
+// storage nodes, and charges the file to its tenant without checking the
+// quota, since the data is stored already. It returns false and changes
+// nothing if the file is recorded already.
+func (r *Repository) RestoreFile(ctx context.Context, file File, chunks []Chunk) (bool, error) {
+	ctx, done := startQuery(ctx, "restore_file")
+	defer done()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "begin tx")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		insert into files (uuid, name, size, encrypted_key, key_id, owner, tenant_id, status, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		on conflict (uuid) do nothing
+	`, file.UUID, file.Name, file.Size, file.EncryptedKey, file.KeyID, file.Owner, file.TenantID, models.FileStatusComplete, file.CreatedAt)
+	if err != nil {
+		return false, errors.Wrap(err, "insert file")
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "rows affected")
+	}
+
+	if inserted == 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update tenants set used_bytes = used_bytes + $1, used_objects = used_objects + 1 where id = $2
+	`, file.Size, file.TenantID)
+	if err != nil {
+		return false, errors.Wrap(err, "charge tenant usage")
+	}
+
+	for _, chunk := range chunks {
+		_, err = tx.ExecContext(ctx, `
+			insert into chunks (uuid, chunk_index, chunk_hash, status, num_of_chunks, storage_id, codec, logical_size, compressed_size)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			on conflict (uuid, chunk_index) do nothing
+		`, chunk.UUID, chunk.ChunkIndex, chunk.ChunkHash, models.ChunkStatusSentToStorage, chunk.NumOfChunks, chunk.StorageID, chunk.Codec, chunk.LogicalSize, chunk.CompressedSize)
+		if err != nil {
+			return false, errors.Wrapf(err, "insert chunk %d", chunk.ChunkIndex)
+		}
+	}
+
+	return true, errors.Wrap(tx.Commit(), "commit")
+}
+
+func (r *Repository) GetFile(ctx context.Context, uuid string) (File, error) {
+	ctx, done := startQuery(ctx, "get_file")
+	defer done()
+
+	var file File
+	err := r.db.GetContext(ctx, &file, `
+		select * from files where uuid = $1
+	`, uuid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return File{}, errors.Wrapf(ErrNotFound, "file %s", uuid)
+	}
+	if err != nil {
+		return File{}, errors.Wrap(err, "get context")
+	}
+
+	return file, nil
+}
+
+// FileFilter selects the complete files of a tenant. Empty Owner and
+// NamePrefix match any file.
+type FileFilter struct {
+	TenantID   string
+	Owner      string
+	NamePrefix string
+	// After is the UUID the page starts after.
+	After string
+	Limit int
+}
+
+// ListFiles returns a page of the files matching filter ordered by UUID.
+func (r *Repository) ListFiles(ctx context.Context, filter FileFilter) ([]File, error) {
+	ctx, done := startQuery(ctx, "list_files")
+	defer done()
+
+	var files []File
+	err := r.db.SelectContext(ctx, &files, `
+		select * from files
+		where tenant_id = $1 and status = $2
+			and ($3 = '' or owner = $3)
+			and starts_with(name, $4)
+			and uuid > $5
+		order by uuid limit $6
+	`, filter.TenantID, models.FileStatusComplete, filter.Owner, filter.NamePrefix, filter.After, filter.Limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "select context")
+	}
+
+	return files, nil
+}
+
+// GetFilesByStatus returns up to limit files in the given status ordered by
+// UUID, starting after the given UUID.
+func (r *Repository) GetFilesByStatus(ctx context.Context, status models.FileStatus, after string, limit int) ([]File, error) {
+	ctx, done := startQuery(ctx, "get_files_by_status")
+	defer done()
+
+	var files []File
+	err := r.db.SelectContext(ctx, &files, `
+		select * from files where status = $1 and uuid > $2 order by uuid limit $3
+	`, status, after, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "select context")
+	}
+
+	return files, nil
+}
+
+// CountFilesNotInStatus returns how many files are in any other status than
+// the given one.
+func (r *Repository) CountFilesNotInStatus(ctx context.Context, status models.FileStatus) (int, error) {
+	ctx, done := startQuery(ctx, "count_files_not_in_status")
+	defer done()
+
+	var count int
+	err := r.db.GetContext(ctx, &count, `select count(*) from files where status <> $1`, status)
+	if err != nil {
+		return 0, errors.Wrap(err, "get context")
+	}
+
+	return count, nil
+}
+
+// UpdateFileStatus moves a file from one status to another. It fails with
+// ErrNotFound if the file is gone or no longer in the from status, as when
+// an upload was cleaned up as aborted while it was still running.
+func (r *Repository) UpdateFileStatus(ctx context.Context, uuid string, from models.FileStatus, to models.FileStatus) error {
+	ctx, done := startQuery(ctx, "update_file_status")
+	defer done()
+
+	res, err := r.db.ExecContext(ctx, `
+		update files set status = $1 where uuid = $2 and status = $3
+	`, to, uuid, from)
+	if err != nil {
+		return errors.Wrap(err, "exec context")
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "rows affected")
+	}
+
+	if updated == 0 {
+		return errors.Wrapf(ErrNotFound, "%s file %s", from, uuid)
+	}
+
+	return nil
+}
+
+// GetAbortedUploads returns up to limit files that are still uploading more
+// than olderThan after they were created, or whose deletion did not finish.
+// The age is computed by Postgres, whose clock created_at is set with.
+func (r *Repository) GetAbortedUploads(ctx context.Context, olderThan time.Duration, limit int) ([]File, error) {
+	ctx, done := startQuery(ctx, "get_aborted_uploads")
+	defer done()
+
+	var files []File
+	err := r.db.SelectContext(ctx, &files, `
+		select * from files
+		where (status = $1 and created_at < now() - make_interval(secs => $2)) or status = $3
+		order by created_at limit $4
+	`, models.FileStatusUploading, olderThan.Seconds(), models.FileStatusDeleting, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "select context")
+	}
+
+	return files, nil
+}
+
+// GetFilesWithStaleKey returns up to limit encrypted files ordered by UUID,
+// starting after the given UUID, whose data key is not wrapped with keyID.
+func (r *Repository) GetFilesWithStaleKey(ctx context.Context, keyID string, after string, limit int) ([]File, error) {
+	ctx, done := startQuery(ctx, "get_files_with_stale_key")
+	defer done()
+
+	var files []File
+	err := r.db.SelectContext(ctx, &files, `
+		select * from files where key_id is not null and key_id <> $1 and uuid > $2 order by uuid limit $3
+	`, keyID, after, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "select context")
+	}
+
+	return files, nil
+}
+
+// UpdateFileKey replaces the wrapped data key of a file, provided it is still
+// wrapped with oldKeyID.
+func (r *Repository) UpdateFileKey(ctx context.Context, uuid string, oldKeyID string, encryptedKey []byte, keyID string) error {
+	ctx, done := startQuery(ctx, "update_file_key")
+	defer done()
+
+	_, err := r.db.ExecContext(ctx, `
+		update files set encrypted_key = $1, key_id = $2 where uuid = $3 and key_id = $4
+	`, encryptedKey, keyID, uuid, oldKeyID)
+	if err != nil {
+		return errors.Wrap(err, "exec context")
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Tenant struct {
+	ID           string    `db:"id"`
+	Name         string    `db:"name"`
+	QuotaBytes   *int64    `db:"quota_bytes"`
+	QuotaObjects *int64    `db:"quota_objects"`
+	UsedBytes    int64     `db:"used_bytes"`
+	UsedObjects  int64     `db:"used_objects"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+func (r *Repository) InsertTenant(ctx context.Context, tenant Tenant) error {
+	ctx, done := startQuery(ctx, "insert_tenant")
+	defer done()
+
+	_, err := r.db.ExecContext(ctx, `
+		insert into tenants (id, name, quota_bytes, quota_objects) values ($1, $2, $3, $4)
+	`, tenant.ID, tenant.Name, tenant.QuotaBytes, tenant.QuotaObjects)
+	if isUniqueViolation(err) {
+		return errors.Wrapf(ErrAlreadyExists, "tenant %s", tenant.ID)
+	}
+	if err != nil {
+		return errors.Wrap(err, "exec context")
+	}
+
+	return nil
+}
+
+// UpdateTenant changes the name and quotas of a tenant. Lowering a quota
+// below the current usage is allowed; it only blocks new uploads.
+func (r *Repository) UpdateTenant(ctx context.Context, tenant Tenant) error {
+	ctx, done := startQuery(ctx, "update_tenant")
+	defer done()
+
+	res, err := r.db.ExecContext(ctx, `
+		update tenants set name = $1, quota_bytes = $2, quota_objects = $3 where id = $4
+	`, tenant.Name, tenant.QuotaBytes, tenant.QuotaObjects, tenant.ID)
+	if err != nil {
+		return errors.Wrap(err, "exec context")
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "rows affected")
+	}
+
+	if updated == 0 {
+		return errors.Wrapf(ErrNotFound, "tenant %s", tenant.ID)
+	}
+
+	return nil
+}
+
+func (r *Repository) GetTenant(ctx context.Context, id string) (Tenant, error) {
+	ctx, done := startQuery(ctx, "get_tenant")
+	defer done()
+
+	var tenant Tenant
+	err := r.db.GetContext(ctx, &tenant, `
+		select * from tenants where id = $1
+	`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Tenant{}, errors.Wrapf(ErrNotFound, "tenant %s", id)
+	}
+	if err != nil {
+		return Tenant{}, errors.Wrap(err, "get context")
+	}
+
+	return tenant, nil
+}
+
+func (r *Repository) GetTenants(ctx context.Context) ([]Tenant, error) {
+	ctx, done := startQuery(ctx, "get_tenants")
+	defer done()
+
+	var tenants []Tenant
+	err := r.db.SelectContext(ctx, &tenants, `
+		select * from tenants order by id
+	`)
+	if err != nil {
+		return nil, errors.Wrap(err, "select context")
+	}
+
+	return tenants, nil
+}
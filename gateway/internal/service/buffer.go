@@ -0,0 +1,86 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// chunkBuffer holds a single chunk so that its upload can be retried. Data is
+// kept in memory until it grows past memLimit, after which everything is
+// spilled to a temporary file in dir.
+type chunkBuffer struct {
+	dir      string
+	memLimit int64
+	mem      bytes.Buffer
+	file     *os.File
+	size     int64
+}
+
+func newChunkBuffer(dir string, memLimit int64) *chunkBuffer {
+	return &chunkBuffer{
+		dir:      dir,
+		memLimit: memLimit,
+	}
+}
+
+func (b *chunkBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.size+int64(len(p)) > b.memLimit {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+
+	return n, err
+}
+
+func (b *chunkBuffer) spill() error {
+	file, err := os.CreateTemp(b.dir, "chunk-*")
+	if err != nil {
+		return errors.Wrap(err, "create temp file")
+	}
+
+	if _, err := b.mem.WriteTo(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return errors.Wrap(err, "spill buffer to disk")
+	}
+
+	b.file = file
+	b.mem = bytes.Buffer{}
+
+	return nil
+}
+
+func (b *chunkBuffer) Size() int64 {
+	return b.size
+}
+
+// Reader returns a seekable view of the buffered chunk.
+func (b *chunkBuffer) Reader() io.ReadSeeker {
+	if b.file != nil {
+		return b.file
+	}
+
+	return bytes.NewReader(b.mem.Bytes())
+}
+
+func (b *chunkBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestChunkBuffer_SpillsToDisk(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		memLimit  int64
+		wantSpill bool
+	}{
+		{"fits in memory", 100, 1024, false},
+		{"exactly at limit", 1024, 1024, false},
+		{"over limit", 4096, 1024, true},
+		{"empty", 0, 1024, false},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		data := bytes.Repeat([]byte("k8"), tt.size/2)
+
+		buffer := newChunkBuffer(dir, tt.memLimit)
+		for chunk := range slices.Chunk(data, 300) {
+			if _, err := buffer.Write(chunk); err != nil {
+				t.Fatalf("%s: write: %v", tt.name, err)
+			}
+		}
+
+		if buffer.Size() != int64(len(data)) {
+			t.Errorf("%s: expected size %d, got %d", tt.name, len(data), buffer.Size())
+		}
+
+		if spilled := buffer.file != nil; spilled != tt.wantSpill {
+			t.Errorf("%s: expected spill=%v, got %v", tt.name, tt.wantSpill, spilled)
+		}
+
+		// The reader must be rewindable for retries.
+		for range 2 {
+			reader := buffer.Reader()
+			if _, err := reader.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("%s: seek: %v", tt.name, err)
+			}
+
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("%s: read: %v", tt.name, err)
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: buffered data does not match", tt.name)
+			}
+		}
+
+		if err := buffer.Close(); err != nil {
+			t.Errorf("%s: close: %v", tt.name, err)
+		}
+
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 0 {
+			t.Errorf("%s: expected temp files to be removed, found %d", tt.name, len(entries))
+		}
+	}
+}
@@ -1,17 +1,23 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"time"
 
+	"gateway/internal/compression"
+	"gateway/internal/encryption"
+	"gateway/internal/metrics"
 	"gateway/internal/models"
 	"gateway/internal/repository"
 	"gateway/internal/storage"
+	"karma8/common/logging"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -19,63 +25,342 @@ import (
 
 const NUM_OF_CHUNKS = 6
 
+type ChunkerConfig struct {
+	// UploadDir is where chunks larger than MemoryBufferSize are buffered
+	// while they are uploaded.
+	UploadDir        string
+	MemoryBufferSize int64
+	// KeyWrapper enables encryption at rest when set: every file gets its
+	// own data key, stored wrapped in the file metadata.
+	KeyWrapper encryption.KeyWrapper
+	// Compression is the codec chunks are compressed with, unless a sample of
+	// the chunk shows it does not compress.
+	Compression compression.Codec
+}
+
 type ChunkerService struct {
 	repository     *repository.Repository
 	storageManager *storage.StorageManager
+	config         ChunkerConfig
 }
 
-func NewChunkerService(repository *repository.Repository, storageManager *storage.StorageManager) *ChunkerService {
+func NewChunkerService(repository *repository.Repository, storageManager *storage.StorageManager, config ChunkerConfig) *ChunkerService {
 	return &ChunkerService{
 		repository:     repository,
 		storageManager: storageManager,
+		config:         config,
 	}
 }
 
-type chunkReader struct {
-	reader        io.Reader
-	contentLength int64
+// UploadOptions describes who an uploaded file belongs to.
+type UploadOptions struct {
+	Owner    string
+	TenantID string
+	// FileUUID is the UUID assigned to the file in advance, as by a presigned
+	// upload URL. A new one is generated when it is empty.
+	FileUUID string
+	// Replaces is the UUID of the file the upload is going to replace, whose
+	// size is not counted against the quota.
+	Replaces string
 }
 
-func (cr *chunkReader) Read(p []byte) (n int, err error) {
-	return cr.reader.Read(p)
-}
+// InsertStream splits the file into chunks and stores them. The file is
+// charged to the tenant's quota before any data is sent to storage, and the
+// charge is released again if the upload fails.
+func (s *ChunkerService) InsertStream(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts UploadOptions) (string, error) {
+	metrics.UploadsInFlight.Inc()
+	defer metrics.UploadsInFlight.Dec()
 
-func (s *ChunkerService) InsertStream(ctx context.Context, file multipart.File, header *multipart.FileHeader) (string, error) {
 	chunkSizes := getChunkSizes(header.Size, NUM_OF_CHUNKS)
-	fileUUID := uuid.New().String()
+	fileUUID := opts.FileUUID
+	if fileUUID == "" {
+		fileUUID = uuid.New().String()
+	}
 
-	for i := int64(0); i < int64(len(chunkSizes)); i++ {
-		limitedReader := io.LimitReader(file, chunkSizes[i])
+	fileRecord := repository.File{
+		UUID:     fileUUID,
+		Name:     header.Filename,
+		Size:     header.Size,
+		Owner:    opts.Owner,
+		TenantID: opts.TenantID,
+	}
+
+	var dataKey []byte
+	if s.config.KeyWrapper != nil {
+		var err error
+		dataKey, err = encryption.NewDataKey()
+		if err != nil {
+			return "", errors.Wrap(err, "new data key")
+		}
+
+		encryptedKey, keyID, err := s.config.KeyWrapper.WrapKey(ctx, dataKey, fileUUID)
+		if err != nil {
+			return "", errors.Wrap(err, "wrap data key")
+		}
+
+		fileRecord.EncryptedKey = encryptedKey
+		fileRecord.KeyID = &keyID
+	}
+
+	err := s.repository.InsertFile(ctx, fileRecord, opts.Replaces)
+	if err != nil {
+		return "", errors.Wrap(err, "insert file")
+	}
+
+	err = s.insertChunks(ctx, file, fileRecord, chunkSizes, dataKey)
+	if err == nil {
+		err = s.repository.UpdateFileStatus(ctx, fileUUID, models.FileStatusUploading, models.FileStatusComplete)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("upload failed", "file_uuid", fileUUID, "error", err)
 
-		reader := &chunkReader{
-			reader:        limitedReader,
-			contentLength: chunkSizes[i],
+		// The client may be gone, but the chunks sent so far still have to be
+		// removed. What cannot be removed now is left to
+		// CleanupAbortedUploads.
+		if abortErr := s.abortUpload(context.WithoutCancel(ctx), fileUUID); abortErr != nil {
+			return "", errors.Wrapf(err, "clean up aborted upload: %v", abortErr)
 		}
+		return "", err
+	}
+
+	metrics.UploadedBytes.Add(float64(header.Size))
+
+	return fileUUID, nil
+}
+
+// DeleteFile removes a complete file. The file is hidden first, so that no
+// download sees it partially removed; a deletion that fails midway is
+// finished by CleanupAbortedUploads.
+func (s *ChunkerService) DeleteFile(ctx context.Context, fileUUID string) error {
+	err := s.repository.UpdateFileStatus(ctx, fileUUID, models.FileStatusComplete, models.FileStatusDeleting)
+	if err != nil {
+		return errors.Wrap(err, "mark file deleting")
+	}
+
+	return s.abortUpload(ctx, fileUUID)
+}
+
+// listLimit bounds the page size of ListFiles.
+const listLimit = 1000
+
+// ListFiles returns a page of the complete files matching filter and the
+// UUID the next page starts after, which is empty on the last page. The page
+// holds 100 files unless filter asks for another size, up to 1000.
+func (s *ChunkerService) ListFiles(ctx context.Context, filter repository.FileFilter) ([]repository.File, string, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	if filter.Limit > listLimit {
+		filter.Limit = listLimit
+	}
+
+	files, err := s.repository.ListFiles(ctx, filter)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "list files")
+	}
+
+	var next string
+	if len(files) == filter.Limit {
+		next = files[len(files)-1].UUID
+	}
+
+	return files, next, nil
+}
+
+// abortUpload removes the chunks of an upload from storage and then the file
+// from the database, releasing its quota. If a chunk cannot be removed the
+// file is kept, so that the cleanup can be retried.
+func (s *ChunkerService) abortUpload(ctx context.Context, fileUUID string) error {
+	chunks, err := s.repository.GetChunksByUUID(ctx, fileUUID)
+	if err != nil {
+		return errors.Wrap(err, "get chunks")
+	}
+
+	for _, chunk := range chunks {
+		// A pending chunk may have been stored by any node the upload failed
+		// over to, or by none.
+		var storageIDs []int
+		if chunk.Status == models.ChunkStatusPending.String() {
+			for storageID := 1; storageID <= s.storageManager.GetNumStorage(); storageID++ {
+				storageIDs = append(storageIDs, storageID)
+			}
+		} else {
+			storageIDs = []int{chunk.StorageID}
+		}
+
+		for _, storageID := range storageIDs {
+			err := s.storageManager.DeleteChunk(ctx, storageID, fileUUID, chunk.ChunkIndex)
+			if err != nil {
+				return errors.Wrapf(err, "delete chunk %d from storage %d", chunk.ChunkIndex, storageID)
+			}
+		}
+	}
 
-		md5Hash := md5.New()
-		teeReader := io.TeeReader(reader, md5Hash)
+	err = s.repository.DeleteFile(ctx, fileUUID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return errors.Wrap(err, "delete file")
+	}
+
+	return nil
+}
 
-		storageID := s.storageManager.GetStorageID(fileUUID, i)
+// cleanupBatchSize is how many aborted uploads are fetched at a time.
+const cleanupBatchSize = 100
 
-		err := s.storageManager.UploadChunkStream(ctx, fileUUID, i, teeReader, chunkSizes[i])
+// CleanupAbortedUploads removes uploads that are still not complete olderThan
+// after they started, such as those of a gateway that was killed, and
+// finishes deletions that failed. olderThan
+// must exceed the longest upload, or uploads still running are removed. It
+// returns how many uploads were removed.
+func (s *ChunkerService) CleanupAbortedUploads(ctx context.Context, olderThan time.Duration) (int, error) {
+	cleaned := 0
+	for {
+		files, err := s.repository.GetAbortedUploads(ctx, olderThan, cleanupBatchSize)
 		if err != nil {
-			return "", errors.Wrap(err, "upload chunk to storage")
+			return cleaned, errors.Wrap(err, "get aborted uploads")
 		}
 
-		chunkHash := hex.EncodeToString(md5Hash.Sum(nil))
+		batchCleaned := 0
+		for _, file := range files {
+			if err := s.abortUpload(ctx, file.UUID); err != nil {
+				logging.FromContext(ctx).Warn("aborted upload cleanup failed", "file_uuid", file.UUID, "error", err)
+				continue
+			}
+			batchCleaned++
+		}
+		cleaned += batchCleaned
 
-		err = s.repository.InsertChunk(ctx, fileUUID, i, chunkHash, models.ChunkStatusPending, NUM_OF_CHUNKS, storageID)
+		// Stop when the batch was the last one, or when it consisted of
+		// uploads that cannot be cleaned up right now.
+		if len(files) < cleanupBatchSize || batchCleaned == 0 {
+			return cleaned, nil
+		}
+	}
+}
+
+func (s *ChunkerService) insertChunks(ctx context.Context, file io.Reader, fileRecord repository.File, chunkSizes []int64, dataKey []byte) error {
+	fileUUID := fileRecord.UUID
+	for i := int64(0); i < int64(len(chunkSizes)); i++ {
+		chunk, err := s.uploadChunk(ctx, file, fileRecord, i, chunkSizes[i], dataKey)
 		if err != nil {
-			return "", errors.Wrap(err, "insert chunk")
+			return err
 		}
 
-		err = s.repository.UpdateChunkStatus(ctx, fileUUID, i, models.ChunkStatusSentToStorage, time.Now())
+		logging.FromContext(ctx).Debug("chunk uploaded",
+			"file_uuid", fileUUID,
+			"chunk_index", i,
+			"storage_id", chunk.StorageID,
+			"codec", chunk.Codec,
+		)
+	}
+
+	return nil
+}
+
+// uploadChunk buffers the next chunk of the file so that the upload can be
+// retried and sends it to storage. On the way the chunk is compressed, unless
+// a sample shows it is incompressible, and then encrypted if the file has a
+// data key. The node keeps the file's wrapped data key and owner with the
+// chunk, for recovery. The chunk is recorded as pending before it is sent,
+// so that an aborted upload finds every chunk it may have left on a node,
+// and as sent to storage once a node has it. It returns the chunk's
+// metadata, with the hash computed over the original data.
+func (s *ChunkerService) uploadChunk(ctx context.Context, file io.Reader, fileRecord repository.File, chunkIndex int64, chunkSize int64, dataKey []byte) (repository.Chunk, error) {
+	fileUUID := fileRecord.UUID
+	reader := io.LimitReader(file, chunkSize)
+
+	sample := make([]byte, min(chunkSize, compression.SampleSize))
+	if _, err := io.ReadFull(reader, sample); err != nil {
+		return repository.Chunk{}, errors.Wrap(err, "read chunk sample")
+	}
+	codec := compression.Choose(s.config.Compression, sample)
+
+	buffer := newChunkBuffer(s.config.UploadDir, s.config.MemoryBufferSize)
+	defer buffer.Close()
+
+	// The node verifies the chunk against the hash of the bytes it stores.
+	storedHash := sha256.New()
+	stored := io.MultiWriter(buffer, storedHash)
+
+	var encryptor io.WriteCloser = nopWriteCloser{stored}
+	if dataKey != nil {
+		chunkCipher, err := encryption.NewChunkCipher(dataKey, fileUUID, chunkIndex)
 		if err != nil {
-			return "", errors.Wrap(err, "update chunk status")
+			return repository.Chunk{}, errors.Wrap(err, "new chunk cipher")
 		}
+		encryptor = chunkCipher.EncryptWriter(stored)
 	}
 
-	return fileUUID, nil
+	compressed := &countingWriter{w: encryptor}
+	compressor, err := compression.NewWriter(codec, compressed)
+	if err != nil {
+		return repository.Chunk{}, errors.Wrap(err, "new compressor")
+	}
+
+	md5Hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(compressor, md5Hash), io.MultiReader(bytes.NewReader(sample), reader))
+	if err != nil {
+		return repository.Chunk{}, errors.Wrap(err, "buffer chunk")
+	}
+
+	if n != chunkSize {
+		return repository.Chunk{}, errors.Errorf("short read: got %d of %d bytes", n, chunkSize)
+	}
+
+	if err := compressor.Close(); err != nil {
+		return repository.Chunk{}, errors.Wrap(err, "compress chunk")
+	}
+
+	if err := encryptor.Close(); err != nil {
+		return repository.Chunk{}, errors.Wrap(err, "encrypt chunk")
+	}
+
+	chunkHash := hex.EncodeToString(md5Hash.Sum(nil))
+	metadata := storage.ChunkMetadata{
+		NumOfChunks:    NUM_OF_CHUNKS,
+		Checksum:       hex.EncodeToString(storedHash.Sum(nil)),
+		ChunkHash:      chunkHash,
+		Codec:          codec.String(),
+		LogicalSize:    n,
+		CompressedSize: compressed.n,
+		Owner:          fileRecord.Owner,
+	}
+	if dataKey != nil {
+		// The hash of the plaintext would let the node confirm guesses of
+		// the data it cannot read.
+		metadata.ChunkHash = ""
+		metadata.EncryptedKey = fileRecord.EncryptedKey
+		metadata.KeyID = *fileRecord.KeyID
+	}
+
+	chunk := repository.Chunk{
+		UUID:           fileUUID,
+		ChunkIndex:     chunkIndex,
+		ChunkHash:      chunkHash,
+		Status:         models.ChunkStatusPending.String(),
+		NumOfChunks:    NUM_OF_CHUNKS,
+		StorageID:      s.storageManager.GetStorageID(fileUUID, chunkIndex),
+		Codec:          codec.String(),
+		LogicalSize:    &n,
+		CompressedSize: &compressed.n,
+	}
+	if err := s.repository.InsertChunk(ctx, chunk); err != nil {
+		return repository.Chunk{}, errors.Wrap(err, "insert chunk")
+	}
+
+	storageID, err := s.storageManager.UploadChunkStream(ctx, fileUUID, chunkIndex, buffer.Reader(), buffer.Size(), metadata)
+	if err != nil {
+		return repository.Chunk{}, errors.Wrap(err, "upload chunk to storage")
+	}
+
+	if err := s.repository.UpdateChunkLocation(ctx, fileUUID, chunkIndex, storageID, time.Now()); err != nil {
+		return repository.Chunk{}, errors.Wrap(err, "update chunk location")
+	}
+
+	chunk.Status = models.ChunkStatusSentToStorage.String()
+	chunk.StorageID = storageID
+
+	return chunk, nil
 }
 
 func getChunkSizes(fileSize int64, numOfChunks int) []int64 {
@@ -97,42 +382,304 @@ func getChunkSizes(fileSize int64, numOfChunks int) []int64 {
 	return chunkSizes
 }
 
-func (s *ChunkerService) SelectStream(ctx context.Context, fileUUID string, writer io.Writer) error {
-	chunks, err := s.repository.GetChunksByUUID(ctx, fileUUID)
+func (s *ChunkerService) GetFile(ctx context.Context, fileUUID string) (repository.File, error) {
+	file, err := s.repository.GetFile(ctx, fileUUID)
 	if err != nil {
-		return errors.Wrap(err, "get chunks from database")
+		return repository.File{}, errors.Wrap(err, "get file")
 	}
 
-	if len(chunks) == 0 {
-		return errors.New("no chunks found for file")
+	if file.Status != models.FileStatusComplete.String() {
+		return repository.File{}, errors.Wrapf(ErrNotFound, "upload of file %s is not complete", fileUUID)
 	}
 
-	fmt.Printf("DEBUG: Found %d chunks for file %s\n", len(chunks), fileUUID)
+	return file, nil
+}
+
+// Download is a file whose chunks have been checked to be stored, ready to
+// be streamed.
+type Download struct {
+	File repository.File
+
+	service *ChunkerService
+	chunks  []repository.Chunk
+	dataKey []byte
+}
 
-	chunksIntegrity := make(map[int64]struct{})
+// PrepareDownload checks that every chunk of a file is stored and unwraps its
+// data key, so that a download that cannot succeed fails before any data is
+// sent.
+func (s *ChunkerService) PrepareDownload(ctx context.Context, file repository.File) (*Download, error) {
+	chunks, err := s.repository.GetChunksByUUID(ctx, file.UUID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get chunks from database")
+	}
+
+	logging.FromContext(ctx).Debug("found chunks", "file_uuid", file.UUID, "num_chunks", len(chunks))
+
+	if err := checkChunks(chunks); err != nil {
+		return nil, err
+	}
+
+	dataKey, err := s.getDataKey(ctx, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "get data key")
+	}
+
+	return &Download{
+		File:    file,
+		service: s,
+		chunks:  chunks,
+		dataKey: dataKey,
+	}, nil
+}
+
+// checkChunks checks that the chunks, ordered by index, are all of a file's
+// and are stored. The count of chunks is the one the chunks record, as the
+// file may have been written with another count than NUM_OF_CHUNKS.
+func checkChunks(chunks []repository.Chunk) error {
+	if len(chunks) == 0 {
+		return errors.Wrap(ErrIncomplete, "no chunks found for file")
+	}
+
+	numOfChunks := chunks[0].NumOfChunks
 	for i, chunk := range chunks {
-		fmt.Printf("DEBUG: Chunk %d: index=%d, hash=%s, status=%s, storage_id=%d\n", i, chunk.ChunkIndex, chunk.ChunkHash, chunk.Status, chunk.StorageID)
+		if chunk.NumOfChunks != numOfChunks {
+			return errors.Wrapf(ErrIncomplete, "chunk %d records %d chunks, the first chunk %d", chunk.ChunkIndex, chunk.NumOfChunks, numOfChunks)
+		}
+
+		if chunk.ChunkIndex >= numOfChunks {
+			return errors.Wrapf(ErrIncomplete, "chunk %d is beyond the chunk count %d", chunk.ChunkIndex, numOfChunks)
+		}
+
+		if chunk.ChunkIndex != int64(i) {
+			return errors.Wrapf(ErrIncomplete, "chunk %d is missing", i)
+		}
+
 		if chunk.Status != models.ChunkStatusSentToStorage.String() {
-			return errors.New("chunk is not sent to storage")
+			return errors.Wrapf(ErrIncomplete, "chunk %d is not sent to storage", chunk.ChunkIndex)
 		}
+	}
 
-		chunksIntegrity[chunk.ChunkIndex] = struct{}{}
+	if int64(len(chunks)) != numOfChunks {
+		return errors.Wrapf(ErrIncomplete, "chunk %d is missing", len(chunks))
 	}
 
-	for i := range NUM_OF_CHUNKS {
-		if _, ok := chunksIntegrity[int64(i)]; !ok {
-			return errors.New("file integrity check failed")
-		}
+	return nil
+}
+
+// FileETag returns the ETag of a file, a strong entity tag derived from the
+// hashes of its chunks, or empty if one of them is unknown. It does not check
+// that the file can be downloaded.
+func (s *ChunkerService) FileETag(ctx context.Context, fileUUID string) (string, error) {
+	chunks, err := s.repository.GetChunksByUUID(ctx, fileUUID)
+	if err != nil {
+		return "", errors.Wrap(err, "get chunks from database")
 	}
 
+	return fileETag(chunks), nil
+}
+
+// fileETag digests the hashes of all chunks, in the manner of multipart
+// uploads: the MD5 of the chunks' MD5s followed by the number of chunks.
+func fileETag(chunks []repository.Chunk) string {
+	digest := md5.New()
 	for _, chunk := range chunks {
-		fmt.Printf("DEBUG: Downloading chunk %d from storage %d\n", chunk.ChunkIndex, chunk.StorageID)
-		err := s.storageManager.DownloadChunkStream(ctx, fileUUID, chunk.ChunkIndex, writer)
+		chunkHash, err := hex.DecodeString(chunk.ChunkHash)
+		if err != nil || len(chunkHash) != md5.Size {
+			return ""
+		}
+		digest.Write(chunkHash)
+	}
+
+	return fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(digest.Sum(nil)), len(chunks))
+}
+
+// Size returns the size of the file and whether it is known. Files uploaded
+// before sizes were recorded were given a size of 0 and their chunks record
+// none, so their size is only known once they have been read.
+func (d *Download) Size() (int64, bool) {
+	if d.File.Size > 0 {
+		return d.File.Size, true
+	}
+
+	for _, chunk := range d.chunks {
+		if chunk.LogicalSize == nil {
+			return 0, false
+		}
+	}
+
+	return 0, true
+}
+
+// WriteRange streams length bytes of the file starting at offset, or the
+// rest of the file if length is negative. Chunks before the range are
+// skipped when their size is known, and the download of the last chunk in
+// the range stops once the range is complete.
+func (d *Download) WriteRange(ctx context.Context, offset int64, length int64, writer io.Writer) error {
+	logger := logging.FromContext(ctx).With("file_uuid", d.File.UUID)
+
+	downloaded := &countingWriter{w: writer}
+	defer func() {
+		metrics.DownloadedBytes.Add(float64(downloaded.n))
+	}()
+
+	ranged := &rangeWriter{w: downloaded, skip: offset, remaining: length}
+	for _, chunk := range d.chunks {
+		if ranged.remaining == 0 {
+			break
+		}
+
+		if chunk.LogicalSize != nil && *chunk.LogicalSize <= ranged.skip {
+			ranged.skip -= *chunk.LogicalSize
+			continue
+		}
+
+		chunkLogger := logger.With("chunk_index", chunk.ChunkIndex, "storage_id", chunk.StorageID)
+
+		start := time.Now()
+		err := d.service.downloadChunk(ctx, chunk, d.dataKey, ranged)
 		if err != nil {
+			chunkLogger.Error("chunk download failed", "error", err)
 			return errors.Wrapf(err, "download chunk stream %d", chunk.ChunkIndex)
 		}
-		fmt.Printf("DEBUG: Successfully downloaded chunk %d\n", chunk.ChunkIndex)
+		chunkLogger.Debug("chunk downloaded", "codec", chunk.Codec, "duration", time.Since(start))
 	}
 
 	return nil
 }
+
+// getDataKey returns the unwrapped data key of an encrypted file, or nil if
+// the file is stored in plaintext.
+func (s *ChunkerService) getDataKey(ctx context.Context, file repository.File) ([]byte, error) {
+	if file.KeyID == nil {
+		return nil, nil
+	}
+
+	if s.config.KeyWrapper == nil {
+		return nil, errors.New("file is encrypted but no master key is configured")
+	}
+
+	return s.config.KeyWrapper.UnwrapKey(ctx, file.EncryptedKey, *file.KeyID, file.UUID)
+}
+
+// downloadChunk streams a chunk to writer, decrypting and decompressing it
+// as recorded in its metadata. Uncompressed chunks are read from the byte,
+// or for encrypted ones the segment, that holds the first byte writer keeps;
+// compressed ones are read from their start. The download is cancelled once
+// writer needs no more bytes.
+func (s *ChunkerService) downloadChunk(ctx context.Context, chunk repository.Chunk, dataKey []byte, writer *rangeWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer.done = cancel
+
+	var offset, segment int64
+	if chunk.LogicalSize != nil && compression.Codec(chunk.Codec) == compression.CodecNone {
+		if dataKey != nil {
+			segment, offset, writer.skip = encryption.SegmentOffset(writer.skip)
+		} else {
+			offset, writer.skip = writer.skip, 0
+		}
+	}
+
+	decompressor := compression.NewDecompressWriter(compression.Codec(chunk.Codec), writer)
+	defer decompressor.Close()
+
+	var decryptor io.WriteCloser = nopWriteCloser{decompressor}
+	if dataKey != nil {
+		chunkCipher, err := encryption.NewChunkCipher(dataKey, chunk.UUID, chunk.ChunkIndex)
+		if err != nil {
+			return errors.Wrap(err, "new chunk cipher")
+		}
+		decryptor = chunkCipher.DecryptWriter(decompressor, segment)
+	}
+
+	err := s.storageManager.DownloadChunkStream(ctx, chunk.StorageID, chunk.UUID, chunk.ChunkIndex, offset, decryptor)
+	if err == nil {
+		err = errors.Wrap(decryptor.Close(), "decrypt chunk")
+	}
+	if err == nil {
+		err = errors.Wrap(decompressor.Close(), "decompress chunk")
+	}
+
+	// Once the range is complete the rest of the chunk is not wanted, so it
+	// is neither read nor authenticated nor decompressed.
+	if writer.complete() {
+		return nil
+	}
+
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rangeWriter drops the first skip bytes written to it and passes on at most
+// remaining bytes after them, or all of them if remaining is negative. Once
+// it has passed on remaining bytes it calls done and fails further writes
+// with errRangeComplete.
+type rangeWriter struct {
+	w         io.Writer
+	skip      int64
+	remaining int64
+	done      func()
+}
+
+// errRangeComplete stops the copy of a chunk of which no more bytes are
+// needed.
+var errRangeComplete = errors.New("range complete")
+
+func (r *rangeWriter) complete() bool {
+	return r.remaining == 0
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	if r.complete() {
+		return 0, errRangeComplete
+	}
+
+	n := len(p)
+
+	if r.skip > 0 {
+		if int64(len(p)) <= r.skip {
+			r.skip -= int64(len(p))
+			return n, nil
+		}
+		p = p[r.skip:]
+		r.skip = 0
+	}
+
+	if r.remaining >= 0 {
+		if int64(len(p)) > r.remaining {
+			p = p[:r.remaining]
+		}
+		r.remaining -= int64(len(p))
+	}
+
+	if len(p) > 0 {
+		if _, err := r.w.Write(p); err != nil {
+			return 0, err
+		}
+	}
+
+	if r.complete() && r.done != nil {
+		r.done()
+	}
+
+	return n, nil
+}
@@ -1,7 +1,26 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/pkg/errors"
+
+	"gateway/internal/compression"
+	"gateway/internal/encryption"
+	"gateway/internal/models"
+	"gateway/internal/repository"
+	"gateway/internal/storage"
 )
 
 func TestCreateChunkSizes_ValidChunks(t *testing.T) {
@@ -46,3 +65,272 @@ func TestCreateChunkSizes_ValidChunks(t *testing.T) {
 		}
 	}
 }
+
+func TestRangeWriter(t *testing.T) {
+	tests := []struct {
+		skip      int64
+		remaining int64
+		want      string
+	}{
+		{0, -1, "abcdefghij"},
+		{3, -1, "defghij"},
+		{3, 4, "defg"},
+		{0, 0, ""},
+		{12, -1, ""},
+		{9, 5, "j"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		done := false
+		w := &rangeWriter{w: &out, skip: tt.skip, remaining: tt.remaining, done: func() { done = true }}
+		for _, part := range []string{"abc", "defg", "hij"} {
+			n, err := w.Write([]byte(part))
+			if errors.Is(err, errRangeComplete) && w.complete() {
+				break
+			}
+			if err != nil || n != len(part) {
+				t.Fatalf("Write(%q) = %d, %v", part, n, err)
+			}
+		}
+
+		if out.String() != tt.want {
+			t.Errorf("skip %d, remaining %d: got %q, want %q", tt.skip, tt.remaining, out.String(), tt.want)
+		}
+		if done != (tt.remaining > 0 && int64(len(tt.want)) == tt.remaining) {
+			t.Errorf("skip %d, remaining %d: done called = %v", tt.skip, tt.remaining, done)
+		}
+	}
+}
+
+// chunkServer serves chunks as a storage node does and records the offset
+// each chunk was requested from.
+type chunkServer struct {
+	mu      sync.Mutex
+	chunks  map[string][]byte
+	offsets map[int64]int64
+}
+
+func (c *chunkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	chunkIndex, _ := strconv.ParseInt(query.Get("chunk_index"), 10, 64)
+	data := c.chunks[query.Get("chunk_index")]
+
+	var offset int64
+	if header := r.Header.Get("Range"); header != "" {
+		offset, _ = strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(header, "bytes="), "-"), 10, 64)
+	}
+
+	c.mu.Lock()
+	c.offsets[chunkIndex] = offset
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)-int(offset)))
+	if offset > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(data[offset:])
+}
+
+func TestWriteRange(t *testing.T) {
+	const chunkSize = 100 << 10
+
+	plain := make([]byte, 3*chunkSize)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+
+	dataKey, err := encryption.NewDataKey()
+	if err != nil {
+		t.Fatalf("new data key: %v", err)
+	}
+
+	// stored returns the chunks of plain as the gateway uploads them.
+	stored := func(codec compression.Codec, dataKey []byte) map[string][]byte {
+		chunks := make(map[string][]byte)
+		for i := range int64(3) {
+			var out bytes.Buffer
+			var sink io.WriteCloser = nopWriteCloser{&out}
+			if dataKey != nil {
+				chunkCipher, err := encryption.NewChunkCipher(dataKey, "file", i)
+				if err != nil {
+					t.Fatalf("new chunk cipher: %v", err)
+				}
+				sink = chunkCipher.EncryptWriter(&out)
+			}
+			compressor, err := compression.NewWriter(codec, sink)
+			if err != nil {
+				t.Fatalf("new writer: %v", err)
+			}
+			compressor.Write(plain[i*chunkSize : (i+1)*chunkSize])
+			compressor.Close()
+			sink.Close()
+			chunks[strconv.FormatInt(i, 10)] = out.Bytes()
+		}
+		return chunks
+	}
+
+	tests := []struct {
+		name        string
+		codec       compression.Codec
+		dataKey     []byte
+		unsized     bool
+		offset      int64
+		length      int64
+		wantOffsets map[int64]int64
+	}{
+		{"whole file", compression.CodecNone, nil, false, 0, -1, map[int64]int64{0: 0, 1: 0, 2: 0}},
+		{"inside a plain chunk", compression.CodecNone, nil, false, chunkSize + 70000, 1000, map[int64]int64{1: 70000}},
+		{"across plain chunks", compression.CodecNone, nil, false, 90000, 20000, map[int64]int64{0: 90000, 1: 0}},
+		{"rest of the file", compression.CodecNone, nil, false, chunkSize + 5, -1, map[int64]int64{1: 5, 2: 0}},
+		{"inside an encrypted chunk", compression.CodecNone, dataKey, false, chunkSize + 70000, 1000, map[int64]int64{1: encryption.SegmentSize + encryption.Overhead}},
+		{"across encrypted chunks", compression.CodecNone, dataKey, false, 90000, 20000, map[int64]int64{0: encryption.SegmentSize + encryption.Overhead, 1: 0}},
+		{"inside a compressed chunk", compression.CodecZstd, nil, false, chunkSize + 70000, 1000, map[int64]int64{1: 0}},
+		{"inside a compressed encrypted chunk", compression.CodecGzip, dataKey, false, chunkSize + 70000, 1000, map[int64]int64{1: 0}},
+		{"chunks of unknown size", compression.CodecNone, nil, true, chunkSize + 70000, 1000, map[int64]int64{0: 0, 1: 0}},
+	}
+
+	for _, tt := range tests {
+		server := &chunkServer{chunks: stored(tt.codec, tt.dataKey), offsets: make(map[int64]int64)}
+		httpServer := httptest.NewServer(server)
+
+		storageManager, err := storage.NewStorageManager([]string{strings.TrimPrefix(httpServer.URL, "http://")}, storage.DefaultConfig())
+		if err != nil {
+			t.Fatalf("new storage manager: %v", err)
+		}
+
+		download := &Download{
+			File:    repository.File{UUID: "file"},
+			service: &ChunkerService{storageManager: storageManager},
+			dataKey: tt.dataKey,
+		}
+		for i := range int64(3) {
+			chunk := repository.Chunk{UUID: "file", ChunkIndex: i, StorageID: 1, Codec: tt.codec.String()}
+			if !tt.unsized {
+				size := int64(chunkSize)
+				chunk.LogicalSize = &size
+			}
+			download.chunks = append(download.chunks, chunk)
+		}
+
+		var out bytes.Buffer
+		err = download.WriteRange(context.Background(), tt.offset, tt.length, &out)
+		storageManager.Close()
+		httpServer.Close()
+		if err != nil {
+			t.Errorf("%s: write range: %v", tt.name, err)
+			continue
+		}
+
+		end := int64(len(plain))
+		if tt.length >= 0 {
+			end = tt.offset + tt.length
+		}
+		if !bytes.Equal(out.Bytes(), plain[tt.offset:end]) {
+			t.Errorf("%s: got %d bytes that differ from the %d in the range", tt.name, out.Len(), end-tt.offset)
+		}
+		if !maps.Equal(server.offsets, tt.wantOffsets) {
+			t.Errorf("%s: chunks requested from %v, want %v", tt.name, server.offsets, tt.wantOffsets)
+		}
+	}
+}
+
+func TestDownloadSize(t *testing.T) {
+	size := func(n int64) *int64 { return &n }
+
+	tests := []struct {
+		name      string
+		fileSize  int64
+		chunks    []repository.Chunk
+		wantSize  int64
+		wantKnown bool
+	}{
+		{"recorded size", 10, []repository.Chunk{{LogicalSize: size(4)}, {LogicalSize: size(6)}}, 10, true},
+		{"empty file", 0, []repository.Chunk{{LogicalSize: size(0)}}, 0, true},
+		{"backfilled file", 0, []repository.Chunk{{}, {}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		download := &Download{File: repository.File{Size: tt.fileSize}, chunks: tt.chunks}
+		got, known := download.Size()
+		if got != tt.wantSize || known != tt.wantKnown {
+			t.Errorf("%s: Size() = %d, %v; want %d, %v", tt.name, got, known, tt.wantSize, tt.wantKnown)
+		}
+	}
+}
+
+func TestCheckChunks(t *testing.T) {
+	chunks := func(numOfChunks int64, indexes ...int64) []repository.Chunk {
+		var chunks []repository.Chunk
+		for _, index := range indexes {
+			chunks = append(chunks, repository.Chunk{
+				ChunkIndex:  index,
+				NumOfChunks: numOfChunks,
+				Status:      models.ChunkStatusSentToStorage.String(),
+			})
+		}
+		return chunks
+	}
+
+	pending := chunks(3, 0, 1, 2)
+	pending[1].Status = models.ChunkStatusPending.String()
+
+	mixed := chunks(3, 0, 1, 2)
+	mixed[2].NumOfChunks = 4
+
+	tests := []struct {
+		name    string
+		chunks  []repository.Chunk
+		wantErr bool
+	}{
+		{"default count", chunks(NUM_OF_CHUNKS, 0, 1, 2, 3, 4, 5), false},
+		{"fewer chunks recorded", chunks(3, 0, 1, 2), false},
+		{"more chunks recorded", chunks(8, 0, 1, 2, 3, 4, 5, 6, 7), false},
+		{"no chunks", nil, true},
+		{"missing in the middle", chunks(3, 0, 2), true},
+		{"missing at the end", chunks(3, 0, 1), true},
+		{"beyond the count", chunks(3, 0, 1, 2, 3), true},
+		{"pending", pending, true},
+		{"differing counts", mixed, true},
+	}
+
+	for _, tt := range tests {
+		err := checkChunks(tt.chunks)
+		if tt.wantErr && !errors.Is(err, ErrIncomplete) {
+			t.Errorf("%s: expected ErrIncomplete, got %v", tt.name, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
+
+func TestFileETag(t *testing.T) {
+	hashOf := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	chunks := func(hashes ...string) []repository.Chunk {
+		records := make([]repository.Chunk, len(hashes))
+		for i, chunkHash := range hashes {
+			records[i] = repository.Chunk{ChunkIndex: int64(i), ChunkHash: chunkHash}
+		}
+		return records
+	}
+
+	etag := fileETag(chunks(hashOf("a"), hashOf("b")))
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `-2"`) {
+		t.Errorf("etag = %s, want a quoted digest of 2 chunks", etag)
+	}
+	if other := fileETag(chunks(hashOf("b"), hashOf("a"))); other == etag {
+		t.Errorf("etag of reordered chunks = %s, want it to differ", other)
+	}
+	if again := fileETag(chunks(hashOf("a"), hashOf("b"))); again != etag {
+		t.Errorf("etag = %s, then %s for the same chunks", etag, again)
+	}
+	if unknown := fileETag(chunks(hashOf("a"), "")); unknown != "" {
+		t.Errorf("etag with an unknown chunk hash = %s, want none", unknown)
+	}
+}
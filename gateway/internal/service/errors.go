@@ -0,0 +1,24 @@
+package service
+
+import (
+	"gateway/internal/repository"
+	"gateway/internal/storage"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotFound        = repository.ErrNotFound
+	ErrAlreadyExists   = repository.ErrAlreadyExists
+	ErrQuotaExceeded   = repository.ErrQuotaExceeded
+	ErrTenantNotFound  = repository.ErrTenantNotFound
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrIncomplete is returned for files that are recorded as complete but
+	// miss chunks, so that they cannot be read.
+	ErrIncomplete = errors.New("file incomplete")
+	// ErrUnavailable is returned when the storage nodes cannot be reached.
+	ErrUnavailable = storage.ErrUnavailable
+	// ErrPreconditionFailed is returned when a conditional write finds its
+	// target changed.
+	ErrPreconditionFailed = repository.ErrPreconditionFailed
+)
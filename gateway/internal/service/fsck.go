@@ -0,0 +1,401 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gateway/internal/encryption"
+	"gateway/internal/models"
+	"gateway/internal/repository"
+	"gateway/internal/storage"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	fsckBatchSize   = 100
+	fsckConcurrency = 8
+)
+
+// FsckState is the verdict on a file.
+type FsckState string
+
+const (
+	// FsckHealthy files have every chunk recorded as sent and stored on its
+	// node with the expected size.
+	FsckHealthy FsckState = "healthy"
+	// FsckDegraded files look readable, but their metadata does not match the
+	// nodes or could not be verified completely.
+	FsckDegraded FsckState = "degraded"
+	// FsckLost files miss data: a chunk that is not recorded, not stored on
+	// any node or stored with the wrong size.
+	FsckLost FsckState = "lost"
+)
+
+// Kinds of problems found in a file. Each one is either degrading or makes
+// the file lost, see isLost.
+const (
+	ProblemMissingRecord   = "missing_record"
+	ProblemMissingObject   = "missing_object"
+	ProblemSizeMismatch    = "size_mismatch"
+	ProblemNotSent         = "not_sent"
+	ProblemMisplaced       = "misplaced"
+	ProblemNodeUnavailable = "node_unavailable"
+	ProblemUnexpectedChunk = "unexpected_chunk"
+	ProblemChunkCount      = "chunk_count_mismatch"
+)
+
+func isLost(kind string) bool {
+	switch kind {
+	case ProblemMissingRecord, ProblemMissingObject, ProblemSizeMismatch:
+		return true
+	}
+
+	return false
+}
+
+type FsckProblem struct {
+	Kind       string `json:"kind"`
+	ChunkIndex int64  `json:"chunk_index"`
+	// StorageID is the node the chunk is recorded on, or for misplaced
+	// chunks the node it was found on.
+	StorageID int    `json:"storage_id,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	// Repaired is set once the metadata has been fixed.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+type FsckFile struct {
+	UUID     string        `json:"file_uuid"`
+	Name     string        `json:"name"`
+	TenantID string        `json:"tenant_id"`
+	State    FsckState     `json:"state"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+// FsckReport is the result of a check. Healthy files are only counted, the
+// others are listed with their problems ordered by UUID.
+type FsckReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Repair     bool      `json:"repair"`
+	Checked    int       `json:"checked"`
+	Healthy    int       `json:"healthy"`
+	Degraded   int       `json:"degraded"`
+	Lost       int       `json:"lost"`
+	// Repaired counts the files whose metadata was fixed and Skipped the
+	// files that were not checked because they are not complete.
+	Repaired int        `json:"repaired"`
+	Skipped  int        `json:"skipped"`
+	Files    []FsckFile `json:"files"`
+}
+
+type FsckOptions struct {
+	// Repair fixes the metadata of chunks that were found intact: their
+	// status, and their storage ID when they are on another node than
+	// recorded. Lost data is only reported.
+	Repair bool
+	// Concurrency is how many files are checked at once, 8 if not set.
+	Concurrency int
+}
+
+// chunkStatter looks up chunks on the storage nodes.
+type chunkStatter interface {
+	StatChunk(ctx context.Context, storageID int, fileUUID string, chunkIndex int64) (int64, error)
+	GetNumStorage() int
+}
+
+type FsckService struct {
+	repository *repository.Repository
+	nodes      chunkStatter
+	jobs       fsckJobs
+}
+
+func NewFsckService(repository *repository.Repository, storageManager *storage.StorageManager) *FsckService {
+	return &FsckService{
+		repository: repository,
+		nodes:      storageManager,
+	}
+}
+
+// Fsck checks every complete file against the storage nodes.
+func (s *FsckService) Fsck(ctx context.Context, options FsckOptions) (FsckReport, error) {
+	report := FsckReport{
+		StartedAt: time.Now(),
+		Repair:    options.Repair,
+		Files:     []FsckFile{},
+	}
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = fsckConcurrency
+	}
+
+	// The first error stops the check.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	files := make(chan repository.File)
+
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				result, repaired, err := s.fsckFile(ctx, file, options.Repair)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				if err == nil {
+					report.add(result, repaired)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := s.eachCompleteFile(ctx, files)
+	close(files)
+	wg.Wait()
+
+	if firstErr != nil {
+		err = firstErr
+	}
+	if err != nil {
+		return FsckReport{}, err
+	}
+
+	report.Skipped, err = s.repository.CountFilesNotInStatus(ctx, models.FileStatusComplete)
+	if err != nil {
+		return FsckReport{}, errors.Wrap(err, "count skipped files")
+	}
+
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].UUID < report.Files[j].UUID
+	})
+	report.FinishedAt = time.Now()
+
+	return report, nil
+}
+
+func (r *FsckReport) add(file FsckFile, repaired bool) {
+	r.Checked++
+	switch file.State {
+	case FsckHealthy:
+		r.Healthy++
+		return
+	case FsckDegraded:
+		r.Degraded++
+	case FsckLost:
+		r.Lost++
+	}
+
+	if repaired {
+		r.Repaired++
+	}
+	r.Files = append(r.Files, file)
+}
+
+// eachCompleteFile sends every complete file to files until ctx is done.
+func (s *FsckService) eachCompleteFile(ctx context.Context, files chan<- repository.File) error {
+	after := ""
+	for {
+		page, err := s.repository.GetFilesByStatus(ctx, models.FileStatusComplete, after, fsckBatchSize)
+		if err != nil {
+			return errors.Wrap(err, "get files")
+		}
+
+		if len(page) == 0 {
+			return nil
+		}
+
+		for _, file := range page {
+			select {
+			case files <- file:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			after = file.UUID
+		}
+	}
+}
+
+func (s *FsckService) fsckFile(ctx context.Context, file repository.File, repair bool) (FsckFile, bool, error) {
+	chunks, err := s.repository.GetChunksByUUID(ctx, file.UUID)
+	if err != nil {
+		return FsckFile{}, false, errors.Wrapf(err, "get chunks of file %s", file.UUID)
+	}
+
+	result := s.checkFile(ctx, file, chunks)
+	if !repair || result.State == FsckHealthy {
+		return result, false, nil
+	}
+
+	repaired := false
+	for i, problem := range result.Problems {
+		switch problem.Kind {
+		case ProblemNotSent:
+			err = s.repository.UpdateChunkStatus(ctx, file.UUID, problem.ChunkIndex, models.ChunkStatusSentToStorage, time.Now())
+		case ProblemMisplaced:
+			err = s.repository.UpdateChunkLocation(ctx, file.UUID, problem.ChunkIndex, problem.StorageID, time.Now())
+		default:
+			continue
+		}
+		if err != nil {
+			return FsckFile{}, false, errors.Wrapf(err, "repair chunk %d of file %s", problem.ChunkIndex, file.UUID)
+		}
+
+		result.Problems[i].Repaired = true
+		repaired = true
+	}
+
+	return result, repaired, nil
+}
+
+// checkFile compares the chunk records of a file with what the storage nodes
+// hold.
+func (s *FsckService) checkFile(ctx context.Context, file repository.File, chunks []repository.Chunk) FsckFile {
+	result := FsckFile{
+		UUID:     file.UUID,
+		Name:     file.Name,
+		TenantID: file.TenantID,
+		Problems: []FsckProblem{},
+	}
+
+	// Every record carries the chunk count; without any, the file is written
+	// with NUM_OF_CHUNKS chunks.
+	numOfChunks := int64(NUM_OF_CHUNKS)
+	if len(chunks) > 0 {
+		numOfChunks = chunks[0].NumOfChunks
+	}
+
+	byIndex := make(map[int64]repository.Chunk, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.NumOfChunks != numOfChunks {
+			result.Problems = append(result.Problems, FsckProblem{
+				Kind:       ProblemChunkCount,
+				ChunkIndex: chunk.ChunkIndex,
+				Detail:     fmt.Sprintf("records %d chunks, the first chunk %d", chunk.NumOfChunks, numOfChunks),
+			})
+		}
+		if chunk.ChunkIndex < 0 || chunk.ChunkIndex >= numOfChunks {
+			result.Problems = append(result.Problems, FsckProblem{
+				Kind:       ProblemUnexpectedChunk,
+				ChunkIndex: chunk.ChunkIndex,
+				StorageID:  chunk.StorageID,
+			})
+			continue
+		}
+		byIndex[chunk.ChunkIndex] = chunk
+	}
+
+	for index := range numOfChunks {
+		chunk, ok := byIndex[index]
+		if !ok {
+			result.Problems = append(result.Problems, FsckProblem{Kind: ProblemMissingRecord, ChunkIndex: index})
+			continue
+		}
+
+		if problem, ok := s.checkChunk(ctx, file, chunk); ok {
+			result.Problems = append(result.Problems, problem)
+		}
+	}
+
+	result.State = FsckHealthy
+	for _, problem := range result.Problems {
+		if isLost(problem.Kind) {
+			result.State = FsckLost
+			break
+		}
+		result.State = FsckDegraded
+	}
+
+	return result
+}
+
+// checkChunk looks up a chunk on its node and, if it is not there, on all
+// others. It reports the chunk's problem if it has one.
+func (s *FsckService) checkChunk(ctx context.Context, file repository.File, chunk repository.Chunk) (FsckProblem, bool) {
+	problem := FsckProblem{ChunkIndex: chunk.ChunkIndex, StorageID: chunk.StorageID}
+
+	// Chunks stored before sizes were recorded can only be checked for
+	// existence.
+	expected := int64(-1)
+	if chunk.CompressedSize != nil {
+		expected = *chunk.CompressedSize
+		if file.KeyID != nil {
+			expected = encryption.EncryptedSize(expected)
+		}
+	}
+
+	size, err := s.nodes.StatChunk(ctx, chunk.StorageID, file.UUID, chunk.ChunkIndex)
+	switch {
+	case errors.Is(err, storage.ErrChunkNotFound):
+		return s.findChunk(ctx, file, chunk, expected), true
+	case err != nil:
+		problem.Kind = ProblemNodeUnavailable
+		problem.Detail = err.Error()
+		return problem, true
+	case expected >= 0 && size != expected:
+		problem.Kind = ProblemSizeMismatch
+		problem.Detail = fmt.Sprintf("stored %d bytes, expected %d", size, expected)
+		return problem, true
+	case chunk.Status != models.ChunkStatusSentToStorage.String():
+		problem.Kind = ProblemNotSent
+		problem.Detail = "status is " + chunk.Status
+		return problem, true
+	}
+
+	return FsckProblem{}, false
+}
+
+// findChunk searches the nodes other than the recorded one for a chunk, as
+// placed there when its node was unavailable during the upload.
+func (s *FsckService) findChunk(ctx context.Context, file repository.File, chunk repository.Chunk, expected int64) FsckProblem {
+	problem := FsckProblem{
+		Kind:       ProblemMissingObject,
+		ChunkIndex: chunk.ChunkIndex,
+		StorageID:  chunk.StorageID,
+	}
+
+	var unavailable []int
+	for storageID := 1; storageID <= s.nodes.GetNumStorage(); storageID++ {
+		if storageID == chunk.StorageID {
+			continue
+		}
+
+		size, err := s.nodes.StatChunk(ctx, storageID, file.UUID, chunk.ChunkIndex)
+		if errors.Is(err, storage.ErrChunkNotFound) {
+			continue
+		}
+		if err != nil {
+			unavailable = append(unavailable, storageID)
+			continue
+		}
+		if expected >= 0 && size != expected {
+			continue
+		}
+
+		problem.Kind = ProblemMisplaced
+		problem.StorageID = storageID
+		problem.Detail = fmt.Sprintf("recorded on storage %d", chunk.StorageID)
+		return problem
+	}
+
+	// The chunk may still be on a node that did not answer.
+	if len(unavailable) > 0 {
+		problem.Kind = ProblemNodeUnavailable
+		problem.Detail = fmt.Sprintf("not on storage %d, storage %v unavailable", chunk.StorageID, unavailable)
+	}
+
+	return problem
+}
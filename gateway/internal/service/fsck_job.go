@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"karma8/common/logging"
+
+	"github.com/pkg/errors"
+)
+
+// FsckJobState is the progress of a check run in the background.
+type FsckJobState string
+
+const (
+	FsckJobRunning   FsckJobState = "running"
+	FsckJobFinished  FsckJobState = "finished"
+	FsckJobFailed    FsckJobState = "failed"
+	FsckJobCancelled FsckJobState = "cancelled"
+)
+
+// FsckJob is a check started by StartFsck. Report is set once the check
+// finished; why a check failed is only logged.
+type FsckJob struct {
+	State      FsckJobState `json:"state"`
+	Repair     bool         `json:"repair"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Report     *FsckReport  `json:"report,omitempty"`
+}
+
+// fsckJobs runs one check at a time in the background and keeps the last
+// one.
+type fsckJobs struct {
+	mu     sync.Mutex
+	last   *FsckJob
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartFsck starts checking every complete file in the background, since a
+// check takes longer than a request may. The check keeps the values of ctx,
+// such as its logger, but is not cancelled with it; see CancelFsck. Only one
+// check runs at a time, starting another fails with ErrAlreadyExists.
+func (s *FsckService) StartFsck(ctx context.Context, options FsckOptions) (FsckJob, error) {
+	return s.jobs.start(ctx, options, s.Fsck)
+}
+
+// FsckStatus returns the running check or the last one that ended, or
+// ErrNotFound if none was started.
+func (s *FsckService) FsckStatus() (FsckJob, error) {
+	return s.jobs.status()
+}
+
+// CancelFsck stops the running check and returns it once it ended. It fails
+// with ErrNotFound if no check is running.
+func (s *FsckService) CancelFsck(ctx context.Context) (FsckJob, error) {
+	return s.jobs.stop(ctx)
+}
+
+func (j *fsckJobs) start(ctx context.Context, options FsckOptions, run func(context.Context, FsckOptions) (FsckReport, error)) (FsckJob, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.last != nil && j.last.State == FsckJobRunning {
+		return FsckJob{}, errors.Wrap(ErrAlreadyExists, "a check is already running")
+	}
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	job := &FsckJob{
+		State:     FsckJobRunning,
+		Repair:    options.Repair,
+		StartedAt: time.Now(),
+	}
+	done := make(chan struct{})
+	j.last, j.cancel, j.done = job, cancel, done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		report, err := run(ctx, options)
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		logger := logging.FromContext(ctx)
+		now := time.Now()
+		job.FinishedAt = &now
+		switch {
+		case err == nil:
+			job.State = FsckJobFinished
+			job.Report = &report
+			logger.Info("fsck finished",
+				"checked", report.Checked, "degraded", report.Degraded, "lost", report.Lost, "repaired", report.Repaired)
+		case ctx.Err() != nil:
+			job.State = FsckJobCancelled
+			logger.Info("fsck cancelled")
+		default:
+			job.State = FsckJobFailed
+			logger.Error("fsck failed", "error", err)
+		}
+	}()
+
+	return *job, nil
+}
+
+func (j *fsckJobs) status() (FsckJob, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.last == nil {
+		return FsckJob{}, errors.Wrap(ErrNotFound, "no check was started")
+	}
+
+	return *j.last, nil
+}
+
+func (j *fsckJobs) stop(ctx context.Context) (FsckJob, error) {
+	j.mu.Lock()
+	if j.last == nil || j.last.State != FsckJobRunning {
+		j.mu.Unlock()
+		return FsckJob{}, errors.Wrap(ErrNotFound, "no check is running")
+	}
+	cancel, done := j.cancel, j.done
+	j.mu.Unlock()
+
+	cancel()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return FsckJob{}, ctx.Err()
+	}
+
+	return j.status()
+}
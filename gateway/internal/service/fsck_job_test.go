@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFsckJobs(t *testing.T) {
+	var jobs fsckJobs
+
+	if _, err := jobs.status(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound before a check was started, got %v", err)
+	}
+
+	release := make(chan struct{})
+	run := func(ctx context.Context, options FsckOptions) (FsckReport, error) {
+		select {
+		case <-release:
+			return FsckReport{Checked: 3, Repair: options.Repair}, nil
+		case <-ctx.Done():
+			return FsckReport{}, ctx.Err()
+		}
+	}
+
+	// The check outlives the request that started it.
+	ctx, cancel := context.WithCancel(context.Background())
+	job, err := jobs.start(ctx, FsckOptions{Repair: true}, run)
+	cancel()
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if job.State != FsckJobRunning || !job.Repair {
+		t.Errorf("Expected a running repair, got %+v", job)
+	}
+
+	if _, err := jobs.start(context.Background(), FsckOptions{}, run); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Expected ErrAlreadyExists while a check is running, got %v", err)
+	}
+
+	close(release)
+	<-jobs.done
+
+	job, err = jobs.status()
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if job.State != FsckJobFinished || job.Report == nil || job.Report.Checked != 3 || job.FinishedAt == nil {
+		t.Errorf("Expected a finished check with its report, got %+v", job)
+	}
+
+	if _, err := jobs.stop(context.Background()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound when no check is running, got %v", err)
+	}
+}
+
+func TestFsckJobs_Cancel(t *testing.T) {
+	var jobs fsckJobs
+
+	run := func(ctx context.Context, options FsckOptions) (FsckReport, error) {
+		<-ctx.Done()
+		return FsckReport{}, ctx.Err()
+	}
+
+	if _, err := jobs.start(context.Background(), FsckOptions{}, run); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	job, err := jobs.stop(context.Background())
+	if err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if job.State != FsckJobCancelled || job.Report != nil {
+		t.Errorf("Expected a cancelled check without a report, got %+v", job)
+	}
+
+	if _, err := jobs.start(context.Background(), FsckOptions{}, run); err != nil {
+		t.Errorf("Expected a check to start after the last one was cancelled, got %v", err)
+	}
+	jobs.stop(context.Background())
+}
+
+func TestFsckJobs_Failed(t *testing.T) {
+	var jobs fsckJobs
+
+	run := func(ctx context.Context, options FsckOptions) (FsckReport, error) {
+		return FsckReport{}, errors.New("database unavailable")
+	}
+
+	if _, err := jobs.start(context.Background(), FsckOptions{}, run); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	<-jobs.done
+
+	job, err := jobs.status()
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if job.State != FsckJobFailed || job.Report != nil {
+		t.Errorf("Expected a failed check without a report, got %+v", job)
+	}
+}
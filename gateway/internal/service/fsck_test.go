@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"gateway/internal/repository"
+	"gateway/internal/storage"
+
+	"github.com/pkg/errors"
+)
+
+// fakeNodes holds the sizes of the chunks stored on each node. Nodes listed
+// in down fail every request.
+type fakeNodes struct {
+	chunks map[int]map[int64]int64
+	down   map[int]bool
+	num    int
+}
+
+func (f *fakeNodes) StatChunk(_ context.Context, storageID int, _ string, chunkIndex int64) (int64, error) {
+	if f.down[storageID] {
+		return 0, errors.New("connection refused")
+	}
+
+	size, ok := f.chunks[storageID][chunkIndex]
+	if !ok {
+		return 0, storage.ErrChunkNotFound
+	}
+
+	return size, nil
+}
+
+func (f *fakeNodes) GetNumStorage() int {
+	return f.num
+}
+
+func TestCheckFile(t *testing.T) {
+	size := func(n int64) *int64 { return &n }
+	keyID := "k1"
+
+	// chunks returns records of three chunks of 10 bytes each, all on
+	// storage 1.
+	chunks := func(edit func([]repository.Chunk)) []repository.Chunk {
+		records := make([]repository.Chunk, 3)
+		for i := range records {
+			records[i] = repository.Chunk{
+				ChunkIndex:     int64(i),
+				NumOfChunks:    3,
+				StorageID:      1,
+				Status:         "sent_to_storage",
+				CompressedSize: size(10),
+			}
+		}
+		if edit != nil {
+			edit(records)
+		}
+		return records
+	}
+	stored := map[int64]int64{0: 10, 1: 10, 2: 10}
+
+	tests := []struct {
+		name      string
+		encrypted bool
+		chunks    []repository.Chunk
+		nodes     fakeNodes
+		want      FsckState
+		wantKinds []string
+	}{
+		{
+			name:   "healthy",
+			chunks: chunks(nil),
+			nodes:  fakeNodes{chunks: map[int]map[int64]int64{1: stored}},
+			want:   FsckHealthy,
+		},
+		{
+			name:   "unknown size only checks existence",
+			chunks: chunks(func(c []repository.Chunk) { c[1].CompressedSize = nil }),
+			nodes:  fakeNodes{chunks: map[int]map[int64]int64{1: {0: 10, 1: 99, 2: 10}}},
+			want:   FsckHealthy,
+		},
+		{
+			name:      "encrypted size",
+			encrypted: true,
+			chunks:    chunks(nil),
+			nodes:     fakeNodes{chunks: map[int]map[int64]int64{1: stored}},
+			want:      FsckLost,
+			wantKinds: []string{ProblemSizeMismatch, ProblemSizeMismatch, ProblemSizeMismatch},
+		},
+		{
+			name:      "missing record",
+			chunks:    chunks(nil)[:2],
+			nodes:     fakeNodes{chunks: map[int]map[int64]int64{1: stored}},
+			want:      FsckLost,
+			wantKinds: []string{ProblemMissingRecord},
+		},
+		{
+			name:      "missing object",
+			chunks:    chunks(nil),
+			nodes:     fakeNodes{chunks: map[int]map[int64]int64{1: {0: 10, 1: 10}}, num: 2},
+			want:      FsckLost,
+			wantKinds: []string{ProblemMissingObject},
+		},
+		{
+			name:      "pending chunk",
+			chunks:    chunks(func(c []repository.Chunk) { c[0].Status = "pending" }),
+			nodes:     fakeNodes{chunks: map[int]map[int64]int64{1: stored}},
+			want:      FsckDegraded,
+			wantKinds: []string{ProblemNotSent},
+		},
+		{
+			name:   "misplaced chunk",
+			chunks: chunks(nil),
+			nodes: fakeNodes{
+				chunks: map[int]map[int64]int64{1: {0: 10, 1: 10}, 2: {2: 10}},
+				num:    2,
+			},
+			want:      FsckDegraded,
+			wantKinds: []string{ProblemMisplaced},
+		},
+		{
+			name:      "node down",
+			chunks:    chunks(func(c []repository.Chunk) { c[2].StorageID = 2 }),
+			nodes:     fakeNodes{chunks: map[int]map[int64]int64{1: stored}, down: map[int]bool{2: true}, num: 2},
+			want:      FsckDegraded,
+			wantKinds: []string{ProblemNodeUnavailable},
+		},
+		{
+			name: "unexpected chunk",
+			chunks: append(chunks(nil), repository.Chunk{
+				ChunkIndex: 3, NumOfChunks: 3, StorageID: 1, Status: "sent_to_storage",
+			}),
+			nodes:     fakeNodes{chunks: map[int]map[int64]int64{1: stored}},
+			want:      FsckDegraded,
+			wantKinds: []string{ProblemUnexpectedChunk},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := repository.File{UUID: "f"}
+			if tt.encrypted {
+				file.KeyID = &keyID
+			}
+
+			s := &FsckService{nodes: &tt.nodes}
+			result := s.checkFile(context.Background(), file, tt.chunks)
+
+			if result.State != tt.want {
+				t.Errorf("Expected state %s, got %s (%+v)", tt.want, result.State, result.Problems)
+			}
+
+			var kinds []string
+			for _, problem := range result.Problems {
+				kinds = append(kinds, problem.Kind)
+			}
+			if fmt.Sprint(kinds) != fmt.Sprint(tt.wantKinds) {
+				t.Errorf("Expected problems %v, got %v", tt.wantKinds, kinds)
+			}
+		})
+	}
+}
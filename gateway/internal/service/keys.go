@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+
+	"gateway/internal/encryption"
+	"gateway/internal/repository"
+
+	"github.com/pkg/errors"
+)
+
+const rotateBatchSize = 100
+
+type KeyService struct {
+	repository *repository.Repository
+	keyWrapper encryption.KeyWrapper
+}
+
+func NewKeyService(repository *repository.Repository, keyWrapper encryption.KeyWrapper) *KeyService {
+	return &KeyService{
+		repository: repository,
+		keyWrapper: keyWrapper,
+	}
+}
+
+// RotateKeys re-wraps every data key that is not wrapped with the primary
+// master key yet. Only the keys in Postgres are re-wrapped: the chunk data
+// does not change, and the copies of the key stored with the chunks on the
+// nodes keep the wrapping of the upload. Recovery needs the master key of the
+// upload to restore a file, so a retired master key should be kept where
+// files may have to be recovered. It returns the number of files that were
+// re-wrapped.
+func (s *KeyService) RotateKeys(ctx context.Context) (int, error) {
+	primaryKeyID := s.keyWrapper.PrimaryKeyID()
+
+	rotated := 0
+	after := ""
+	for {
+		files, err := s.repository.GetFilesWithStaleKey(ctx, primaryKeyID, after, rotateBatchSize)
+		if err != nil {
+			return rotated, errors.Wrap(err, "get files with stale key")
+		}
+
+		if len(files) == 0 {
+			return rotated, nil
+		}
+
+		for _, file := range files {
+			after = file.UUID
+
+			dataKey, err := s.keyWrapper.UnwrapKey(ctx, file.EncryptedKey, *file.KeyID, file.UUID)
+			if err != nil {
+				return rotated, errors.Wrapf(err, "unwrap data key of file %s", file.UUID)
+			}
+
+			encryptedKey, keyID, err := s.keyWrapper.WrapKey(ctx, dataKey, file.UUID)
+			if err != nil {
+				return rotated, errors.Wrapf(err, "wrap data key of file %s", file.UUID)
+			}
+
+			err = s.repository.UpdateFileKey(ctx, file.UUID, *file.KeyID, encryptedKey, keyID)
+			if err != nil {
+				return rotated, errors.Wrapf(err, "update data key of file %s", file.UUID)
+			}
+
+			rotated++
+		}
+	}
+}
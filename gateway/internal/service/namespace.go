@@ -0,0 +1,268 @@
+package service
+
+import (
+	"context"
+	"mime/multipart"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gateway/internal/repository"
+	"karma8/common/logging"
+
+	"github.com/pkg/errors"
+)
+
+// bucketPattern follows the S3 bucket naming rules, less the checks for
+// addresses and consecutive dots.
+var bucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+const (
+	maxKeyLength = 1024
+	// keyEnd sorts after every key that may follow a prefix, as keys are
+	// compared bytewise and cannot contain it.
+	keyEnd = "\U0010FFFF"
+)
+
+// ObjectPath addresses a file as /{bucket}/{key} within a tenant. Keys
+// are flat; slashes only group them when paths are listed with a delimiter.
+type ObjectPath struct {
+	Bucket string
+	Key    string
+}
+
+// ParsePath parses "/{bucket}/{key}".
+func ParsePath(value string) (ObjectPath, error) {
+	rest, rooted := strings.CutPrefix(value, "/")
+	bucket, key, ok := strings.Cut(rest, "/")
+	if !rooted || !ok {
+		return ObjectPath{}, errors.Wrapf(ErrInvalidArgument, "path %q is not of the form /bucket/key", value)
+	}
+
+	path := ObjectPath{Bucket: bucket, Key: key}
+	if err := path.validate(); err != nil {
+		return ObjectPath{}, err
+	}
+
+	return path, nil
+}
+
+func (p ObjectPath) String() string {
+	return "/" + p.Bucket + "/" + p.Key
+}
+
+func (p ObjectPath) validate() error {
+	if err := validateBucket(p.Bucket); err != nil {
+		return err
+	}
+
+	if p.Key == "" || strings.HasPrefix(p.Key, "/") {
+		return errors.Wrapf(ErrInvalidArgument, "key %q must not be empty or start with a slash", p.Key)
+	}
+
+	return validateKey(p.Key)
+}
+
+func validateBucket(bucket string) error {
+	if !bucketPattern.MatchString(bucket) {
+		return errors.Wrapf(ErrInvalidArgument, "bucket %q must be 3-63 lowercase letters, digits, dots or dashes", bucket)
+	}
+
+	return nil
+}
+
+// validateKey checks a key or key prefix.
+func validateKey(key string) error {
+	if len(key) > maxKeyLength {
+		return errors.Wrapf(ErrInvalidArgument, "key is longer than %d bytes", maxKeyLength)
+	}
+
+	if !utf8.ValidString(key) || strings.ContainsRune(key, 0) || strings.Contains(key, keyEnd) {
+		return errors.Wrapf(ErrInvalidArgument, "key %q is not valid UTF-8 or contains a forbidden character", key)
+	}
+
+	return nil
+}
+
+// NamespaceService maps paths onto the UUIDs of the files the
+// ChunkerService stores.
+type NamespaceService struct {
+	repository     *repository.Repository
+	chunkerService *ChunkerService
+}
+
+func NewNamespaceService(repository *repository.Repository, chunkerService *ChunkerService) *NamespaceService {
+	return &NamespaceService{
+		repository:     repository,
+		chunkerService: chunkerService,
+	}
+}
+
+// Lookup returns the UUID of the file a path names in a tenant, which may
+// not be complete, as when it is being deleted.
+func (s *NamespaceService) Lookup(ctx context.Context, tenantID string, path ObjectPath) (string, error) {
+	mapping, err := s.repository.GetPath(ctx, tenantID, path.Bucket, path.Key)
+	if err != nil {
+		return "", errors.Wrap(err, "get path")
+	}
+
+	return mapping.FileUUID, nil
+}
+
+// Resolve returns the complete file a path names in a tenant.
+func (s *NamespaceService) Resolve(ctx context.Context, tenantID string, path ObjectPath) (repository.File, error) {
+	fileUUID, err := s.Lookup(ctx, tenantID, path)
+	if err != nil {
+		return repository.File{}, err
+	}
+
+	return s.chunkerService.GetFile(ctx, fileUUID)
+}
+
+// Upload stores a file and points a path of the file's tenant at it. The
+// path must still name the file with UUID expected, or not exist if
+// expected is empty, or the upload fails with ErrPreconditionFailed, so that
+// the checks the caller made against that file hold. The file the path named
+// is deleted, so it does not count against the quota of the new one.
+func (s *NamespaceService) Upload(ctx context.Context, path ObjectPath, file multipart.File, header *multipart.FileHeader, opts UploadOptions, expected string) (string, error) {
+	opts.Replaces = expected
+	fileUUID, err := s.chunkerService.InsertStream(ctx, file, header, opts)
+	if err != nil {
+		return "", err
+	}
+
+	replaced, err := s.repository.BindPath(ctx, repository.Path{
+		TenantID: opts.TenantID,
+		Bucket:   path.Bucket,
+		Key:      path.Key,
+		FileUUID: fileUUID,
+	}, expected)
+	if err != nil {
+		if deleteErr := s.chunkerService.DeleteFile(context.WithoutCancel(ctx), fileUUID); deleteErr != nil {
+			return "", errors.Wrapf(err, "bind path %s: delete unbound file: %v", path, deleteErr)
+		}
+		return "", errors.Wrapf(err, "bind path %s", path)
+	}
+
+	// The replaced file is hidden already; what cannot be removed now is
+	// left to CleanupAbortedUploads.
+	if replaced != "" {
+		if err := s.chunkerService.abortUpload(context.WithoutCancel(ctx), replaced); err != nil {
+			logging.FromContext(ctx).Warn("replaced file cleanup failed", "file_uuid", replaced, "error", err)
+		}
+	}
+
+	return fileUUID, nil
+}
+
+// Rename moves the path of the file with the given UUID within its tenant.
+// It fails with ErrNotFound if from no longer names the file and with
+// ErrAlreadyExists if to is taken.
+func (s *NamespaceService) Rename(ctx context.Context, tenantID string, fileUUID string, from ObjectPath, to ObjectPath) error {
+	err := s.repository.RenamePath(ctx,
+		repository.Path{TenantID: tenantID, Bucket: from.Bucket, Key: from.Key, FileUUID: fileUUID},
+		repository.Path{TenantID: tenantID, Bucket: to.Bucket, Key: to.Key},
+	)
+	return errors.Wrap(err, "rename path")
+}
+
+// PathListOptions selects the paths of a bucket. With a Delimiter, keys
+// that contain it after Prefix are rolled up into the common prefix up to
+// and including it, as directories.
+type PathListOptions struct {
+	TenantID  string
+	Bucket    string
+	Owner     string
+	Prefix    string
+	Delimiter string
+	// After is the key, or the NextAfter of a previous page, the page starts
+	// after.
+	After string
+	Limit int
+}
+
+// PathListing is a page of paths.
+type PathListing struct {
+	Files          []repository.PathFile
+	CommonPrefixes []string
+	// NextAfter is passed as After to get the next page. It is empty on the
+	// last page.
+	NextAfter string
+}
+
+// List returns a page of the paths of complete files in a bucket ordered by
+// key. A page holds 100 files and common prefixes unless opts asks for
+// another size, up to 1000.
+func (s *NamespaceService) List(ctx context.Context, opts PathListOptions) (PathListing, error) {
+	if err := validateBucket(opts.Bucket); err != nil {
+		return PathListing{}, err
+	}
+
+	if err := validateKey(opts.Prefix); err != nil {
+		return PathListing{}, err
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > listLimit {
+		limit = listLimit
+	}
+
+	filter := repository.PathFilter{
+		TenantID: opts.TenantID,
+		Bucket:   opts.Bucket,
+		Owner:    opts.Owner,
+		Prefix:   opts.Prefix,
+		After:    opts.After,
+	}
+
+	var listing PathListing
+	for {
+		filter.Limit = limit - len(listing.Files) - len(listing.CommonPrefixes)
+		paths, err := s.repository.ListPaths(ctx, filter)
+		if err != nil {
+			return PathListing{}, errors.Wrap(err, "list paths")
+		}
+
+		// A common prefix may span any number of keys, which are skipped by
+		// querying again after them.
+		rolledUp := false
+		for _, path := range paths {
+			if prefix, ok := commonPrefix(path.Key, opts.Prefix, opts.Delimiter); ok {
+				listing.CommonPrefixes = append(listing.CommonPrefixes, prefix)
+				filter.After = prefix + keyEnd
+				rolledUp = true
+				break
+			}
+
+			listing.Files = append(listing.Files, path)
+			filter.After = path.Key
+		}
+
+		if len(listing.Files)+len(listing.CommonPrefixes) == limit {
+			listing.NextAfter = filter.After
+			return listing, nil
+		}
+
+		if !rolledUp && len(paths) < filter.Limit {
+			return listing, nil
+		}
+	}
+}
+
+// commonPrefix returns the part of key up to and including the first
+// delimiter after prefix, if there is one.
+func commonPrefix(key string, prefix string, delimiter string) (string, bool) {
+	if delimiter == "" {
+		return "", false
+	}
+
+	i := strings.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return "", false
+	}
+
+	return key[:len(prefix)+i+len(delimiter)], true
+}
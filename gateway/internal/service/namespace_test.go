@@ -0,0 +1,89 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    ObjectPath
+		wantErr bool
+	}{
+		{"/photos/2024/beach.jpg", ObjectPath{Bucket: "photos", Key: "2024/beach.jpg"}, false},
+		{"/my.bucket-1/a", ObjectPath{Bucket: "my.bucket-1", Key: "a"}, false},
+		{"/photos/dir/", ObjectPath{Bucket: "photos", Key: "dir/"}, false},
+		{"/photos/ünïcode key", ObjectPath{Bucket: "photos", Key: "ünïcode key"}, false},
+		{"photos/a", ObjectPath{}, true},
+		{"/photos", ObjectPath{}, true},
+		{"/photos/", ObjectPath{}, true},
+		{"/photos//a", ObjectPath{}, true},
+		{"//a", ObjectPath{}, true},
+		{"/Photos/a", ObjectPath{}, true},
+		{"/ab/a", ObjectPath{}, true},
+		{"/-photos/a", ObjectPath{}, true},
+		{"/photos/a\x00b", ObjectPath{}, true},
+		{"/photos/\xff", ObjectPath{}, true},
+		{"/photos/a\U0010FFFF", ObjectPath{}, true},
+		{"/photos/" + strings.Repeat("a", maxKeyLength+1), ObjectPath{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePath(tt.value)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("ParsePath(%q): expected ErrInvalidArgument, got %v", tt.value, err)
+			}
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePath(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+
+		if got.String() != tt.value {
+			t.Errorf("ParsePath(%q).String() = %q", tt.value, got.String())
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		key       string
+		prefix    string
+		delimiter string
+		want      string
+		wantOK    bool
+	}{
+		{"a/b/c", "", "", "", false},
+		{"a/b/c", "", "/", "a/", true},
+		{"a/b/c", "a/", "/", "a/b/", true},
+		{"a/b/c", "a/b/", "/", "", false},
+		{"a/", "", "/", "a/", true},
+		{"a/b/c", "a", "/", "a/", true},
+		{"2024--01--x", "2024", "--", "2024--", true},
+	}
+
+	for _, tt := range tests {
+		got, ok := commonPrefix(tt.key, tt.prefix, tt.delimiter)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("commonPrefix(%q, %q, %q) = %q, %v, want %q, %v", tt.key, tt.prefix, tt.delimiter, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestKeyEndSortsLast(t *testing.T) {
+	prefix := "dir/"
+	for _, key := range []string{"dir/", "dir/a", "dir/\U0010FFFE", "dir/z/ÿ"} {
+		if key >= prefix+keyEnd {
+			t.Errorf("key %q does not sort before the end of prefix %q", key, prefix)
+		}
+	}
+
+	if "dir0" <= prefix+keyEnd {
+		t.Errorf("key %q sorts before the end of prefix %q", "dir0", prefix)
+	}
+}
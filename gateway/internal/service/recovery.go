@@ -0,0 +1,385 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"gateway/internal/encryption"
+	"gateway/internal/repository"
+	"gateway/internal/storage"
+
+	"github.com/pkg/errors"
+)
+
+const recoveryPageSize = 1000
+
+// RecoveryState is the verdict on a file found on the storage nodes.
+type RecoveryState string
+
+const (
+	// RecoveryRecoverable files have every chunk with complete metadata on
+	// some node and can be recorded again.
+	RecoveryRecoverable RecoveryState = "recoverable"
+	// RecoveryIncomplete files miss chunks, or metadata needed to read them,
+	// as do encrypted files uploaded before chunks carried their data key and
+	// files whose data key none of the configured master keys unwraps.
+	RecoveryIncomplete RecoveryState = "incomplete"
+	// RecoveryConflicting files have chunks that disagree with each other.
+	RecoveryConflicting RecoveryState = "conflicting"
+)
+
+type RecoveredFile struct {
+	UUID        string        `json:"file_uuid"`
+	State       RecoveryState `json:"state"`
+	NumOfChunks int64         `json:"num_of_chunks"`
+	Size        int64         `json:"size"`
+	Problems    []string      `json:"problems"`
+	// Restored is set once the file has been recorded.
+	Restored bool `json:"restored,omitempty"`
+}
+
+// RecoveryReport is the result of a recovery. Files that exist already are
+// only counted, the others are listed ordered by UUID.
+type RecoveryReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Apply      bool      `json:"apply"`
+	// Chunks counts the chunks found on all nodes.
+	Chunks      int             `json:"chunks"`
+	Recoverable int             `json:"recoverable"`
+	Incomplete  int             `json:"incomplete"`
+	Conflicting int             `json:"conflicting"`
+	Existing    int             `json:"existing"`
+	Restored    int             `json:"restored"`
+	Files       []RecoveredFile `json:"files"`
+}
+
+type RecoveryOptions struct {
+	// Apply records the recoverable files. Without it nothing is changed.
+	Apply bool
+	// TenantID is the tenant restored files are charged to. Their names are
+	// not stored on the nodes and are left empty.
+	TenantID string
+}
+
+// chunkLister lists the chunks held by the storage nodes.
+type chunkLister interface {
+	ListChunks(ctx context.Context, storageID int, after string, limit int) ([]storage.ChunkInfo, string, error)
+	GetNumStorage() int
+	GetStorageID(fileUUID string, chunkIndex int64) int
+}
+
+type RecoveryService struct {
+	repository *repository.Repository
+	nodes      chunkLister
+	keyWrapper encryption.KeyWrapper
+}
+
+// NewRecoveryService returns a service that restores files with the master
+// keys of keyWrapper, which is nil if no keys are configured.
+func NewRecoveryService(repository *repository.Repository, storageManager *storage.StorageManager, keyWrapper encryption.KeyWrapper) *RecoveryService {
+	return &RecoveryService{
+		repository: repository,
+		nodes:      storageManager,
+		keyWrapper: keyWrapper,
+	}
+}
+
+// storedChunk is a chunk found on the node with StorageID.
+type storedChunk struct {
+	storage.ChunkInfo
+	StorageID int
+}
+
+// Recover rebuilds the records of the files whose chunks are on the storage
+// nodes but which are missing from Postgres, as after the database was lost.
+func (s *RecoveryService) Recover(ctx context.Context, options RecoveryOptions) (RecoveryReport, error) {
+	report := RecoveryReport{
+		StartedAt: time.Now(),
+		Apply:     options.Apply,
+		Files:     []RecoveredFile{},
+	}
+
+	if options.Apply {
+		if _, err := s.repository.GetTenant(ctx, options.TenantID); err != nil {
+			return RecoveryReport{}, errors.Wrapf(err, "get tenant %s", options.TenantID)
+		}
+	}
+
+	err := s.scan(ctx, func(fileUUID string, found []storedChunk) error {
+		report.Chunks += len(found)
+
+		result, file, chunks := planRecovery(fileUUID, found, s.nodes.GetStorageID)
+		result = checkDataKey(ctx, s.keyWrapper, result, file)
+		file.TenantID = options.TenantID
+
+		_, err := s.repository.GetFile(ctx, fileUUID)
+		switch {
+		case err == nil:
+			report.Existing++
+			return nil
+		case !errors.Is(err, repository.ErrNotFound):
+			return errors.Wrapf(err, "get file %s", fileUUID)
+		}
+
+		if options.Apply && result.State == RecoveryRecoverable {
+			result.Restored, err = s.repository.RestoreFile(ctx, file, chunks)
+			if err != nil {
+				return errors.Wrapf(err, "restore file %s", fileUUID)
+			}
+
+			// Recorded by someone else in the meantime.
+			if !result.Restored {
+				report.Existing++
+				return nil
+			}
+			report.Restored++
+		}
+
+		switch result.State {
+		case RecoveryRecoverable:
+			report.Recoverable++
+		case RecoveryIncomplete:
+			report.Incomplete++
+		case RecoveryConflicting:
+			report.Conflicting++
+		}
+		report.Files = append(report.Files, result)
+
+		return nil
+	})
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+
+	report.FinishedAt = time.Now()
+
+	return report, nil
+}
+
+// checkDataKey marks a recoverable encrypted file incomplete if its data key,
+// as stored with its chunks, cannot be unwrapped. Rotation re-wraps only the
+// key in Postgres, so once the master key of the upload is retired the file
+// could not be read if it were restored.
+func checkDataKey(ctx context.Context, keyWrapper encryption.KeyWrapper, result RecoveredFile, file repository.File) RecoveredFile {
+	if result.State != RecoveryRecoverable || file.KeyID == nil {
+		return result
+	}
+
+	var err error
+	if keyWrapper == nil {
+		err = errors.New("no master key is configured")
+	} else {
+		_, err = keyWrapper.UnwrapKey(ctx, file.EncryptedKey, *file.KeyID, file.UUID)
+	}
+	if err != nil {
+		result.State = RecoveryIncomplete
+		result.Problems = append(result.Problems, fmt.Sprintf("data key wrapped with master key %s cannot be unwrapped: %v", *file.KeyID, err))
+	}
+
+	return result
+}
+
+// nodeCursor pages through the chunks of one node.
+type nodeCursor struct {
+	nodes     chunkLister
+	storageID int
+	page      []storage.ChunkInfo
+	after     string
+	done      bool
+}
+
+// peek returns the next chunk of the node without consuming it, or nil once
+// the node has no more.
+func (c *nodeCursor) peek(ctx context.Context) (*storage.ChunkInfo, error) {
+	for len(c.page) == 0 {
+		if c.done {
+			return nil, nil
+		}
+
+		chunks, next, err := c.nodes.ListChunks(ctx, c.storageID, c.after, recoveryPageSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list chunks of storage %d", c.storageID)
+		}
+
+		c.page, c.after, c.done = chunks, next, next == ""
+	}
+
+	return &c.page[0], nil
+}
+
+// scan lists the chunks of all nodes and calls visit with those of one file
+// at a time, ordered by file UUID. Nodes list chunks by object name, which
+// starts with the file UUID, so merging their listings only holds a page per
+// node and the chunks of the current file.
+func (s *RecoveryService) scan(ctx context.Context, visit func(fileUUID string, found []storedChunk) error) error {
+	cursors := make([]*nodeCursor, 0, s.nodes.GetNumStorage())
+	for storageID := 1; storageID <= s.nodes.GetNumStorage(); storageID++ {
+		cursors = append(cursors, &nodeCursor{nodes: s.nodes, storageID: storageID})
+	}
+
+	for {
+		fileUUID := ""
+		for _, cursor := range cursors {
+			chunk, err := cursor.peek(ctx)
+			if err != nil {
+				return err
+			}
+			if chunk != nil && (fileUUID == "" || chunk.FileUUID < fileUUID) {
+				fileUUID = chunk.FileUUID
+			}
+		}
+
+		if fileUUID == "" {
+			return nil
+		}
+
+		var found []storedChunk
+		for _, cursor := range cursors {
+			for {
+				chunk, err := cursor.peek(ctx)
+				if err != nil {
+					return err
+				}
+				if chunk == nil || chunk.FileUUID != fileUUID {
+					break
+				}
+
+				found = append(found, storedChunk{ChunkInfo: *chunk, StorageID: cursor.storageID})
+				cursor.page = cursor.page[1:]
+			}
+		}
+
+		if err := visit(fileUUID, found); err != nil {
+			return err
+		}
+	}
+}
+
+// planRecovery decides whether a file can be rebuilt from the chunks found
+// of it and returns its records if so. Copies of a chunk on several nodes,
+// as left by an upload that failed over, are fine as long as they match;
+// the one on the node the chunk hashes to is preferred.
+func planRecovery(fileUUID string, found []storedChunk, primaryNode func(string, int64) int) (RecoveredFile, repository.File, []repository.Chunk) {
+	result := RecoveredFile{
+		UUID:     fileUUID,
+		State:    RecoveryRecoverable,
+		Problems: []string{},
+	}
+	problem := func(state RecoveryState, format string, args ...any) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+		// Conflicts outweigh missing data.
+		if result.State != RecoveryConflicting {
+			result.State = state
+		}
+	}
+
+	var counts []int64
+	copies := make(map[int64][]storedChunk)
+	for _, chunk := range found {
+		if chunk.NumOfChunks > 0 && !slices.Contains(counts, chunk.NumOfChunks) {
+			counts = append(counts, chunk.NumOfChunks)
+		}
+		copies[chunk.ChunkIndex] = append(copies[chunk.ChunkIndex], chunk)
+	}
+
+	switch len(counts) {
+	case 0:
+		problem(RecoveryIncomplete, "no chunk records the chunk count")
+		return result, repository.File{}, nil
+	case 1:
+		result.NumOfChunks = counts[0]
+	default:
+		slices.Sort(counts)
+		problem(RecoveryConflicting, "chunks disagree on the chunk count: %v", counts)
+		return result, repository.File{}, nil
+	}
+
+	// Every chunk carries the owner and wrapped data key of the file. The key
+	// is wrapped as it was at upload, so a restored file needs that master
+	// key even if the key was rotated since; see checkDataKey.
+	first := found[0]
+	for _, chunk := range found[1:] {
+		if chunk.Owner != first.Owner || chunk.KeyID != first.KeyID || !bytes.Equal(chunk.EncryptedKey, first.EncryptedKey) {
+			problem(RecoveryConflicting, "chunks disagree on the owner or data key of the file")
+			return result, repository.File{}, nil
+		}
+	}
+
+	file := repository.File{UUID: fileUUID, Owner: first.Owner}
+	encrypted := first.KeyID != ""
+	if encrypted {
+		keyID := first.KeyID
+		file.EncryptedKey = first.EncryptedKey
+		file.KeyID = &keyID
+	}
+
+	var chunks []repository.Chunk
+	for _, index := range slices.Sorted(maps.Keys(copies)) {
+		if index < 0 || index >= result.NumOfChunks {
+			problem(RecoveryConflicting, "chunk %d is beyond the chunk count %d", index, result.NumOfChunks)
+		}
+	}
+
+	for index := range result.NumOfChunks {
+		candidates := copies[index]
+		if len(candidates) == 0 {
+			problem(RecoveryIncomplete, "chunk %d is on no node", index)
+			continue
+		}
+
+		primary := primaryNode(fileUUID, index)
+		chosen := candidates[0]
+		conflict := false
+		for _, candidate := range candidates[1:] {
+			if candidate.Checksum != chosen.Checksum || candidate.Size != chosen.Size {
+				conflict = true
+			}
+			if chosen.StorageID != primary && (candidate.StorageID == primary || candidate.StorageID < chosen.StorageID) {
+				chosen = candidate
+			}
+		}
+		if conflict {
+			problem(RecoveryConflicting, "chunk %d has differing copies on %d nodes", index, len(candidates))
+			continue
+		}
+
+		// Encrypted chunks do not carry the hash of their plaintext, so
+		// restored encrypted files have no ETag.
+		if (chosen.ChunkHash == "" && !encrypted) || chosen.Codec == "" || chosen.LogicalSize == nil || chosen.CompressedSize == nil {
+			problem(RecoveryIncomplete, "chunk %d on storage %d lacks its hash or data key, codec or sizes", index, chosen.StorageID)
+			continue
+		}
+
+		result.Size += *chosen.LogicalSize
+		if file.CreatedAt.IsZero() || (!chosen.UploadedAt.IsZero() && chosen.UploadedAt.Before(file.CreatedAt)) {
+			file.CreatedAt = chosen.UploadedAt
+		}
+
+		chunks = append(chunks, repository.Chunk{
+			UUID:           fileUUID,
+			ChunkIndex:     index,
+			ChunkHash:      chosen.ChunkHash,
+			NumOfChunks:    result.NumOfChunks,
+			StorageID:      chosen.StorageID,
+			Codec:          chosen.Codec,
+			LogicalSize:    chosen.LogicalSize,
+			CompressedSize: chosen.CompressedSize,
+		})
+	}
+
+	if result.State != RecoveryRecoverable {
+		return result, repository.File{}, nil
+	}
+
+	file.Size = result.Size
+	if file.CreatedAt.IsZero() {
+		file.CreatedAt = time.Now()
+	}
+
+	return result, file, chunks
+}
@@ -0,0 +1,313 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gateway/internal/encryption"
+	"gateway/internal/repository"
+	"gateway/internal/storage"
+)
+
+func TestPlanRecovery(t *testing.T) {
+	size := func(n int64) *int64 { return &n }
+	uploadedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// chunk returns chunk index of a three chunk file of 10 bytes per chunk,
+	// found on the node with storageID.
+	chunk := func(storageID int, index int64, edit func(*storedChunk)) storedChunk {
+		c := storedChunk{
+			ChunkInfo: storage.ChunkInfo{
+				FileUUID:       "f1",
+				ChunkIndex:     index,
+				Size:           8,
+				NumOfChunks:    3,
+				Checksum:       "sum",
+				ChunkHash:      "hash",
+				Codec:          "zstd",
+				LogicalSize:    size(10),
+				CompressedSize: size(8),
+				Owner:          "alice",
+				UploadedAt:     uploadedAt.Add(time.Duration(index) * time.Second),
+			},
+			StorageID: storageID,
+		}
+		if edit != nil {
+			edit(&c)
+		}
+		return c
+	}
+	encrypted := func(c *storedChunk) {
+		c.ChunkHash = ""
+		c.EncryptedKey = []byte("wrapped")
+		c.KeyID = "k1"
+	}
+	// Every chunk hashes to storage 2.
+	primaryNode := func(string, int64) int { return 2 }
+
+	tests := []struct {
+		name      string
+		found     []storedChunk
+		state     RecoveryState
+		problems  int
+		storageID int
+		encrypted bool
+	}{
+		{
+			name:      "complete",
+			found:     []storedChunk{chunk(1, 0, nil), chunk(1, 1, nil), chunk(1, 2, nil)},
+			state:     RecoveryRecoverable,
+			storageID: 1,
+		},
+		{
+			name:      "matching copies prefer the primary node",
+			found:     []storedChunk{chunk(3, 0, nil), chunk(2, 0, nil), chunk(1, 0, nil), chunk(1, 1, nil), chunk(1, 2, nil)},
+			state:     RecoveryRecoverable,
+			storageID: 2,
+		},
+		{
+			name:      "matching copies off the primary node prefer the lowest node",
+			found:     []storedChunk{chunk(3, 0, nil), chunk(1, 0, nil), chunk(1, 1, nil), chunk(1, 2, nil)},
+			state:     RecoveryRecoverable,
+			storageID: 1,
+		},
+		{
+			name:     "missing chunk",
+			found:    []storedChunk{chunk(1, 0, nil), chunk(1, 2, nil)},
+			state:    RecoveryIncomplete,
+			problems: 1,
+		},
+		{
+			name:      "encrypted",
+			found:     []storedChunk{chunk(1, 0, encrypted), chunk(1, 1, encrypted), chunk(1, 2, encrypted)},
+			state:     RecoveryRecoverable,
+			storageID: 1,
+			encrypted: true,
+		},
+		{
+			name: "chunks without hash or data key",
+			found: []storedChunk{chunk(1, 0, func(c *storedChunk) {
+				c.ChunkHash = ""
+			}), chunk(1, 1, func(c *storedChunk) {
+				c.ChunkHash = ""
+			}), chunk(1, 2, func(c *storedChunk) {
+				c.ChunkHash = ""
+			})},
+			state:    RecoveryIncomplete,
+			problems: 3,
+		},
+		{
+			name: "differing data keys",
+			found: []storedChunk{chunk(1, 0, encrypted), chunk(1, 1, encrypted), chunk(1, 2, func(c *storedChunk) {
+				encrypted(c)
+				c.EncryptedKey = []byte("other")
+			})},
+			state:    RecoveryConflicting,
+			problems: 1,
+		},
+		{
+			name: "differing owners",
+			found: []storedChunk{chunk(1, 0, nil), chunk(1, 1, nil), chunk(1, 2, func(c *storedChunk) {
+				c.Owner = "mallory"
+			})},
+			state:    RecoveryConflicting,
+			problems: 1,
+		},
+		{
+			name: "no chunk count",
+			found: []storedChunk{chunk(1, 0, func(c *storedChunk) {
+				c.NumOfChunks = 0
+			})},
+			state:    RecoveryIncomplete,
+			problems: 1,
+		},
+		{
+			name: "differing copies",
+			found: []storedChunk{chunk(1, 0, nil), chunk(2, 0, func(c *storedChunk) {
+				c.Checksum = "other"
+			}), chunk(1, 1, nil), chunk(1, 2, nil)},
+			state:    RecoveryConflicting,
+			problems: 1,
+		},
+		{
+			name: "differing chunk counts",
+			found: []storedChunk{chunk(1, 0, nil), chunk(1, 1, func(c *storedChunk) {
+				c.NumOfChunks = 6
+			}), chunk(1, 2, nil)},
+			state:    RecoveryConflicting,
+			problems: 1,
+		},
+		{
+			name: "conflict outweighs missing chunk",
+			found: []storedChunk{chunk(1, 0, nil), chunk(1, 3, nil), chunk(1, 2, func(c *storedChunk) {
+				c.Codec = ""
+			})},
+			state:    RecoveryConflicting,
+			problems: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, file, chunks := planRecovery("f1", tt.found, primaryNode)
+
+			if result.State != tt.state {
+				t.Errorf("state = %s, want %s (problems %v)", result.State, tt.state, result.Problems)
+			}
+			if len(result.Problems) != tt.problems {
+				t.Errorf("got %d problems %v, want %d", len(result.Problems), result.Problems, tt.problems)
+			}
+
+			if tt.state != RecoveryRecoverable {
+				if chunks != nil {
+					t.Errorf("got %d chunk records for a file that is not recoverable", len(chunks))
+				}
+				return
+			}
+
+			if file.UUID != "f1" || file.Size != 30 || !file.CreatedAt.Equal(uploadedAt) || file.Owner != "alice" {
+				t.Errorf("file = %+v, want f1 of 30 bytes of alice created at %v", file, uploadedAt)
+			}
+			if tt.encrypted != (file.KeyID != nil) {
+				t.Errorf("file key ID = %v, want encrypted %v", file.KeyID, tt.encrypted)
+			}
+			if tt.encrypted && (*file.KeyID != "k1" || string(file.EncryptedKey) != "wrapped") {
+				t.Errorf("file key = %q of %s, want the wrapped key of k1", file.EncryptedKey, *file.KeyID)
+			}
+			if len(chunks) != 3 {
+				t.Fatalf("got %d chunk records, want 3", len(chunks))
+			}
+			if chunks[0].StorageID != tt.storageID {
+				t.Errorf("chunk 0 on storage %d, want %d", chunks[0].StorageID, tt.storageID)
+			}
+			wantHash := "hash"
+			if tt.encrypted {
+				wantHash = ""
+			}
+			for i, c := range chunks {
+				if c.ChunkIndex != int64(i) || c.NumOfChunks != 3 || c.ChunkHash != wantHash || c.Codec != "zstd" {
+					t.Errorf("chunk record %d = %+v", i, c)
+				}
+			}
+		})
+	}
+}
+
+// pagedLister serves the chunks of each node two at a time.
+type pagedLister struct {
+	nodes [][]storage.ChunkInfo
+	calls int
+}
+
+func (l *pagedLister) ListChunks(ctx context.Context, storageID int, after string, limit int) ([]storage.ChunkInfo, string, error) {
+	l.calls++
+
+	start, _ := strconv.Atoi(after)
+	chunks := l.nodes[storageID-1]
+	end := min(start+2, len(chunks))
+
+	next := ""
+	if end < len(chunks) {
+		next = strconv.Itoa(end)
+	}
+
+	return chunks[start:end], next, nil
+}
+
+func (l *pagedLister) GetNumStorage() int { return len(l.nodes) }
+
+func (l *pagedLister) GetStorageID(string, int64) int { return 1 }
+
+func TestScan(t *testing.T) {
+	chunks := func(fileUUIDs ...string) []storage.ChunkInfo {
+		var infos []storage.ChunkInfo
+		for _, fileUUID := range fileUUIDs {
+			infos = append(infos, storage.ChunkInfo{FileUUID: fileUUID})
+		}
+		return infos
+	}
+
+	lister := &pagedLister{nodes: [][]storage.ChunkInfo{
+		chunks("a", "a", "b", "d", "d", "d"),
+		chunks(),
+		chunks("a", "c", "c", "d"),
+	}}
+	service := &RecoveryService{nodes: lister}
+
+	var visited []string
+	err := service.scan(context.Background(), func(fileUUID string, found []storedChunk) error {
+		nodes := make([]string, 0, len(found))
+		for _, chunk := range found {
+			if chunk.FileUUID != fileUUID {
+				t.Errorf("file %s: got a chunk of %s", fileUUID, chunk.FileUUID)
+			}
+			nodes = append(nodes, strconv.Itoa(chunk.StorageID))
+		}
+		visited = append(visited, fileUUID+":"+strings.Join(nodes, ""))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+
+	want := []string{"a:113", "b:1", "c:33", "d:1113"}
+	if !slices.Equal(visited, want) {
+		t.Errorf("visited %v, want %v", visited, want)
+	}
+	if lister.calls != 6 {
+		t.Errorf("listed %d pages, want 6", lister.calls)
+	}
+}
+
+func TestCheckDataKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "v2 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write keyfile: %v", err)
+	}
+
+	keyring, err := encryption.LoadKeyfile(path)
+	if err != nil {
+		t.Fatalf("load keyfile: %v", err)
+	}
+
+	dataKey, _ := encryption.NewDataKey()
+	wrapped, keyID, err := keyring.WrapKey(context.Background(), dataKey, "f1")
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+	retired := "v1"
+
+	tests := []struct {
+		name       string
+		keyWrapper encryption.KeyWrapper
+		state      RecoveryState
+		file       repository.File
+		want       RecoveryState
+	}{
+		{"plaintext", nil, RecoveryRecoverable, repository.File{UUID: "f1"}, RecoveryRecoverable},
+		{"configured key", keyring, RecoveryRecoverable, repository.File{UUID: "f1", EncryptedKey: wrapped, KeyID: &keyID}, RecoveryRecoverable},
+		{"retired key", keyring, RecoveryRecoverable, repository.File{UUID: "f1", EncryptedKey: wrapped, KeyID: &retired}, RecoveryIncomplete},
+		{"key of another file", keyring, RecoveryRecoverable, repository.File{UUID: "f2", EncryptedKey: wrapped, KeyID: &keyID}, RecoveryIncomplete},
+		{"no keys configured", nil, RecoveryRecoverable, repository.File{UUID: "f1", EncryptedKey: wrapped, KeyID: &keyID}, RecoveryIncomplete},
+		{"conflicting", keyring, RecoveryConflicting, repository.File{UUID: "f1", EncryptedKey: wrapped, KeyID: &retired}, RecoveryConflicting},
+	}
+
+	for _, tt := range tests {
+		result := checkDataKey(context.Background(), tt.keyWrapper, RecoveredFile{UUID: tt.file.UUID, State: tt.state, Problems: []string{}}, tt.file)
+		if result.State != tt.want {
+			t.Errorf("%s: expected state %s, got %s", tt.name, tt.want, result.State)
+		}
+		if (result.State != tt.state) != (len(result.Problems) == 1) {
+			t.Errorf("%s: expected a problem only when the state changed, got %v", tt.name, result.Problems)
+		}
+	}
+}
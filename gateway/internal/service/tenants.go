@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"regexp"
+
+	"gateway/internal/repository"
+
+	"github.com/pkg/errors"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+type TenantService struct {
+	repository *repository.Repository
+}
+
+func NewTenantService(repository *repository.Repository) *TenantService {
+	return &TenantService{
+		repository: repository,
+	}
+}
+
+func (s *TenantService) ListTenants(ctx context.Context) ([]repository.Tenant, error) {
+	tenants, err := s.repository.GetTenants(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get tenants")
+	}
+
+	return tenants, nil
+}
+
+func (s *TenantService) GetTenant(ctx context.Context, id string) (repository.Tenant, error) {
+	tenant, err := s.repository.GetTenant(ctx, id)
+	if err != nil {
+		return repository.Tenant{}, errors.Wrap(err, "get tenant")
+	}
+
+	return tenant, nil
+}
+
+func (s *TenantService) CreateTenant(ctx context.Context, tenant repository.Tenant) error {
+	if !tenantIDPattern.MatchString(tenant.ID) {
+		return errors.Wrap(ErrInvalidArgument, "tenant id must be 1-63 lowercase letters, digits or dashes")
+	}
+
+	if err := validateQuotas(tenant); err != nil {
+		return err
+	}
+
+	return errors.Wrap(s.repository.InsertTenant(ctx, tenant), "insert tenant")
+}
+
+func (s *TenantService) UpdateTenant(ctx context.Context, tenant repository.Tenant) error {
+	if err := validateQuotas(tenant); err != nil {
+		return err
+	}
+
+	return errors.Wrap(s.repository.UpdateTenant(ctx, tenant), "update tenant")
+}
+
+func validateQuotas(tenant repository.Tenant) error {
+	if tenant.QuotaBytes != nil && *tenant.QuotaBytes < 0 {
+		return errors.Wrap(ErrInvalidArgument, "quota_bytes must not be negative")
+	}
+
+	if tenant.QuotaObjects != nil && *tenant.QuotaObjects < 0 {
+		return errors.Wrap(ErrInvalidArgument, "quota_objects must not be negative")
+	}
+
+	return nil
+}
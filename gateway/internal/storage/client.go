@@ -2,90 +2,532 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"gateway/internal/metrics"
+	"karma8/common/logging"
+	"karma8/common/security"
+	"karma8/common/tracing"
+
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Client struct {
 	httpClient *http.Client
+	addr       string
 	baseURL    string
+	config     Config
+	healthy    atomic.Bool
+}
+
+// Errors reported by the storage nodes, which StatusError matches, and
+// ErrUnavailable for nodes that cannot be reached or fail.
+var (
+	ErrChunkNotFound    = errors.New("chunk not found on storage node")
+	ErrChecksumMismatch = errors.New("chunk checksum mismatch")
+	ErrMetadataMismatch = errors.New("chunk metadata mismatch")
+	ErrUnavailable      = errors.New("storage node unavailable")
+)
+
+// Codes of the storage nodes' error responses that are not implied by the
+// status.
+const (
+	codeChecksumMismatch = "checksum_mismatch"
+	codeMetadataMismatch = "metadata_mismatch"
+)
+
+// StatusError is returned when a storage node answers with an error status.
+// It matches the error the node reported with errors.Is.
+type StatusError struct {
+	StatusCode int
+	// Code and Message are taken from the node's error body.
+	Code    string
+	Message string
+}
+
+// newStatusError reads the error a node answered with. Nodes that predate
+// JSON errors send plain text, which becomes the message.
+func newStatusError(resp *http.Response) *StatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+
+	statusErr := &StatusError{StatusCode: resp.StatusCode}
+
+	var apiErr struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Code != "" {
+		statusErr.Code = apiErr.Code
+		statusErr.Message = apiErr.Message
+	} else {
+		statusErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return statusErr
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("storage responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound:
+		return ErrChunkNotFound
+	case e.Code == codeChecksumMismatch:
+		return ErrChecksumMismatch
+	case e.Code == codeMetadataMismatch:
+		return ErrMetadataMismatch
+	case e.StatusCode >= http.StatusInternalServerError:
+		return ErrUnavailable
+	}
+
+	return nil
 }
 
-func NewClient(storageAddr string) (*Client, error) {
-	baseURL := fmt.Sprintf("http://%s", storageAddr)
+// unavailableError is a failure to reach a node. It matches both
+// ErrUnavailable and the cause.
+type unavailableError struct {
+	err error
+}
+
+func unavailable(err error) error {
+	return &unavailableError{err: err}
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() []error {
+	return []error{ErrUnavailable, e.err}
+}
+
+func NewClient(storageAddr string, config Config) (*Client, error) {
+	scheme := "http"
+	if config.TLS != nil {
+		scheme = "https"
+	}
+	baseURL := fmt.Sprintf("%s://%s", scheme, storageAddr)
 
 	if len(baseURL) > 6 && baseURL[len(baseURL)-5:] == ":9090" {
 		baseURL = baseURL[:len(baseURL)-5] + ":8081"
 	}
 
+	// There is deliberately no overall client timeout: it would also cover
+	// the body, so large chunks could never finish. Transfers are bounded per
+	// operation instead, see transfer.
+	var tlsConfig *tls.Config
+	if config.TLS != nil {
+		tlsConfig = config.TLS.Clone()
+	}
+
+	// otelhttp propagates the trace context to the node and adds a span per
+	// HTTP request below the transfer's span.
 	httpClient := &http.Client{
-		Timeout: 30 * time.Second,
+		Transport: otelhttp.NewTransport(&http.Transport{
+			TLSClientConfig: tlsConfig,
+			Proxy:           http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   config.ConnectTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+		}),
 	}
 
-	return &Client{
+	client := &Client{
 		httpClient: httpClient,
+		addr:       storageAddr,
 		baseURL:    baseURL,
-	}, nil
+		config:     config,
+	}
+	client.healthy.Store(true)
+
+	return client, nil
 }
 
 func (c *Client) Close() error {
 	return nil
 }
 
-func (c *Client) UploadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, reader io.Reader, contentLength int64) error {
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// IsHealthy reports whether the last operation against the node succeeded.
+func (c *Client) IsHealthy() bool {
+	return c.healthy.Load()
+}
+
+func (c *Client) setHealthy(healthy bool) {
+	c.healthy.Store(healthy)
+}
+
+// newRequest creates a request to the node. The body, if any, must be set
+// before the request is created; the request is signed when it is sent by
+// do.
+func (c *Client) newRequest(ctx context.Context, method string, url string, body io.Reader, contentLength int64) (*http.Request, error) {
+	// An empty body would otherwise be sent chunked, with a length the node
+	// sees differently than the signature covers.
+	if body != nil && contentLength == 0 {
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "new request with context")
+	}
+
+	if body != nil && body != http.NoBody {
+		req.ContentLength = contentLength
+	}
+
+	if requestID := logging.RequestID(ctx); requestID != "" {
+		req.Header.Set(logging.RequestIDHeader, requestID)
+	}
+
+	return req, nil
+}
+
+// do sends a request to the node, signed if a signing secret is configured.
+// The signature covers the metadata headers, so they must be set before.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.config.SigningSecret != nil {
+		if err := security.SignRequest(req, c.config.SigningSecret); err != nil {
+			return nil, errors.Wrap(err, "sign request")
+		}
+	}
+
+	return c.httpClient.Do(req)
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", c.baseURL+"/health", nil, 0)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		c.setHealthy(false)
+		return errors.Wrap(unavailable(err), "do")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		c.setHealthy(false)
+		return newStatusError(resp)
+	}
+
+	c.setHealthy(true)
+	return nil
+}
+
+// Headers carrying the metadata of a chunk to and from the nodes.
+const (
+	ChecksumHeader       = "X-Checksum-SHA256"
+	ChunkCountHeader     = "X-Chunk-Count"
+	ChunkHashHeader      = "X-Chunk-Hash"
+	CodecHeader          = "X-Chunk-Codec"
+	LogicalSizeHeader    = "X-Chunk-Logical-Size"
+	CompressedSizeHeader = "X-Chunk-Compressed-Size"
+	EncryptedKeyHeader   = "X-Chunk-Encrypted-Key"
+	KeyIDHeader          = "X-Chunk-Key-ID"
+	OwnerHeader          = "X-Chunk-Owner"
+)
+
+// ChunkMetadata is stored by the node with a chunk, so that the node's
+// contents describe themselves.
+type ChunkMetadata struct {
+	NumOfChunks int64
+	// Checksum is the hex SHA-256 of the chunk as sent, which the node
+	// verifies, and ChunkHash the hex MD5 of the original data. ChunkHash
+	// is left empty for encrypted chunks.
+	Checksum       string
+	ChunkHash      string
+	Codec          string
+	LogicalSize    int64
+	CompressedSize int64
+	// EncryptedKey and KeyID are the wrapped data key of an encrypted file
+	// and Owner the subject that uploaded it, so that the file can be
+	// recovered from its chunks.
+	EncryptedKey []byte
+	KeyID        string
+	Owner        string
+}
+
+func (m ChunkMetadata) setHeaders(header http.Header) {
+	header.Set(ChunkCountHeader, strconv.FormatInt(m.NumOfChunks, 10))
+	header.Set(ChecksumHeader, m.Checksum)
+	if m.ChunkHash != "" {
+		header.Set(ChunkHashHeader, m.ChunkHash)
+	}
+	header.Set(CodecHeader, m.Codec)
+	header.Set(LogicalSizeHeader, strconv.FormatInt(m.LogicalSize, 10))
+	header.Set(CompressedSizeHeader, strconv.FormatInt(m.CompressedSize, 10))
+	if m.EncryptedKey != nil {
+		header.Set(EncryptedKeyHeader, base64.StdEncoding.EncodeToString(m.EncryptedKey))
+		header.Set(KeyIDHeader, m.KeyID)
+	}
+	// Nodes store the owner as sent, which must be printable ASCII.
+	if m.Owner != "" {
+		header.Set(OwnerHeader, url.QueryEscape(m.Owner))
+	}
+}
+
+// UploadChunkStream sends a chunk with its metadata to the node, which
+// rejects the chunk unless it matches the checksum.
+func (c *Client) UploadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, reader io.Reader, contentLength int64, metadata ChunkMetadata) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "storage.upload", trace.WithAttributes(
+		attribute.String("storage.node", c.addr),
+		attribute.String("file.uuid", fileUUID),
+		attribute.Int64("chunk.index", chunkIndex),
+	))
+	defer func(start time.Time) {
+		metrics.ObserveStorageRequest(c.addr, "upload", start, err)
+		tracing.End(span, err)
+	}(time.Now())
+
 	url := fmt.Sprintf("%s/api/chunks/upload?file_uuid=%s&chunk_index=%d", c.baseURL, fileUUID, chunkIndex)
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	transfer := newTransfer(ctx, c.config)
+	defer transfer.stop()
+	transfer.setSize(contentLength)
+
+	req, err := c.newRequest(transfer.ctx, "POST", url, io.NopCloser(transfer.reader(reader)), contentLength)
 	if err != nil {
-		return errors.Wrap(err, "new request with context")
+		return err
 	}
 
 	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", contentLength))
-
-	req.Body = io.NopCloser(reader)
-	req.ContentLength = contentLength
+	metadata.setHeaders(req.Header)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return errors.Wrap(err, "do request")
+		return errors.Wrap(unavailable(transfer.err(err)), "do request")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return errors.Wrapf(errors.New(string(body)), "upload failed with status %d", resp.StatusCode)
+		return errors.Wrap(newStatusError(resp), "upload failed")
 	}
 
 	return nil
 }
 
-func (c *Client) DownloadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, writer io.Writer) error {
+// DownloadChunkStream streams a chunk from offset to writer. A chunk read
+// from its start is checked against its checksum; a chunk read from an
+// offset cannot be.
+func (c *Client) DownloadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, offset int64, writer io.Writer) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "storage.download", trace.WithAttributes(
+		attribute.String("storage.node", c.addr),
+		attribute.String("file.uuid", fileUUID),
+		attribute.Int64("chunk.index", chunkIndex),
+		attribute.Int64("chunk.offset", offset),
+	))
+	defer func(start time.Time) {
+		metrics.ObserveStorageRequest(c.addr, "download", start, err)
+		tracing.End(span, err)
+	}(time.Now())
+
 	url := fmt.Sprintf("%s/api/chunks/download?file_uuid=%s&chunk_index=%d", c.baseURL, fileUUID, chunkIndex)
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	transfer := newTransfer(ctx, c.config)
+	defer transfer.stop()
+
+	req, err := c.newRequest(transfer.ctx, "GET", url, nil, 0)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return errors.Wrap(unavailable(transfer.err(err)), "do")
+	}
+	defer resp.Body.Close()
+
+	wantStatus := http.StatusOK
+	if offset > 0 {
+		wantStatus = http.StatusPartialContent
+	}
+	if resp.StatusCode != wantStatus {
+		return errors.Wrap(newStatusError(resp), "download failed")
+	}
+
+	transfer.setSize(resp.ContentLength)
+
+	// A node that fails mid-stream aborts the connection, which surfaces as
+	// an unexpected EOF. The checksum catches data the node sent in full but
+	// found corrupt only at the end.
+	hash := sha256.New()
+	_, err = io.Copy(transfer.writer(io.MultiWriter(writer, hash)), transfer.reader(resp.Body))
+	if err != nil {
+		return errors.Wrap(transfer.err(err), "copy response to writer")
+	}
+
+	expected := strings.ToLower(resp.Header.Get(ChecksumHeader))
+	if actual := hex.EncodeToString(hash.Sum(nil)); offset == 0 && expected != "" && actual != expected {
+		return errors.Wrapf(ErrChecksumMismatch, "got %s, expected %s", actual, expected)
+	}
+
+	return nil
+}
+
+// StatChunk returns the size of a chunk as stored on the node, or
+// ErrChunkNotFound if the node does not hold it.
+func (c *Client) StatChunk(ctx context.Context, fileUUID string, chunkIndex int64) (size int64, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "storage.stat", trace.WithAttributes(
+		attribute.String("storage.node", c.addr),
+		attribute.String("file.uuid", fileUUID),
+		attribute.Int64("chunk.index", chunkIndex),
+	))
+	defer func(start time.Time) {
+		metrics.ObserveStorageRequest(c.addr, "stat", start, err)
+		tracing.End(span, err)
+	}(time.Now())
+
+	url := fmt.Sprintf("%s/api/chunks/%s/%d", c.baseURL, fileUUID, chunkIndex)
+
+	req, err := c.newRequest(ctx, "HEAD", url, nil, 0)
 	if err != nil {
-		return errors.Wrap(err, "new request with context")
+		return 0, err
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return errors.Wrap(err, "do")
+		return 0, errors.Wrap(unavailable(err), "do")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, errors.Wrapf(ErrChunkNotFound, "chunk %s/%d on %s", fileUUID, chunkIndex, c.addr)
+	default:
+		return 0, errors.Wrap(newStatusError(resp), "stat failed")
+	}
+}
+
+// ChunkInfo is a chunk held by a node, described by the metadata it was
+// uploaded with. Metadata the chunk was stored without is zero.
+type ChunkInfo struct {
+	FileUUID       string    `json:"file_uuid"`
+	ChunkIndex     int64     `json:"chunk_index"`
+	Size           int64     `json:"size"`
+	NumOfChunks    int64     `json:"num_of_chunks"`
+	Checksum       string    `json:"checksum_sha256"`
+	ChunkHash      string    `json:"chunk_hash"`
+	Codec          string    `json:"codec"`
+	LogicalSize    *int64    `json:"logical_size"`
+	CompressedSize *int64    `json:"compressed_size"`
+	EncryptedKey   []byte    `json:"encrypted_key"`
+	KeyID          string    `json:"key_id"`
+	Owner          string    `json:"owner"`
+	UploadedAt     time.Time `json:"uploaded_at"`
+}
+
+// ListChunks returns up to limit chunks the node holds, with their metadata,
+// starting after the given position. It also returns the position of the next
+// page, or "" if this was the last one.
+func (c *Client) ListChunks(ctx context.Context, after string, limit int) (chunks []ChunkInfo, next string, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "storage.list", trace.WithAttributes(
+		attribute.String("storage.node", c.addr),
+	))
+	defer func(start time.Time) {
+		metrics.ObserveStorageRequest(c.addr, "list", start, err)
+		tracing.End(span, err)
+	}(time.Now())
+
+	query := url.Values{}
+	query.Set("metadata", "true")
+	query.Set("after", after)
+	query.Set("limit", strconv.Itoa(limit))
+
+	req, err := c.newRequest(ctx, "GET", c.baseURL+"/api/chunks?"+query.Encode(), nil, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, "", errors.Wrap(unavailable(err), "do")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return errors.Wrapf(errors.New(string(body)), "download failed with status %d", resp.StatusCode)
+		return nil, "", errors.Wrap(newStatusError(resp), "list failed")
+	}
+
+	var page struct {
+		Chunks []ChunkInfo `json:"chunks"`
+		Next   string      `json:"next"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, "", errors.Wrap(err, "decode response")
+	}
+
+	for i := range page.Chunks {
+		owner, err := url.QueryUnescape(page.Chunks[i].Owner)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "chunk %s/%d owner", page.Chunks[i].FileUUID, page.Chunks[i].ChunkIndex)
+		}
+		page.Chunks[i].Owner = owner
+	}
+
+	return page.Chunks, page.Next, nil
+}
+
+// DeleteChunk removes a chunk from the node. Deleting a missing chunk
+// succeeds.
+func (c *Client) DeleteChunk(ctx context.Context, fileUUID string, chunkIndex int64) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "storage.delete", trace.WithAttributes(
+		attribute.String("storage.node", c.addr),
+		attribute.String("file.uuid", fileUUID),
+		attribute.Int64("chunk.index", chunkIndex),
+	))
+	defer func(start time.Time) {
+		metrics.ObserveStorageRequest(c.addr, "delete", start, err)
+		tracing.End(span, err)
+	}(time.Now())
+
+	url := fmt.Sprintf("%s/api/chunks/delete?file_uuid=%s&chunk_index=%d", c.baseURL, fileUUID, chunkIndex)
+
+	req, err := c.newRequest(ctx, "DELETE", url, nil, 0)
+	if err != nil {
+		return err
 	}
 
-	_, err = io.Copy(writer, resp.Body)
+	resp, err := c.do(req)
 	if err != nil {
-		return errors.Wrap(err, "copy response to writer")
+		return errors.Wrap(unavailable(err), "do")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.Wrap(newStatusError(resp), "delete failed")
 	}
 
 	return nil
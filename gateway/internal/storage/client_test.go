@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"karma8/common/security"
+
+	"github.com/pkg/errors"
+)
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		want        error
+		wantMessage string
+	}{
+		{"not found", http.StatusNotFound, `{"code":"not_found","message":"Chunk not found"}`, ErrChunkNotFound, "Chunk not found"},
+		{"checksum mismatch", http.StatusBadRequest, `{"code":"checksum_mismatch","message":"bad chunk"}`, ErrChecksumMismatch, "bad chunk"},
+		{"metadata mismatch", http.StatusConflict, `{"code":"metadata_mismatch","message":"other chunk"}`, ErrMetadataMismatch, "other chunk"},
+		{"node failure", http.StatusInternalServerError, `{"code":"internal","message":"disk full"}`, ErrUnavailable, "disk full"},
+		{"plain text", http.StatusServiceUnavailable, "overloaded\n", ErrUnavailable, "overloaded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+
+			client, err := NewClient(strings.TrimPrefix(server.URL, "http://"), DefaultConfig())
+			if err != nil {
+				t.Fatalf("new client: %v", err)
+			}
+
+			err = client.DeleteChunk(context.Background(), "uuid", 0)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != tt.status || statusErr.Message != tt.wantMessage {
+				t.Errorf("Expected status %d with message %q, got %v", tt.status, tt.wantMessage, err)
+			}
+		})
+	}
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	client, err := NewClient(strings.TrimPrefix(server.URL, "http://"), DefaultConfig())
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	if err := client.DeleteChunk(context.Background(), "uuid", 0); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable for a node that is down, got %v", err)
+	}
+}
+
+func TestClient_SignsMetadata(t *testing.T) {
+	secret := []byte(strings.Repeat("s", 32))
+
+	var gotCodec string
+	server := httptest.NewServer(security.RequireSignature(secret, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCodec = r.Header.Get(CodecHeader)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer server.Close()
+
+	config := DefaultConfig()
+	config.SigningSecret = secret
+
+	client, err := NewClient(strings.TrimPrefix(server.URL, "http://"), config)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	body := strings.NewReader("chunk")
+	err = client.UploadChunkStream(context.Background(), "uuid", 0, body, body.Size(), ChunkMetadata{
+		NumOfChunks: 1,
+		Checksum:    "checksum",
+		Codec:       "zstd",
+		LogicalSize: 5,
+	})
+	if err != nil {
+		t.Fatalf("Expected the signed upload to be accepted, got %v", err)
+	}
+	if gotCodec != "zstd" {
+		t.Errorf("Expected codec zstd, got %q", gotCodec)
+	}
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTransferTimeout = errors.New("transfer deadline exceeded")
+	ErrTransferStalled = errors.New("transfer stalled")
+)
+
+// transfer bounds a single chunk transfer. Instead of one fixed timeout for
+// the whole request it enforces a deadline derived from the chunk size and
+// the minimum acceptable throughput, and aborts the transfer when the body
+// makes no progress for IdleTimeout. Both only count the time spent on the
+// node, not the time a download waits for its destination.
+type transfer struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	config Config
+
+	deadline *time.Timer
+	// deadlineAt is when the deadline fires. While the transfer is paused the
+	// deadline is stopped and left holds the time that remained.
+	deadlineAt time.Time
+	left       time.Duration
+	paused     bool
+
+	idle *time.Timer
+}
+
+func newTransfer(ctx context.Context, config Config) *transfer {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	return &transfer{
+		ctx:    ctx,
+		cancel: cancel,
+		config: config,
+	}
+}
+
+// setSize starts the deadline for moving size bytes. A negative size means
+// the size is unknown and only the idle timeout applies.
+func (t *transfer) setSize(size int64) {
+	if size < 0 || t.deadline != nil {
+		return
+	}
+
+	timeout := t.config.transferTimeout(size)
+	if timeout <= 0 {
+		return
+	}
+
+	t.deadlineAt = time.Now().Add(timeout)
+	t.deadline = time.AfterFunc(timeout, func() {
+		t.cancel(ErrTransferTimeout)
+	})
+}
+
+// writer wraps the destination of a download so that both timeouts are
+// paused while a write blocks, as it does for a slow or throttled client.
+func (t *transfer) writer(w io.Writer) io.Writer {
+	return &pausingWriter{writer: w, transfer: t}
+}
+
+func (t *transfer) pause() {
+	if t.deadline != nil && t.deadline.Stop() {
+		t.left = time.Until(t.deadlineAt)
+		t.paused = true
+	}
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+}
+
+func (t *transfer) resume() {
+	if t.paused {
+		t.deadlineAt = time.Now().Add(t.left)
+		t.deadline.Reset(t.left)
+		t.paused = false
+	}
+	if t.idle != nil {
+		t.idle.Reset(t.config.IdleTimeout)
+	}
+}
+
+// reader wraps a body so that every read that moves bytes pushes the idle
+// timeout back. The idle timeout ends with the body; waiting for the response
+// to a fully sent upload is bounded by the deadline alone.
+func (t *transfer) reader(r io.Reader) io.Reader {
+	if t.config.IdleTimeout <= 0 {
+		return r
+	}
+
+	t.idle = time.AfterFunc(t.config.IdleTimeout, func() {
+		t.cancel(ErrTransferStalled)
+	})
+
+	return &progressReader{
+		reader:  r,
+		timer:   t.idle,
+		timeout: t.config.IdleTimeout,
+	}
+}
+
+// err replaces the generic context error with the reason the transfer was
+// aborted, if it was aborted by one of its own timeouts.
+func (t *transfer) err(err error) error {
+	cause := context.Cause(t.ctx)
+	if errors.Is(cause, ErrTransferTimeout) || errors.Is(cause, ErrTransferStalled) {
+		return errors.Wrap(cause, err.Error())
+	}
+
+	return err
+}
+
+func (t *transfer) stop() {
+	if t.deadline != nil {
+		t.deadline.Stop()
+	}
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+	t.cancel(nil)
+}
+
+type progressReader struct {
+	reader  io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		r.timer.Stop()
+	} else if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+
+	return n, err
+}
+
+type pausingWriter struct {
+	writer   io.Writer
+	transfer *transfer
+}
+
+func (w *pausingWriter) Write(p []byte) (int, error) {
+	w.transfer.pause()
+	defer w.transfer.resume()
+
+	return w.writer.Write(p)
+}
+
+// transferTimeout is BaseTimeout plus the time it takes to move size bytes
+// at MinThroughput.
+func (c Config) transferTimeout(size int64) time.Duration {
+	if c.MinThroughput <= 0 {
+		return 0
+	}
+
+	seconds := float64(size) / float64(c.MinThroughput)
+	return c.BaseTimeout + time.Duration(seconds*float64(time.Second))
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestTransferTimeout(t *testing.T) {
+	config := Config{BaseTimeout: 10 * time.Second, MinThroughput: 1 << 20}
+
+	tests := []struct {
+		size int64
+		want time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1 << 20, 11 * time.Second},
+		{100 << 20, 110 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := config.transferTimeout(tt.size); got != tt.want {
+			t.Errorf("transferTimeout(%d) = %s, expected %s", tt.size, got, tt.want)
+		}
+	}
+
+	if got := (Config{BaseTimeout: time.Second}).transferTimeout(1 << 30); got != 0 {
+		t.Errorf("Expected no deadline without a minimum throughput, got %s", got)
+	}
+}
+
+func TestDownloadChunkStream_Stalled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := DefaultConfig()
+	config.IdleTimeout = 50 * time.Millisecond
+
+	client, err := NewClient(strings.TrimPrefix(server.URL, "http://"), config)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	err = client.DownloadChunkStream(context.Background(), "uuid", 0, 0, io.Discard)
+	if !errors.Is(err, ErrTransferStalled) {
+		t.Errorf("Expected ErrTransferStalled, got %v", err)
+	}
+}
+
+func TestUploadChunkStream_SlowResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(150 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := DefaultConfig()
+	config.IdleTimeout = 50 * time.Millisecond
+
+	client, err := NewClient(strings.TrimPrefix(server.URL, "http://"), config)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	body := strings.NewReader("chunk")
+	err = client.UploadChunkStream(context.Background(), "uuid", 0, body, body.Size(), ChunkMetadata{})
+	if err != nil {
+		t.Errorf("Expected the upload to wait for the response after the body was sent, got %v", err)
+	}
+}
+
+// slowWriter takes delay for every write, as a slow client does.
+type slowWriter struct {
+	delay time.Duration
+	n     int
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestDownloadChunkStream_SlowWriter(t *testing.T) {
+	data := strings.Repeat("x", 256<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	config := DefaultConfig()
+	config.BaseTimeout = 100 * time.Millisecond
+	config.MinThroughput = 1 << 30
+	config.IdleTimeout = 100 * time.Millisecond
+
+	client, err := NewClient(strings.TrimPrefix(server.URL, "http://"), config)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	writer := &slowWriter{delay: 30 * time.Millisecond}
+	err = client.DownloadChunkStream(context.Background(), "uuid", 0, 0, writer)
+	if err != nil {
+		t.Errorf("Expected a slow writer not to count against the node, got %v", err)
+	}
+	if writer.n != len(data) {
+		t.Errorf("Expected %d bytes, got %d", len(data), writer.n)
+	}
+}
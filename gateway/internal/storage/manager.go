@@ -2,36 +2,130 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"math/rand"
+	"net/http"
 	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
+// Config controls how the manager talks to the storage nodes.
+type Config struct {
+	// RetryAttempts is how many times an upload is tried on one node before
+	// the node is considered unavailable.
+	RetryAttempts int
+	// RetryBackoff is the delay before the first retry; it doubles on every
+	// following attempt up to RetryMaxBackoff.
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+
+	// ConnectTimeout bounds establishing a connection to a node and
+	// ResponseHeaderTimeout bounds waiting for its response headers once the
+	// request has been sent.
+	ConnectTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	// A chunk transfer may take BaseTimeout plus the time needed to move the
+	// chunk at MinThroughput bytes per second, and fails early if the body
+	// makes no progress for IdleTimeout. Time a download spends waiting for
+	// its destination, such as a slow client, does not count.
+	BaseTimeout   time.Duration
+	MinThroughput int64
+	IdleTimeout   time.Duration
+
+	// TLS enables mutual TLS with the nodes when set, see
+	// security.LoadClientTLSConfig.
+	TLS *tls.Config
+	// SigningSecret is shared with the nodes to sign every request when set.
+	SigningSecret []byte
+}
+
+func DefaultConfig() Config {
+	return Config{
+		RetryAttempts:         3,
+		RetryBackoff:          200 * time.Millisecond,
+		RetryMaxBackoff:       5 * time.Second,
+		ConnectTimeout:        5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		BaseTimeout:           30 * time.Second,
+		MinThroughput:         1 << 20,
+		IdleTimeout:           30 * time.Second,
+	}
+}
+
 type StorageManager struct {
-	clients    []*Client
-	numStorage int
-	mu         sync.RWMutex
+	config Config
+
+	// clients is replaced as a whole by SetAddresses. Its position in the
+	// list is the storage ID of a node, minus one.
+	mu      sync.RWMutex
+	clients []*Client
 }
 
-func NewStorageManager(storageAddrs []string) (*StorageManager, error) {
+func NewStorageManager(storageAddrs []string, config Config) (*StorageManager, error) {
 	if len(storageAddrs) == 0 {
 		return nil, fmt.Errorf("at least one storage address is required")
 	}
 
+	if config.RetryAttempts <= 0 {
+		config.RetryAttempts = 1
+	}
+
+	sm := &StorageManager{config: config}
+	if err := sm.SetAddresses(storageAddrs); err != nil {
+		return nil, err
+	}
+
+	return sm, nil
+}
+
+// SetAddresses replaces the list of storage nodes. Chunks record the position
+// of their node in the list, so nodes can be appended or moved to another
+// address but never removed. Clients of unchanged nodes are kept.
+func (sm *StorageManager) SetAddresses(storageAddrs []string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if len(storageAddrs) < len(sm.clients) {
+		return fmt.Errorf("cannot remove storage nodes: have %d, got %d addresses", len(sm.clients), len(storageAddrs))
+	}
+
 	clients := make([]*Client, len(storageAddrs))
+	var replaced []*Client
 	for i, addr := range storageAddrs {
-		client, err := NewClient(addr)
+		if i < len(sm.clients) && sm.clients[i].addr == addr {
+			clients[i] = sm.clients[i]
+			continue
+		}
+
+		client, err := NewClient(addr, sm.config)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create client for %s: %w", addr, err)
+			return fmt.Errorf("failed to create client for %s: %w", addr, err)
 		}
 		clients[i] = client
+
+		if i < len(sm.clients) {
+			replaced = append(replaced, sm.clients[i])
+		}
+	}
+
+	sm.clients = clients
+
+	for _, client := range replaced {
+		client.Close()
 	}
 
-	return &StorageManager{
-		clients:    clients,
-		numStorage: len(clients),
-	}, nil
+	return nil
+}
+
+func (sm *StorageManager) nodes() []*Client {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.clients
 }
 
 func (sm *StorageManager) Close() error {
@@ -48,30 +142,144 @@ func (sm *StorageManager) Close() error {
 }
 
 func (sm *StorageManager) GetStorageIDForChunk(fileUUID string, chunkIndex int64) int {
-	hash := hashString(fmt.Sprintf("%s_%d", fileUUID, chunkIndex))
-	return int(hash % uint32(sm.numStorage))
+	return chunkNode(fileUUID, chunkIndex, len(sm.nodes()))
 }
 
 func (sm *StorageManager) GetClientForChunk(fileUUID string, chunkIndex int64) *Client {
-	storageID := sm.GetStorageIDForChunk(fileUUID, chunkIndex)
-	return sm.clients[storageID]
+	clients := sm.nodes()
+	return clients[chunkNode(fileUUID, chunkIndex, len(clients))]
+}
+
+func chunkNode(fileUUID string, chunkIndex int64, numStorage int) int {
+	hash := hashString(fmt.Sprintf("%s_%d", fileUUID, chunkIndex))
+	return int(hash % uint32(numStorage))
+}
+
+// GetClient returns the client for a 1-based storage ID as recorded in the
+// chunks table.
+func (sm *StorageManager) GetClient(storageID int) (*Client, error) {
+	clients := sm.nodes()
+	if storageID < 1 || storageID > len(clients) {
+		return nil, fmt.Errorf("unknown storage id %d", storageID)
+	}
+
+	return clients[storageID-1], nil
 }
 
 func (sm *StorageManager) GetRandomClient() *Client {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	clients := sm.nodes()
+	return clients[rand.Intn(len(clients))]
+}
+
+// UploadChunkStream uploads a chunk to the node it hashes to. Transient
+// failures are retried with exponential backoff; when the node stays
+// unavailable the chunk is placed on the next healthy node instead. The body
+// is rewound before every attempt. The metadata is stored with the chunk. It
+// returns the 1-based ID of the node that accepted the chunk.
+func (sm *StorageManager) UploadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, body io.ReadSeeker, contentLength int64, metadata ChunkMetadata) (int, error) {
+	clients := sm.nodes()
+	primary := chunkNode(fileUUID, chunkIndex, len(clients))
 
-	return sm.clients[rand.Intn(sm.numStorage)]
+	var lastErr error
+	for offset := range len(clients) {
+		idx := (primary + offset) % len(clients)
+		client := clients[idx]
+
+		if !client.IsHealthy() {
+			if err := client.Ping(ctx); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+
+		err := sm.uploadWithRetry(ctx, client, fileUUID, chunkIndex, body, contentLength, metadata)
+		if err == nil {
+			client.setHealthy(true)
+			return idx + 1, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil || !isRetryable(err) {
+			return 0, err
+		}
+
+		client.setHealthy(false)
+	}
+
+	return 0, errors.Wrap(lastErr, "all storage nodes failed")
+}
+
+func (sm *StorageManager) uploadWithRetry(ctx context.Context, client *Client, fileUUID string, chunkIndex int64, body io.ReadSeeker, contentLength int64, metadata ChunkMetadata) error {
+	backoff := sm.config.RetryBackoff
+
+	var err error
+	for attempt := range sm.config.RetryAttempts {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(jitter(backoff)):
+			}
+
+			backoff *= 2
+			if sm.config.RetryMaxBackoff > 0 && backoff > sm.config.RetryMaxBackoff {
+				backoff = sm.config.RetryMaxBackoff
+			}
+		}
+
+		if _, seekErr := body.Seek(0, io.SeekStart); seekErr != nil {
+			return errors.Wrap(seekErr, "rewind chunk")
+		}
+
+		err = client.UploadChunkStream(ctx, fileUUID, chunkIndex, body, contentLength, metadata)
+		if err == nil || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// DownloadChunkStream streams a chunk from offset from the node it was
+// recorded on.
+func (sm *StorageManager) DownloadChunkStream(ctx context.Context, storageID int, fileUUID string, chunkIndex int64, offset int64, writer io.Writer) error {
+	client, err := sm.GetClient(storageID)
+	if err != nil {
+		return err
+	}
+
+	return client.DownloadChunkStream(ctx, fileUUID, chunkIndex, offset, writer)
 }
 
-func (sm *StorageManager) UploadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, reader io.Reader, contentLength int64) error {
-	client := sm.GetClientForChunk(fileUUID, chunkIndex)
-	return client.UploadChunkStream(ctx, fileUUID, chunkIndex, reader, contentLength)
+// StatChunk returns the size of a chunk on the node with the given storage ID.
+func (sm *StorageManager) StatChunk(ctx context.Context, storageID int, fileUUID string, chunkIndex int64) (int64, error) {
+	client, err := sm.GetClient(storageID)
+	if err != nil {
+		return 0, err
+	}
+
+	return client.StatChunk(ctx, fileUUID, chunkIndex)
 }
 
-func (sm *StorageManager) DownloadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, writer io.Writer) error {
-	client := sm.GetClientForChunk(fileUUID, chunkIndex)
-	return client.DownloadChunkStream(ctx, fileUUID, chunkIndex, writer)
+// ListChunks returns a page of the chunks held by the node with the given
+// storage ID, see Client.ListChunks.
+func (sm *StorageManager) ListChunks(ctx context.Context, storageID int, after string, limit int) ([]ChunkInfo, string, error) {
+	client, err := sm.GetClient(storageID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return client.ListChunks(ctx, after, limit)
+}
+
+// DeleteChunk removes a chunk from the node it was recorded on.
+func (sm *StorageManager) DeleteChunk(ctx context.Context, storageID int, fileUUID string, chunkIndex int64) error {
+	client, err := sm.GetClient(storageID)
+	if err != nil {
+		return err
+	}
+
+	return client.DeleteChunk(ctx, fileUUID, chunkIndex)
 }
 
 func (sm *StorageManager) GetStorageID(fileUUID string, chunkIndex int64) int {
@@ -79,21 +287,37 @@ func (sm *StorageManager) GetStorageID(fileUUID string, chunkIndex int64) int {
 }
 
 func (sm *StorageManager) GetNumStorage() int {
-	return sm.numStorage
+	return len(sm.nodes())
 }
 
 func (sm *StorageManager) HealthCheck() map[int]bool {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
 	health := make(map[int]bool)
-	for i := range sm.clients {
-		health[i+1] = true // 1-based indexing
+	for i, client := range sm.nodes() {
+		health[i+1] = client.IsHealthy() // 1-based indexing
 	}
 
 	return health
 }
 
+// isRetryable reports whether an upload error may succeed on another try.
+// Requests the node rejected as invalid are not retried.
+func isRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func hashString(s string) uint32 {
 	var hash uint32 = 5381
 	for _, c := range s {
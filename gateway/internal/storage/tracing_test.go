@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestClient_PropagatesTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	received := make(chan trace.SpanContext, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		received <- trace.SpanContextFromContext(ctx)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(strings.TrimPrefix(server.URL, "http://"), DefaultConfig())
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	if _, err := client.StatChunk(ctx, "uuid", 0); err != nil {
+		t.Fatalf("stat chunk: %v", err)
+	}
+	parent.End()
+
+	remote := <-received
+	if remote.TraceID() != parent.SpanContext().TraceID() {
+		t.Errorf("Expected the node to continue trace %s, got %s", parent.SpanContext().TraceID(), remote.TraceID())
+	}
+
+	spans := make(map[trace.SpanID]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.SpanContext().SpanID()] = span
+	}
+
+	// The node's parent is the HTTP client span, below the stat span, below
+	// the request's span.
+	var names []string
+	for id := remote.SpanID(); id.IsValid(); {
+		span, ok := spans[id]
+		if !ok {
+			t.Fatalf("Expected span %s to be recorded", id)
+		}
+		names = append(names, span.Name())
+		id = span.Parent().SpanID()
+	}
+
+	if len(names) != 3 || names[1] != "storage.stat" || names[2] != "request" {
+		t.Errorf("Expected the node's parent span below storage.stat and request, got %v", names)
+	}
+}
@@ -18,8 +18,8 @@ type TestService struct {
 func newTestService(db *sqlx.DB) *TestService {
 	repository := repository.NewRepository(db)
 
-	chunkerService := service.NewChunkerService(repository, nil)
-	gatewayHandler := handlers.NewGatewayHandler(chunkerService)
+	chunkerService := service.NewChunkerService(repository, nil, service.ChunkerConfig{})
+	gatewayHandler := handlers.NewGatewayHandler(chunkerService, service.NewNamespaceService(repository, chunkerService))
 
 	return &TestService{
 		gatewayHandler: gatewayHandler,
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// runBatch runs fn for every item with at most parallel of them at a time.
+// A failure does not stop the other items; the error returned lists them all
+// once every item is done, so that it is not mixed with progress bars.
+func runBatch[T any](ctx context.Context, items []T, parallel int, fn func(ctx context.Context, item T) error) error {
+	parallel = max(parallel, 1)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures []string
+	)
+
+	sem := make(chan struct{}, parallel)
+	for _, item := range items {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := fn(ctx, item); err != nil {
+				mu.Lock()
+				failures = append(failures, fmt.Sprintf("%v: %v", item, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failures) == 1 && len(items) == 1 {
+		return errors.New(failures[0])
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("%d of %d failed:\n  %s", len(failures), len(items), strings.Join(failures, "\n  "))
+	}
+
+	return nil
+}
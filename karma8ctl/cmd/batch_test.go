@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRunBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		items    []string
+		failing  map[string]bool
+		wantErr  []string
+		parallel int
+	}{
+		{"all succeed", []string{"a", "b", "c"}, nil, nil, 2},
+		{"single failure", []string{"a"}, map[string]bool{"a": true}, []string{"a: failed"}, 1},
+		{"some fail", []string{"a", "b", "c"}, map[string]bool{"a": true, "c": true}, []string{"2 of 3 failed", "a: failed", "c: failed"}, 2},
+		{"no parallelism asked for", []string{"a", "b"}, nil, nil, 0},
+	}
+
+	for _, tt := range tests {
+		var (
+			mu   sync.Mutex
+			done []string
+		)
+		err := runBatch(context.Background(), tt.items, tt.parallel, func(ctx context.Context, item string) error {
+			mu.Lock()
+			done = append(done, item)
+			mu.Unlock()
+
+			if tt.failing[item] {
+				return errors.New("failed")
+			}
+			return nil
+		})
+
+		if len(done) != len(tt.items) {
+			t.Errorf("%s: ran %v, want every item of %v", tt.name, done, tt.items)
+		}
+		if tt.wantErr == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.wantErr != nil && err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		for _, want := range tt.wantErr {
+			if err != nil && !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q does not mention %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestRunBatch_BoundsParallelism(t *testing.T) {
+	var running, peak atomic.Int32
+
+	items := make([]int, 20)
+	err := runBatch(context.Background(), items, 3, func(ctx context.Context, item int) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			current := peak.Load()
+			if n <= current || peak.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("run batch: %v", err)
+	}
+	if peak.Load() > 3 {
+		t.Errorf("%d items ran at a time, want at most 3", peak.Load())
+	}
+}
+
+func TestRunBatch_StopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var started atomic.Int32
+	err := runBatch(ctx, []string{"a", "b", "c"}, 1, func(ctx context.Context, item string) error {
+		started.Add(1)
+		cancel()
+		// Hold the only slot so that the batch sees the cancellation while
+		// it waits for one.
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if started.Load() != 1 {
+		t.Errorf("%d items started after the batch was cancelled, want 1", started.Load())
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"karma8/client"
+	"karma8ctl/internal/progress"
+
+	"github.com/pkg/errors"
+)
+
+func newFlagSet(name string, arguments string, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: karma8ctl %s [flags] %s\n\n%s\n\nFlags:\n", name, arguments, description)
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+func runUpload(ctx context.Context, c *client.Client, args []string) error {
+	flags := newFlagSet("upload", "PATH...", "Uploads files and prints the UUID each was stored under. A PATH of - reads stdin.")
+	name := flags.String("name", "", "name to store a single file under (default: its base name, or stdin)")
+	parallel := flags.Int("parallel", 4, "number of files uploaded at a time")
+	quiet := flags.Bool("quiet", false, "do not show progress")
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if len(paths) > 1 && *name != "" {
+		return errors.New("-name can only be used with a single file")
+	}
+	if len(paths) > 1 && slices.Contains(paths, "-") {
+		return errors.New("stdin can only be uploaded on its own")
+	}
+
+	pool := progress.NewPool(os.Stderr, !*quiet)
+
+	var mu sync.Mutex
+	uuids := make(map[string]string, len(paths))
+	err := runBatch(ctx, paths, *parallel, func(ctx context.Context, path string) error {
+		fileUUID, err := uploadFile(ctx, c, pool, path, *name)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		uuids[path] = fileUUID
+		mu.Unlock()
+		return nil
+	})
+	pool.Close()
+
+	for _, path := range paths {
+		if fileUUID, ok := uuids[path]; ok {
+			fmt.Printf("%s\t%s\n", fileUUID, path)
+		}
+	}
+
+	return err
+}
+
+func uploadFile(ctx context.Context, c *client.Client, pool *progress.Pool, path string, name string) (string, error) {
+	var (
+		body io.Reader
+		size int64 = -1
+	)
+
+	if path == "-" {
+		body = os.Stdin
+		if name == "" {
+			name = "stdin"
+		}
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return "", err
+		}
+		if info.IsDir() {
+			return "", errors.New("is a directory")
+		}
+
+		body, size = file, info.Size()
+		if name == "" {
+			name = filepath.Base(path)
+		}
+	}
+
+	bar := pool.New(name, size)
+	fileUUID, err := c.Upload(ctx, body, client.UploadOptions{Name: name, Size: size, Progress: bar.Set})
+	bar.Done(err != nil)
+
+	return fileUUID, err
+}
+
+func runDownload(ctx context.Context, c *client.Client, args []string) error {
+	flags := newFlagSet("download", "UUID...", "Downloads files under their stored names. Partial downloads left by an\ninterrupted run are resumed.")
+	output := flags.String("o", "", "path to write a single file to, or - for stdout")
+	dir := flags.String("dir", ".", "directory to download files to")
+	parallel := flags.Int("parallel", 4, "number of files downloaded at a time")
+	resume := flags.Bool("resume", true, "resume partial downloads instead of starting over")
+	quiet := flags.Bool("quiet", false, "do not show progress")
+	flags.Parse(args)
+
+	fileUUIDs := flags.Args()
+	if len(fileUUIDs) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if len(fileUUIDs) > 1 && *output != "" {
+		return errors.New("-o can only be used with a single file")
+	}
+
+	pool := progress.NewPool(os.Stderr, !*quiet && *output != "-")
+
+	var mu sync.Mutex
+	targets := make(map[string]string, len(fileUUIDs))
+	err := runBatch(ctx, fileUUIDs, *parallel, func(ctx context.Context, fileUUID string) error {
+		file, err := c.Stat(ctx, fileUUID)
+		if err != nil {
+			return err
+		}
+
+		target := *output
+		if target == "" {
+			target = filepath.Join(*dir, localName(file))
+		}
+
+		mu.Lock()
+		other, taken := targets[target]
+		targets[target] = fileUUID
+		mu.Unlock()
+		if taken {
+			return errors.Errorf("%s is also the target of %s, use -o", target, other)
+		}
+
+		return downloadFile(ctx, c, pool, file, target, *resume)
+	})
+	pool.Close()
+
+	return err
+}
+
+// localName is the name a file is downloaded under: the base of its stored
+// name, or its UUID if it has none.
+func localName(file client.File) string {
+	name := filepath.Base(file.Name)
+	if name == "." || name == "/" || name == ".." || file.Name == "" {
+		return file.FileUUID
+	}
+
+	return name
+}
+
+func downloadFile(ctx context.Context, c *client.Client, pool *progress.Pool, file client.File, target string, resume bool) error {
+	bar := pool.New(file.Name, file.Size)
+
+	if target == "-" {
+		_, err := c.Download(ctx, file.FileUUID, bar.Writer(os.Stdout))
+		bar.Done(err != nil)
+		return err
+	}
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		bar.Done(true)
+		return err
+	}
+	defer out.Close()
+
+	info, err := out.Stat()
+	if err != nil {
+		bar.Done(true)
+		return err
+	}
+
+	// A local file longer than the stored one is not a partial download of
+	// it, so it is replaced.
+	var offset int64
+	if resume && info.Size() <= file.Size {
+		offset = info.Size()
+	}
+
+	if offset == file.Size && file.Size > 0 {
+		bar.Resume(offset)
+		bar.Done(false)
+		return nil
+	}
+
+	if err := out.Truncate(offset); err != nil {
+		bar.Done(true)
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		bar.Done(true)
+		return err
+	}
+
+	bar.Resume(offset)
+	written, err := c.DownloadRange(ctx, file.FileUUID, offset, -1, bar.Writer(out))
+	if err == nil && offset+written != file.Size {
+		err = errors.Errorf("downloaded %d of %d bytes, run again to resume", offset+written, file.Size)
+	}
+	bar.Done(err != nil)
+
+	return err
+}
+
+func runStat(ctx context.Context, c *client.Client, args []string) error {
+	flags := newFlagSet("stat", "UUID...", "Shows the metadata of files.")
+	asJSON := flags.Bool("json", false, "print JSON")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	files := make([]client.File, 0, flags.NArg())
+	for _, fileUUID := range flags.Args() {
+		file, err := c.Stat(ctx, fileUUID)
+		if err != nil {
+			return errors.Wrap(err, fileUUID)
+		}
+		files = append(files, file)
+	}
+
+	if *asJSON {
+		return printJSON(files)
+	}
+
+	for i, file := range files {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("UUID:      %s\n", file.FileUUID)
+		fmt.Printf("Name:      %s\n", file.Name)
+		fmt.Printf("Size:      %d (%s)\n", file.Size, progress.FormatBytes(file.Size))
+		fmt.Printf("Owner:     %s\n", file.Owner)
+		fmt.Printf("Tenant:    %s\n", file.TenantID)
+		fmt.Printf("Encrypted: %t\n", file.Encrypted)
+		fmt.Printf("Created:   %s\n", file.CreatedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func runList(ctx context.Context, c *client.Client, args []string) error {
+	flags := newFlagSet("ls", "", "Lists the files you can read, ordered by UUID.")
+	prefix := flags.String("prefix", "", "only list files whose name starts with this prefix")
+	pageSize := flags.Int("page-size", 100, "number of files fetched per request")
+	asJSON := flags.Bool("json", false, "print JSON")
+	flags.Parse(args)
+
+	var files []client.File
+	options := client.ListOptions{Prefix: *prefix, Limit: *pageSize}
+	for {
+		page, next, err := c.List(ctx, options)
+		if err != nil {
+			return err
+		}
+		files = append(files, page...)
+
+		if next == "" {
+			break
+		}
+		options.After = next
+	}
+
+	if *asJSON {
+		return printJSON(files)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UUID\tSIZE\tCREATED\tOWNER\tNAME")
+	for _, file := range files {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", file.FileUUID, file.Size, file.CreatedAt.Format(time.RFC3339), file.Owner, file.Name)
+	}
+
+	return w.Flush()
+}
+
+func runRemove(ctx context.Context, c *client.Client, args []string) error {
+	flags := newFlagSet("rm", "UUID...", "Deletes files.")
+	parallel := flags.Int("parallel", 4, "number of files deleted at a time")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	return runBatch(ctx, flags.Args(), *parallel, c.Delete)
+}
+
+type verifyItem struct {
+	fileUUID string
+	path     string
+}
+
+func (v verifyItem) String() string {
+	return v.fileUUID + " " + v.path
+}
+
+func runVerify(ctx context.Context, c *client.Client, args []string) error {
+	flags := newFlagSet("verify", "UUID PATH [UUID PATH...]", "Downloads files and compares their SHA-256 with that of local copies.")
+	parallel := flags.Int("parallel", 4, "number of files verified at a time")
+	quiet := flags.Bool("quiet", false, "do not show progress")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 || flags.NArg()%2 != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var items []verifyItem
+	for i := 0; i < flags.NArg(); i += 2 {
+		items = append(items, verifyItem{fileUUID: flags.Arg(i), path: flags.Arg(i + 1)})
+	}
+
+	pool := progress.NewPool(os.Stderr, !*quiet)
+
+	var mu sync.Mutex
+	verified := make(map[verifyItem]bool, len(items))
+	err := runBatch(ctx, items, *parallel, func(ctx context.Context, item verifyItem) error {
+		if err := verifyFile(ctx, c, pool, item); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		verified[item] = true
+		mu.Unlock()
+		return nil
+	})
+	pool.Close()
+
+	for _, item := range items {
+		if verified[item] {
+			fmt.Printf("OK\t%s\t%s\n", item.fileUUID, item.path)
+		}
+	}
+
+	return err
+}
+
+func verifyFile(ctx context.Context, c *client.Client, pool *progress.Pool, item verifyItem) error {
+	local, err := os.Open(item.path)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	info, err := local.Stat()
+	if err != nil {
+		return err
+	}
+
+	file, err := c.Stat(ctx, item.fileUUID)
+	if err != nil {
+		return err
+	}
+
+	if file.Size != info.Size() {
+		return errors.Errorf("size differs: stored %d, local %d", file.Size, info.Size())
+	}
+
+	localHash := sha256.New()
+	if _, err := io.Copy(localHash, local); err != nil {
+		return errors.Wrap(err, "hash local file")
+	}
+
+	remoteHash := sha256.New()
+	bar := pool.New(file.Name, file.Size)
+	_, err = c.Download(ctx, item.fileUUID, bar.Writer(remoteHash))
+	bar.Done(err != nil)
+	if err != nil {
+		return err
+	}
+
+	if string(localHash.Sum(nil)) != string(remoteHash.Sum(nil)) {
+		return errors.Errorf("content differs: stored sha256 %x, local %x", remoteHash.Sum(nil), localHash.Sum(nil))
+	}
+
+	return nil
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
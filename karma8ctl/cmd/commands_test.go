@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"karma8/client"
+	"karma8ctl/internal/progress"
+)
+
+func TestLocalName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"2024/05/report.pdf", "report.pdf"},
+		{"/etc/passwd", "passwd"},
+		{"../../secret", "secret"},
+		{"dir/", "dir"},
+		{"", "f-1"},
+		{".", "f-1"},
+		{"..", "f-1"},
+		{"/", "f-1"},
+	}
+
+	for _, tt := range tests {
+		if got := localName(client.File{FileUUID: "f-1", Name: tt.name}); got != tt.want {
+			t.Errorf("localName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadFile_Resume(t *testing.T) {
+	const content = "0123456789"
+
+	tests := []struct {
+		name      string
+		local     *string
+		resume    bool
+		wantRange string
+		wantCalls int32
+	}{
+		{name: "no local file", wantCalls: 1},
+		{name: "partial local file", local: ptr("0123"), resume: true, wantRange: "bytes=4-", wantCalls: 1},
+		{name: "resume turned off", local: ptr("0123"), wantCalls: 1},
+		{name: "complete local file", local: ptr(content), resume: true, wantCalls: 0},
+		{name: "longer local file", local: ptr(content + "extra"), resume: true, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		var (
+			calls    atomic.Int32
+			gotRange atomic.Value
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			gotRange.Store(r.Header.Get("Range"))
+
+			offset := 0
+			if value := r.Header.Get("Range"); value != "" {
+				offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(value, "bytes="), "-"))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+			w.Write([]byte(content[offset:]))
+		}))
+
+		config := client.DefaultConfig()
+		config.URL = server.URL
+		config.RetryBackoff = time.Millisecond
+		c := client.New(config)
+
+		target := filepath.Join(t.TempDir(), "digits.txt")
+		if tt.local != nil {
+			if err := os.WriteFile(target, []byte(*tt.local), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pool := progress.NewPool(os.Stderr, false)
+		file := client.File{FileUUID: "f-1", Name: "digits.txt", Size: int64(len(content))}
+		err := downloadFile(context.Background(), c, pool, file, target, tt.resume)
+		pool.Close()
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: download: %v", tt.name, err)
+			continue
+		}
+
+		data, err := os.ReadFile(target)
+		if err != nil || string(data) != content {
+			t.Errorf("%s: local file = %q, %v, want %q", tt.name, data, err, content)
+		}
+		if calls.Load() != tt.wantCalls {
+			t.Errorf("%s: %d requests, want %d", tt.name, calls.Load(), tt.wantCalls)
+		}
+		if got, _ := gotRange.Load().(string); got != tt.wantRange {
+			t.Errorf("%s: requested range %q, want %q", tt.name, got, tt.wantRange)
+		}
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
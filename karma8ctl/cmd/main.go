@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"karma8/client"
+)
+
+const usage = `karma8ctl talks to the karma8 gateway.
+
+Usage:
+  karma8ctl [global flags] <command> [flags] [arguments]
+
+Commands:
+  upload    upload files, or stdin given as -
+  download  download files, resuming partial downloads
+  stat      show the metadata of files
+  ls        list files
+  rm        delete files
+  verify    download files and compare them with local copies
+
+Global flags:
+`
+
+func main() {
+	global := flag.NewFlagSet("karma8ctl", flag.ExitOnError)
+	gatewayURL := global.String("url", envOr("KARMA8_URL", "http://localhost:8080"), "gateway address (KARMA8_URL)")
+	apiKey := global.String("api-key", os.Getenv("KARMA8_API_KEY"), "API key (KARMA8_API_KEY)")
+	token := global.String("token", os.Getenv("KARMA8_TOKEN"), "bearer token (KARMA8_TOKEN)")
+	global.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		global.PrintDefaults()
+	}
+	global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	config := client.DefaultConfig()
+	config.URL = *gatewayURL
+	config.APIKey = *apiKey
+	config.Token = *token
+	c := client.New(config)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	command, args := global.Arg(0), global.Args()[1:]
+
+	var err error
+	switch command {
+	case "upload":
+		err = runUpload(ctx, c, args)
+	case "download":
+		err = runDownload(ctx, c, args)
+	case "stat":
+		err = runStat(ctx, c, args)
+	case "ls":
+		err = runList(ctx, c, args)
+	case "rm":
+		err = runRemove(ctx, c, args)
+	case "verify":
+		err = runVerify(ctx, c, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		global.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "karma8ctl:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return defaultValue
+}
@@ -0,0 +1,10 @@
+module karma8ctl
+
+go 1.24.3
+
+require (
+	github.com/pkg/errors v0.9.1
+	karma8/client v0.0.0
+)
+
+replace karma8/client => ../client
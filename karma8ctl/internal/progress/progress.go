@@ -0,0 +1,236 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	refreshInterval = 200 * time.Millisecond
+	barWidth        = 30
+	nameWidth       = 24
+)
+
+// Pool renders the progress bars of concurrent transfers. On a terminal the
+// bars of running transfers are redrawn in place; elsewhere, as when stderr
+// is redirected to a file, a line is printed when a transfer ends.
+type Pool struct {
+	out         io.Writer
+	interactive bool
+	disabled    bool
+
+	mu    sync.Mutex
+	bars  []*Bar
+	drawn int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPool returns a pool drawing to out. A disabled pool draws nothing.
+func NewPool(out *os.File, enabled bool) *Pool {
+	interactive := false
+	if info, err := out.Stat(); err == nil {
+		interactive = info.Mode()&os.ModeCharDevice != 0
+	}
+
+	pool := &Pool{
+		out:         out,
+		interactive: interactive,
+		disabled:    !enabled,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if pool.interactive && !pool.disabled {
+		go pool.run()
+	} else {
+		close(pool.done)
+	}
+
+	return pool
+}
+
+// Close draws the final state of the bars and stops redrawing.
+func (p *Pool) Close() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	<-p.done
+}
+
+func (p *Pool) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			p.render()
+			return
+		case <-ticker.C:
+			p.render()
+		}
+	}
+}
+
+// render redraws the running bars. Bars that ended are printed one last time
+// above them and forgotten.
+func (p *Pool) render() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var b strings.Builder
+	if p.drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", p.drawn)
+	}
+
+	running := p.bars[:0]
+	for _, bar := range p.bars {
+		if bar.ended.Load() {
+			b.WriteString("\r\x1b[2K" + bar.line() + "\n")
+		}
+	}
+	for _, bar := range p.bars {
+		if !bar.ended.Load() {
+			b.WriteString("\r\x1b[2K" + bar.line() + "\n")
+			running = append(running, bar)
+		}
+	}
+	p.bars = running
+	p.drawn = len(running)
+
+	io.WriteString(p.out, b.String())
+}
+
+// New adds a bar for a transfer of total bytes. A negative total means the
+// size is unknown.
+func (p *Pool) New(name string, total int64) *Bar {
+	bar := &Bar{pool: p, name: name, total: total, start: time.Now()}
+
+	if p.interactive && !p.disabled {
+		p.mu.Lock()
+		p.bars = append(p.bars, bar)
+		p.mu.Unlock()
+	}
+
+	return bar
+}
+
+// Bar tracks the progress of one transfer.
+type Bar struct {
+	pool    *Pool
+	name    string
+	total   int64
+	start   time.Time
+	current atomic.Int64
+	// initial is the part of the transfer done before it started, as when a
+	// download is resumed, which does not count towards its speed.
+	initial atomic.Int64
+	ended   atomic.Bool
+	failed  atomic.Bool
+}
+
+// Resume marks the first n bytes as transferred before.
+func (b *Bar) Resume(n int64) {
+	b.initial.Store(n)
+	b.current.Store(n)
+}
+
+func (b *Bar) Add(n int64) {
+	b.current.Add(n)
+}
+
+// Set sets the number of bytes transferred, as when a transfer restarts.
+func (b *Bar) Set(n int64) {
+	b.current.Store(n)
+}
+
+// Done ends the bar. failed marks the transfer as failed.
+func (b *Bar) Done(failed bool) {
+	b.failed.Store(failed)
+	if b.ended.Swap(true) {
+		return
+	}
+
+	if !b.pool.interactive && !b.pool.disabled {
+		b.pool.mu.Lock()
+		fmt.Fprintln(b.pool.out, b.line())
+		b.pool.mu.Unlock()
+	}
+}
+
+// Writer counts what is written to w.
+func (b *Bar) Writer(w io.Writer) io.Writer {
+	return &countingWriter{w: w, bar: b}
+}
+
+func (b *Bar) line() string {
+	current := b.current.Load()
+	elapsed := time.Since(b.start).Seconds()
+
+	speed := ""
+	if elapsed > 0 {
+		speed = FormatBytes(int64(float64(current-b.initial.Load())/elapsed)) + "/s"
+	}
+
+	name := b.name
+	if len(name) > nameWidth {
+		name = "…" + name[len(name)-nameWidth+1:]
+	}
+
+	status := ""
+	if b.failed.Load() {
+		status = "  failed"
+	}
+
+	if b.total < 0 {
+		return fmt.Sprintf("%-*s  %10s  %12s%s", nameWidth, name, FormatBytes(current), speed, status)
+	}
+
+	fraction := 1.0
+	if b.total > 0 {
+		fraction = min(float64(current)/float64(b.total), 1)
+	}
+	filled := int(fraction * barWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+
+	return fmt.Sprintf("%-*s  [%s] %3d%%  %10s / %-10s %12s%s",
+		nameWidth, name, bar, int(fraction*100), FormatBytes(current), FormatBytes(b.total), speed, status)
+}
+
+// FormatBytes renders n with a binary unit, such as 1.5 MiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type countingWriter struct {
+	w   io.Writer
+	bar *Bar
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.bar.Add(int64(n))
+	return n, err
+}
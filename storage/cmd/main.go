@@ -2,36 +2,76 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"karma8/common/logging"
+	"karma8/common/security"
+	"karma8/common/server"
+	"karma8/common/tracing"
+	"storage/internal/backend"
+	"storage/internal/config"
 	"storage/internal/handlers"
+	"storage/internal/metrics"
 	"storage/internal/repository"
 	"storage/internal/service"
 
 	"github.com/gorilla/mux"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 func main() {
-	minioClient := initMinIO()
-	bucket := os.Getenv("MINIO_BUCKET")
-	if bucket == "" {
-		bucket = "chunks"
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		logging.Fatal("error loading config", "error", err)
 	}
 
-	repository := repository.NewRepository(minioClient, bucket)
+	if err := logging.Setup(cfg.Log.Level, cfg.Log.Format); err != nil {
+		logging.Fatal("error setting up logging", "error", err)
+	}
+
+	slog.Info("effective config", "config", cfg.Redacted())
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		File:        cfg.Tracing.File,
+		ServiceName: "storage",
+	})
+	if err != nil {
+		logging.Fatal("error setting up tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	repository := repository.NewRepository(newBackend(cfg))
 	storageService := service.NewStorageService(repository)
 	storageHandler := handlers.NewStorageHandler(storageService)
 
 	muxRouter := mux.NewRouter()
 	muxRouter.Use(corsMiddleware)
+	muxRouter.Use(metrics.Middleware)
+	muxRouter.Use(tracing.RouteMiddleware)
+
+	apiRouter := muxRouter.PathPrefix("/api").Subrouter()
+	if cfg.Signing.Secret != "" {
+		apiRouter.Use(security.RequireSignature([]byte(cfg.Signing.Secret), cfg.Signing.MaxSkew))
+	} else {
+		slog.Warn("STORAGE_SIGNING_SECRET is not set, chunk requests are not authenticated")
+	}
+
+	apiRouter.HandleFunc("/chunks/upload", storageHandler.UploadChunk).Methods("POST")
+	apiRouter.HandleFunc("/chunks/download", storageHandler.DownloadChunk).Methods("GET")
+	apiRouter.HandleFunc("/chunks/delete", storageHandler.DeleteChunk).Methods("DELETE")
+	apiRouter.HandleFunc("/chunks", storageHandler.ListChunks).Methods("GET")
+	apiRouter.HandleFunc("/chunks/{uuid}/{index:[0-9]+}", storageHandler.StatChunk).Methods("HEAD")
 
-	muxRouter.HandleFunc("/api/chunks/upload", storageHandler.UploadChunk).Methods("POST")
-	muxRouter.HandleFunc("/api/chunks/download", storageHandler.DownloadChunk).Methods("GET")
+	muxRouter.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	muxRouter.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -39,13 +79,76 @@ func main() {
 		w.Write([]byte(`{"status": "ok"}`))
 	}).Methods("GET")
 
-	port := os.Getenv("HTTP_PORT")
-	if port == "" {
-		port = "8081"
+	// The server span continues the trace propagated by the gateway and the
+	// access log carries the gateway's request ID.
+	httpServer := server.New(":"+cfg.HTTP.Port, otelhttp.NewHandler(logging.Middleware(muxRouter), "storage"), server.Config{
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+		DrainDelay:        cfg.HTTP.DrainDelay,
+		ShutdownTimeout:   cfg.HTTP.ShutdownTimeout,
+	})
+	muxRouter.HandleFunc("/ready", httpServer.Ready).Methods("GET")
+
+	listen := httpServer.ListenAndServe
+	if cfg.TLS.CertFile != "" {
+		reloader, err := security.NewCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			logging.Fatal("error loading TLS certificate", "error", err)
+		}
+
+		httpServer.TLSConfig, err = security.ServerTLSConfig(reloader, cfg.TLS.ClientCAFile)
+		if err != nil {
+			logging.Fatal("error loading TLS client CA", "error", err)
+		}
+
+		listen = func() error {
+			return httpServer.ListenAndServeTLS("", "")
+		}
 	}
 
-	if err := http.ListenAndServe(":"+port, muxRouter); err != nil {
-		log.Fatal("Error starting HTTP server:", err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go reloadOnSignal(ctx, cfg)
+
+	if err := httpServer.Run(ctx, listen); err != nil {
+		logging.Fatal("error running HTTP server", "error", err)
+	}
+}
+
+// reloadOnSignal reloads the config on SIGHUP until ctx is done. Only the log
+// level is applied; an invalid config is rejected and the current one kept.
+func reloadOnSignal(ctx context.Context, current config.Config) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+
+		next, err := config.Load(os.Args[1:])
+		if err != nil {
+			slog.Error("config reload failed, keeping the current config", "error", err)
+			continue
+		}
+
+		if err := logging.SetLevel(next.Log.Level); err != nil {
+			slog.Error("config reload failed, keeping the current config", "error", err)
+			continue
+		}
+
+		if current.RestartRequired(next) {
+			slog.Warn("config changes other than the log level take effect after a restart")
+		}
+
+		current = next
+		slog.Info("reloaded config")
 	}
 }
 
@@ -64,55 +167,56 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func initMinIO() *minio.Client {
-	endpoint := os.Getenv("MINIO_ENDPOINT")
-	if endpoint == "" {
-		endpoint = "minio:9000"
-	}
-
-	accessKeyID := os.Getenv("MINIO_ACCESS_KEY_ID")
-	if accessKeyID == "" {
-		accessKeyID = "minioadmin"
+// newBackend opens the configured storage backend.
+func newBackend(cfg config.Config) backend.Backend {
+	switch cfg.Backend.Type {
+	case "fs":
+		fsBackend, err := backend.NewFS(cfg.Backend.FSRoot)
+		if err != nil {
+			logging.Fatal("error opening fs backend", "error", err)
+		}
+		return fsBackend
+	case "memory":
+		slog.Warn("using the memory backend, chunks are lost when the process exits")
+		return backend.NewMemory()
+	default:
+		return backend.NewMinIO(initMinIO(cfg.MinIO), cfg.MinIO.Bucket)
 	}
+}
 
-	secretAccessKey := os.Getenv("MINIO_SECRET_ACCESS_KEY")
-	if secretAccessKey == "" {
-		secretAccessKey = "minioadmin"
+func initMinIO(cfg config.MinIOConfig) *minio.Client {
+	// Requests to MinIO carry the trace context of the chunk request.
+	transport, err := minio.DefaultTransport(cfg.UseSSL)
+	if err != nil {
+		logging.Fatal("error creating MinIO transport", "error", err)
 	}
 
-	useSSL := false
-
 	var client *minio.Client
-	var err error
 
 	maxRetries := 10
 	for i := range maxRetries {
-		client, err = minio.New(endpoint, &minio.Options{
-			Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-			Secure: useSSL,
+		client, err = minio.New(cfg.Endpoint, &minio.Options{
+			Creds:     credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+			Secure:    cfg.UseSSL,
+			Transport: otelhttp.NewTransport(transport),
 		})
 		if err != nil {
-			log.Printf("Error creating MinIO client (attempt %d/%d): %v", i+1, maxRetries, err)
+			slog.Warn("error creating MinIO client", "attempt", i+1, "max_attempts", maxRetries, "error", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
-		bucketName := os.Getenv("MINIO_BUCKET")
-		if bucketName == "" {
-			bucketName = "chunks"
-		}
-
-		exists, err := client.BucketExists(context.Background(), bucketName)
+		exists, err := client.BucketExists(context.Background(), cfg.Bucket)
 		if err != nil {
-			log.Printf("Error checking bucket existence (attempt %d/%d): %v", i+1, maxRetries, err)
+			slog.Warn("error checking bucket existence", "attempt", i+1, "max_attempts", maxRetries, "error", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
 		if !exists {
-			err = client.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{})
+			err = client.MakeBucket(context.Background(), cfg.Bucket, minio.MakeBucketOptions{})
 			if err != nil {
-				log.Printf("Error creating bucket (attempt %d/%d): %v", i+1, maxRetries, err)
+				slog.Warn("error creating bucket", "attempt", i+1, "max_attempts", maxRetries, "error", err)
 				time.Sleep(2 * time.Second)
 				continue
 			}
@@ -121,6 +225,6 @@ func initMinIO() *minio.Client {
 		return client
 	}
 
-	log.Fatal("Could not connect to MinIO after retries:", err)
+	logging.Fatal("could not connect to MinIO after retries", "error", err)
 	return nil
 }
@@ -0,0 +1,75 @@
+// Package backend stores the objects of a storage node. A node runs on
+// exactly one backend, chosen by configuration.
+package backend
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned for objects the backend does not hold.
+	ErrNotFound = errors.New("object not found")
+	// ErrChecksumMismatch is returned by Put for data that does not match
+	// the checksum it was given.
+	ErrChecksumMismatch = errors.New("object checksum mismatch")
+	// ErrInvalidRange is returned by Get for offsets past the end of the
+	// object.
+	ErrInvalidRange = errors.New("offset past the end of the object")
+)
+
+// ObjectInfo describes a stored object without its data.
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// ETag identifies the object's content. Backends that do not track one
+	// leave it empty.
+	ETag string
+	// Metadata is stored with the object by Put. Keys are lower case.
+	// Listings do not include it.
+	Metadata map[string]string
+}
+
+type Backend interface {
+	// Put stores size bytes read from r and the metadata under name,
+	// replacing any object of that name. Readers see either the old or the
+	// new object, never a partial one. If checksum is set, the data must
+	// have that hex-encoded SHA-256, or Put fails with ErrChecksumMismatch
+	// and leaves the old object in place.
+	Put(ctx context.Context, name string, r io.Reader, size int64, metadata map[string]string, checksum string) (ObjectInfo, error)
+	// Get opens an object for reading from offset and describes all of it
+	// with its metadata. The data read is the one the description is of,
+	// even if the object is replaced meanwhile. The caller closes the
+	// reader.
+	Get(ctx context.Context, name string, offset int64) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, name string) (ObjectInfo, error)
+	// Delete removes an object. Deleting a missing object succeeds.
+	Delete(ctx context.Context, name string) error
+	// List returns up to limit objects whose names start with prefix and
+	// sort after the given name, ordered by name.
+	List(ctx context.Context, prefix string, after string, limit int) ([]ObjectInfo, error)
+}
+
+// checkOffset rejects offsets outside of an object of the given size.
+func checkOffset(name string, offset int64, size int64) error {
+	if offset < 0 || offset > size {
+		return errors.Wrapf(ErrInvalidRange, "offset %d of object %s of %d bytes", offset, name, size)
+	}
+
+	return nil
+}
+
+// validateName rejects names that are empty, hidden or contain path
+// separators, so that every backend accepts the same names.
+func validateName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return errors.Errorf("invalid object name %q", name)
+	}
+
+	return nil
+}
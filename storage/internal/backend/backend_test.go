@@ -0,0 +1,387 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// backends returns a fresh instance of every backend that runs without
+// external services.
+func backends(t *testing.T) map[string]Backend {
+	fsBackend, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("new fs backend: %v", err)
+	}
+
+	return map[string]Backend{
+		"memory": NewMemory(),
+		"fs":     fsBackend,
+	}
+}
+
+func checksum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func put(t *testing.T, b Backend, name string, data string, metadata map[string]string) {
+	t.Helper()
+
+	if _, err := b.Put(context.Background(), name, strings.NewReader(data), int64(len(data)), metadata, ""); err != nil {
+		t.Fatalf("put %s: %v", name, err)
+	}
+}
+
+func get(t *testing.T, b Backend, name string) (string, ObjectInfo) {
+	t.Helper()
+
+	r, info, err := b.Get(context.Background(), name, 0)
+	if err != nil {
+		t.Fatalf("get %s: %v", name, err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+
+	return string(data), info
+}
+
+func TestBackendObjects(t *testing.T) {
+	for backendName, b := range backends(t) {
+		t.Run(backendName, func(t *testing.T) {
+			ctx := context.Background()
+
+			info, err := b.Put(ctx, "abcdef_chunk_0", strings.NewReader("hello"), 5, map[string]string{"codec": "zstd"}, checksum("hello"))
+			if err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if info.Name != "abcdef_chunk_0" || info.Size != 5 {
+				t.Errorf("put returned %+v", info)
+			}
+
+			data, info := get(t, b, "abcdef_chunk_0")
+			if data != "hello" || info.Size != 5 || info.Metadata["codec"] != "zstd" {
+				t.Errorf("get returned %q with %+v", data, info)
+			}
+
+			info, err = b.Stat(ctx, "abcdef_chunk_0")
+			if err != nil || info.Size != 5 || info.Metadata["codec"] != "zstd" {
+				t.Errorf("stat returned %+v, %v", info, err)
+			}
+
+			if err := b.Delete(ctx, "abcdef_chunk_0"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+
+			if _, err := b.Stat(ctx, "abcdef_chunk_0"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("stat after delete: expected ErrNotFound, got %v", err)
+			}
+			if _, _, err := b.Get(ctx, "abcdef_chunk_0", 0); !errors.Is(err, ErrNotFound) {
+				t.Errorf("get after delete: expected ErrNotFound, got %v", err)
+			}
+			if err := b.Delete(ctx, "abcdef_chunk_0"); err != nil {
+				t.Errorf("deleting a missing object: %v", err)
+			}
+		})
+	}
+}
+
+func TestBackendReplace(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		size         int64
+		metadata     map[string]string
+		checksum     string
+		wantErr      error
+		wantData     string
+		wantMetadata map[string]string
+	}{
+		{
+			name:         "new data and metadata",
+			data:         "new",
+			size:         3,
+			metadata:     map[string]string{"codec": "none"},
+			wantData:     "new",
+			wantMetadata: map[string]string{"codec": "none"},
+		},
+		{
+			name:         "metadata dropped",
+			data:         "new",
+			size:         3,
+			wantData:     "new",
+			wantMetadata: map[string]string{},
+		},
+		{
+			name:         "matching checksum",
+			data:         "new",
+			size:         3,
+			checksum:     checksum("new"),
+			wantData:     "new",
+			wantMetadata: map[string]string{},
+		},
+		{
+			name:         "checksum mismatch keeps the old object",
+			data:         "bad",
+			size:         3,
+			metadata:     map[string]string{"codec": "none"},
+			checksum:     checksum("new"),
+			wantErr:      ErrChecksumMismatch,
+			wantData:     "old",
+			wantMetadata: map[string]string{"codec": "zstd"},
+		},
+		{
+			name:         "short data keeps the old object",
+			data:         "ne",
+			size:         3,
+			wantErr:      errors.New("any"),
+			wantData:     "old",
+			wantMetadata: map[string]string{"codec": "zstd"},
+		},
+	}
+
+	for backendName := range backends(t) {
+		for _, tt := range tests {
+			t.Run(backendName+"/"+tt.name, func(t *testing.T) {
+				b := backends(t)[backendName]
+				put(t, b, "abcdef_chunk_1", "old", map[string]string{"codec": "zstd"})
+
+				_, err := b.Put(context.Background(), "abcdef_chunk_1", strings.NewReader(tt.data), tt.size, tt.metadata, tt.checksum)
+				switch {
+				case tt.wantErr == nil && err != nil:
+					t.Fatalf("put: %v", err)
+				case tt.wantErr != nil && err == nil:
+					t.Fatalf("put: expected an error")
+				case errors.Is(tt.wantErr, ErrChecksumMismatch) && !errors.Is(err, ErrChecksumMismatch):
+					t.Fatalf("put: expected ErrChecksumMismatch, got %v", err)
+				}
+
+				data, info := get(t, b, "abcdef_chunk_1")
+				if data != tt.wantData {
+					t.Errorf("got %q, want %q", data, tt.wantData)
+				}
+				if len(info.Metadata) != len(tt.wantMetadata) || info.Metadata["codec"] != tt.wantMetadata["codec"] {
+					t.Errorf("got metadata %v, want %v", info.Metadata, tt.wantMetadata)
+				}
+			})
+		}
+	}
+}
+
+// TestBackendGetIsConsistent checks that an object opened before it is
+// replaced keeps reading the data its metadata describes.
+func TestBackendGetIsConsistent(t *testing.T) {
+	for backendName, b := range backends(t) {
+		t.Run(backendName, func(t *testing.T) {
+			put(t, b, "abcdef_chunk_2", "first", map[string]string{"version": "1"})
+
+			r, info, err := b.Get(context.Background(), "abcdef_chunk_2", 0)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			defer r.Close()
+
+			put(t, b, "abcdef_chunk_2", "second", map[string]string{"version": "2"})
+
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(data) != "first" || info.Metadata["version"] != "1" || info.Size != 5 {
+				t.Errorf("got %q with %+v, want the first version", data, info)
+			}
+		})
+	}
+}
+
+func TestBackendGetFromOffset(t *testing.T) {
+	tests := []struct {
+		offset  int64
+		want    string
+		wantErr bool
+	}{
+		{0, "hello", false},
+		{2, "llo", false},
+		{5, "", false},
+		{6, "", true},
+		{-1, "", true},
+	}
+
+	for backendName, b := range backends(t) {
+		put(t, b, "abcdef_chunk_3", "hello", nil)
+
+		for _, tt := range tests {
+			r, info, err := b.Get(context.Background(), "abcdef_chunk_3", tt.offset)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRange) {
+					t.Errorf("%s: get from %d: expected ErrInvalidRange, got %v", backendName, tt.offset, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: get from %d: %v", backendName, tt.offset, err)
+			}
+
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(data) != tt.want || info.Size != 5 {
+				t.Errorf("%s: get from %d = %q of %d bytes, %v, want %q of 5 bytes", backendName, tt.offset, data, info.Size, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestBackendNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"abcdef_chunk_0", true},
+		{"ab", true},
+		{"a.b", true},
+		{"", false},
+		{".hidden", false},
+		{"..", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"../../etc/passwd", false},
+	}
+
+	for backendName, b := range backends(t) {
+		for _, tt := range tests {
+			_, err := b.Put(context.Background(), tt.name, strings.NewReader("x"), 1, nil, "")
+			if tt.valid && err != nil {
+				t.Errorf("%s: put %q: %v", backendName, tt.name, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("%s: put %q: expected an error", backendName, tt.name)
+			}
+		}
+	}
+}
+
+func TestBackendList(t *testing.T) {
+	// Names spread over shards, including ones too short to be sharded,
+	// which the FS backend keeps apart.
+	names := []string{
+		"00ff_chunk_0", "0a0a_chunk_0", "0a0a_chunk_1", "0a0b_chunk_0",
+		"Z", "_x", "abc", "abcd_chunk_0", "ab", "ff00_chunk_5", "ffff_chunk_0",
+	}
+	sorted := slices.Sorted(slices.Values(names))
+
+	tests := []struct {
+		name   string
+		prefix string
+		after  string
+		limit  int
+		want   []string
+	}{
+		{"everything", "", "", 100, sorted},
+		{"limited", "", "", 3, sorted[:3]},
+		{"after", "", "0a0a_chunk_0", 2, []string{"0a0a_chunk_1", "0a0b_chunk_0"}},
+		{"after a short name", "", "Z", 3, []string{"_x", "ab", "abc"}},
+		{"prefix", "0a0a_", "", 100, []string{"0a0a_chunk_0", "0a0a_chunk_1"}},
+		{"prefix and after", "0a0a_", "0a0a_chunk_0", 100, []string{"0a0a_chunk_1"}},
+		{"short prefix", "ab", "", 100, []string{"ab", "abc", "abcd_chunk_0"}},
+		{"after everything", "", "zzzz", 100, nil},
+		{"no match", "1234", "", 100, nil},
+	}
+
+	for backendName, b := range backends(t) {
+		for _, name := range names {
+			put(t, b, name, "data", map[string]string{"k": "v"})
+		}
+
+		for _, tt := range tests {
+			infos, err := b.List(context.Background(), tt.prefix, tt.after, tt.limit)
+			if err != nil {
+				t.Errorf("%s/%s: list: %v", backendName, tt.name, err)
+				continue
+			}
+
+			var got []string
+			for _, info := range infos {
+				got = append(got, info.Name)
+				if info.Size != 4 {
+					t.Errorf("%s/%s: %s listed with size %d", backendName, tt.name, info.Name, info.Size)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%s/%s: got %v, want %v", backendName, tt.name, got, tt.want)
+			}
+		}
+
+		// Paging through the listing returns every object once, in order.
+		var paged []string
+		after := ""
+		for {
+			infos, err := b.List(context.Background(), "", after, 2)
+			if err != nil {
+				t.Fatalf("%s: list page: %v", backendName, err)
+			}
+			for _, info := range infos {
+				paged = append(paged, info.Name)
+			}
+			if len(infos) < 2 {
+				break
+			}
+			after = infos[len(infos)-1].Name
+		}
+		if !slices.Equal(paged, sorted) {
+			t.Errorf("%s: paged listing %v, want %v", backendName, paged, sorted)
+		}
+	}
+}
+
+func TestFSSharding(t *testing.T) {
+	root := t.TempDir()
+	b, err := NewFS(root)
+	if err != nil {
+		t.Fatalf("new fs backend: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"abcdef_chunk_0", filepath.Join("objects", "ab", "cd", "abcdef_chunk_0")},
+		{"0f1e_chunk_3", filepath.Join("objects", "0f", "1e", "0f1e_chunk_3")},
+		{"abc", filepath.Join("objects", "_", "abc")},
+	}
+
+	for _, tt := range tests {
+		put(t, b, tt.name, tt.name, map[string]string{"k": "v"})
+
+		data, err := os.ReadFile(filepath.Join(root, tt.path))
+		if err != nil || string(data) != tt.name {
+			t.Errorf("%s: expected data in %s, got %q, %v", tt.name, tt.path, data, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(root, tt.path+metaSuffix)); err != nil {
+			t.Errorf("%s: expected metadata next to the data: %v", tt.name, err)
+		}
+	}
+
+	// Metadata files are neither objects nor valid names.
+	if _, err := b.Put(context.Background(), "abcdef_chunk_0"+metaSuffix, bytes.NewReader(nil), 0, nil, ""); err == nil {
+		t.Errorf("expected a name ending in %s to be rejected", metaSuffix)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "tmp"))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected no temporary files left, got %d, %v", len(entries), err)
+	}
+}
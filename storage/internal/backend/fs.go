@@ -0,0 +1,482 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	metaSuffix = ".meta"
+	// shortShard holds the objects whose names are too short to be sharded.
+	shortShard = "_"
+	// lockStripes is how many locks the object names are spread over.
+	lockStripes = 256
+)
+
+// FS stores objects as files below a root directory. Objects live in
+// objects/<aa>/<bb>/<name>, sharded by the first four characters of their
+// name, which for chunks are random hex digits of the file UUID, and their
+// metadata as JSON next to them in <name>.meta. New objects are written to
+// tmp/, synced and renamed into place, so a crash never leaves a partial
+// object behind.
+type FS struct {
+	objectsDir string
+	tmpDir     string
+	// locks make replacing an object's data and metadata atomic to readers
+	// and other writers of the same name.
+	locks [lockStripes]sync.RWMutex
+}
+
+// NewFS prepares the directories below root and removes temporary files left
+// by interrupted uploads.
+func NewFS(root string) (*FS, error) {
+	f := &FS{
+		objectsDir: filepath.Join(root, "objects"),
+		tmpDir:     filepath.Join(root, "tmp"),
+	}
+
+	if err := os.RemoveAll(f.tmpDir); err != nil {
+		return nil, errors.Wrap(err, "clean tmp dir")
+	}
+
+	for _, dir := range []string{f.objectsDir, f.tmpDir} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, errors.Wrap(err, "create dir")
+		}
+	}
+
+	return f, nil
+}
+
+func (f *FS) Put(ctx context.Context, name string, r io.Reader, size int64, metadata map[string]string, checksum string) (ObjectInfo, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	hash := sha256.New()
+	tmpData, err := f.writeTemp(io.TeeReader(io.LimitReader(contextReader{ctx, r}, size), hash), size)
+	if err != nil {
+		return ObjectInfo{}, errors.Wrap(err, "write object")
+	}
+	defer os.Remove(tmpData)
+
+	// The data is only moved into place once it is known to be intact.
+	if actual := hex.EncodeToString(hash.Sum(nil)); checksum != "" && actual != checksum {
+		return ObjectInfo{}, errors.Wrapf(ErrChecksumMismatch, "object %s is %s, expected %s", name, actual, checksum)
+	}
+
+	var tmpMeta string
+	if len(metadata) > 0 {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return ObjectInfo{}, errors.Wrap(err, "encode metadata")
+		}
+
+		tmpMeta, err = f.writeTemp(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return ObjectInfo{}, errors.Wrap(err, "write metadata")
+		}
+		defer os.Remove(tmpMeta)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return ObjectInfo{}, errors.Wrap(err, "create shard dir")
+	}
+
+	lock := f.lock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The old metadata is removed first so that it never describes the new
+	// data. A crash before the new metadata is in place leaves an object
+	// without metadata.
+	if err := os.Remove(path + metaSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, errors.Wrap(err, "remove old metadata")
+	}
+
+	if err := os.Rename(tmpData, path); err != nil {
+		return ObjectInfo{}, errors.Wrap(err, "rename object")
+	}
+
+	if tmpMeta != "" {
+		if err := os.Rename(tmpMeta, path+metaSuffix); err != nil {
+			return ObjectInfo{}, errors.Wrap(err, "rename metadata")
+		}
+	}
+
+	// The renames are only durable once the directory is synced.
+	if err := syncDir(dir); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return f.stat(name, path)
+}
+
+// lock returns the lock of an object name.
+func (f *FS) lock(name string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	return &f.locks[h.Sum32()%lockStripes]
+}
+
+// writeTemp writes exactly size bytes from r to a synced file in the tmp
+// directory and returns its path.
+func (f *FS) writeTemp(r io.Reader, size int64) (string, error) {
+	tmp, err := os.CreateTemp(f.tmpDir, "put-*")
+	if err != nil {
+		return "", errors.Wrap(err, "create temp file")
+	}
+
+	n, err := io.Copy(tmp, r)
+	if err == nil && n != size {
+		err = errors.Errorf("got %d bytes, expected %d", n, size)
+	}
+	if err == nil {
+		err = errors.Wrap(tmp.Sync(), "sync")
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = errors.Wrap(closeErr, "close")
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// Get opens the object's file and reads its metadata under the object's
+// lock. The open file keeps its data when a Put renames another over it.
+func (f *FS) Get(_ context.Context, name string, offset int64) (io.ReadCloser, ObjectInfo, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	lock := f.lock(name)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ObjectInfo{}, errors.Wrapf(ErrNotFound, "object %s", name)
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, errors.Wrap(err, "open object")
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, errors.Wrap(err, "stat object")
+	}
+
+	if err := checkOffset(name, offset, stat.Size()); err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, errors.Wrap(err, "seek object")
+	}
+
+	metadata, err := readMetadata(path + metaSuffix)
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	return file, ObjectInfo{
+		Name:     name,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		Metadata: metadata,
+	}, nil
+}
+
+func (f *FS) Stat(_ context.Context, name string) (ObjectInfo, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	lock := f.lock(name)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return f.stat(name, path)
+}
+
+// stat describes the object stored in path. The caller holds its lock.
+func (f *FS) stat(name string, path string) (ObjectInfo, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, errors.Wrapf(ErrNotFound, "object %s", name)
+	}
+	if err != nil {
+		return ObjectInfo{}, errors.Wrap(err, "stat object")
+	}
+
+	metadata, err := readMetadata(path + metaSuffix)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Name:     name,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Metadata: metadata,
+	}, nil
+}
+
+func readMetadata(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read metadata")
+	}
+
+	var metadata map[string]string
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, errors.Wrap(err, "decode metadata")
+	}
+
+	return metadata, nil
+}
+
+func (f *FS) Delete(_ context.Context, name string) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	lock := f.lock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, p := range []string{path, path + metaSuffix} {
+		err = os.Remove(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.Wrap(err, "remove object")
+		}
+	}
+
+	return nil
+}
+
+// List reads the shard directories in order, which is the order of the
+// names they hold, and stops once it has limit objects. Names too short to
+// be sharded are kept apart and merged in.
+func (f *FS) List(ctx context.Context, prefix string, after string, limit int) ([]ObjectInfo, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	infos, err := f.listShards(ctx, prefix, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	short, err := f.listDir(ctx, filepath.Join(f.objectsDir, shortShard), prefix, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeInfos(infos, short, limit), nil
+}
+
+// listShards lists up to limit objects of the sharded directories.
+func (f *FS) listShards(ctx context.Context, prefix string, after string, limit int) ([]ObjectInfo, error) {
+	outer, err := readDirNames(f.objectsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []ObjectInfo
+	for _, first := range outer {
+		if len(first) != 2 || !shardMayMatch(first, prefix, after) {
+			continue
+		}
+
+		inner, err := readDirNames(filepath.Join(f.objectsDir, first))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, second := range inner {
+			if !shardMayMatch(first+second, prefix, after) {
+				continue
+			}
+
+			page, err := f.listDir(ctx, filepath.Join(f.objectsDir, first, second), prefix, after, limit-len(infos))
+			if err != nil {
+				return nil, err
+			}
+
+			infos = append(infos, page...)
+			if len(infos) == limit {
+				return infos, nil
+			}
+		}
+	}
+
+	return infos, nil
+}
+
+// listDir lists up to limit objects of one directory in order of their
+// names.
+func (f *FS) listDir(ctx context.Context, dir string, prefix string, after string, limit int) ([]ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read shard dir")
+	}
+
+	var infos []ObjectInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, metaSuffix) || !strings.HasPrefix(name, prefix) || name <= after {
+			continue
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "stat object")
+		}
+
+		infos = append(infos, ObjectInfo{
+			Name:    name,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		if len(infos) == limit {
+			break
+		}
+	}
+
+	return infos, nil
+}
+
+// readDirNames returns the names of the subdirectories of dir, sorted.
+func readDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read shard dir")
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// shardMayMatch reports whether names that start with the shard prefix p
+// can start with prefix and sort after after.
+func shardMayMatch(p string, prefix string, after string) bool {
+	if !strings.HasPrefix(p, prefix) && !strings.HasPrefix(prefix, p) {
+		return false
+	}
+
+	return p > after || strings.HasPrefix(after, p)
+}
+
+// mergeInfos merges two lists sorted by name into the first limit objects.
+func mergeInfos(a []ObjectInfo, b []ObjectInfo, limit int) []ObjectInfo {
+	merged := make([]ObjectInfo, 0, min(len(a)+len(b), limit))
+	for len(merged) < limit && (len(a) > 0 || len(b) > 0) {
+		if len(b) == 0 || (len(a) > 0 && a[0].Name < b[0].Name) {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+
+	return merged
+}
+
+// path returns the file an object is stored in. Names that could escape
+// the objects directory, or be taken for metadata, are rejected.
+func (f *FS) path(name string) (string, error) {
+	if err := validateName(name); err != nil {
+		return "", err
+	}
+
+	if strings.HasSuffix(name, metaSuffix) {
+		return "", errors.Errorf("invalid object name %q", name)
+	}
+
+	return filepath.Join(f.objectsDir, shard(name)), nil
+}
+
+// shard returns the path of an object relative to the objects directory.
+func shard(name string) string {
+	if len(name) < 4 {
+		return filepath.Join(shortShard, name)
+	}
+
+	return filepath.Join(name[:2], name[2:4], name)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "open dir")
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "sync dir")
+	}
+
+	return nil
+}
+
+// contextReader stops reading once ctx is done, so that an upload whose
+// request was cancelled does not keep writing.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Memory keeps objects in memory. It is meant for tests and local
+// development; everything is lost when the process exits.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		objects: make(map[string]memoryObject),
+	}
+}
+
+func (m *Memory) Put(_ context.Context, name string, r io.Reader, size int64, metadata map[string]string, checksum string) (ObjectInfo, error) {
+	if err := validateName(name); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return ObjectInfo{}, errors.Wrap(err, "read object")
+	}
+	if int64(len(data)) != size {
+		return ObjectInfo{}, errors.Errorf("object is %d bytes, expected %d", len(data), size)
+	}
+
+	if actual := sha256.Sum256(data); checksum != "" && hex.EncodeToString(actual[:]) != checksum {
+		return ObjectInfo{}, errors.Wrapf(ErrChecksumMismatch, "object %s is %x, expected %s", name, actual, checksum)
+	}
+
+	sum := md5.Sum(data)
+	info := ObjectInfo{
+		Name:     name,
+		Size:     size,
+		ModTime:  time.Now(),
+		ETag:     hex.EncodeToString(sum[:]),
+		Metadata: maps.Clone(metadata),
+	}
+
+	m.mu.Lock()
+	m.objects[name] = memoryObject{data: data, info: info}
+	m.mu.Unlock()
+
+	return info, nil
+}
+
+func (m *Memory) Get(_ context.Context, name string, offset int64) (io.ReadCloser, ObjectInfo, error) {
+	m.mu.RLock()
+	obj, ok := m.objects[name]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ObjectInfo{}, errors.Wrapf(ErrNotFound, "object %s", name)
+	}
+
+	if err := checkOffset(name, offset, obj.info.Size); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	info := obj.info
+	info.Metadata = maps.Clone(info.Metadata)
+
+	// Objects are replaced, never modified, so the data can be shared.
+	return io.NopCloser(bytes.NewReader(obj.data[offset:])), info, nil
+}
+
+func (m *Memory) Stat(_ context.Context, name string) (ObjectInfo, error) {
+	m.mu.RLock()
+	obj, ok := m.objects[name]
+	m.mu.RUnlock()
+	if !ok {
+		return ObjectInfo{}, errors.Wrapf(ErrNotFound, "object %s", name)
+	}
+
+	info := obj.info
+	info.Metadata = maps.Clone(info.Metadata)
+
+	return info, nil
+}
+
+func (m *Memory) Delete(_ context.Context, name string) error {
+	m.mu.Lock()
+	delete(m.objects, name)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Memory) List(_ context.Context, prefix string, after string, limit int) ([]ObjectInfo, error) {
+	m.mu.RLock()
+	var infos []ObjectInfo
+	for name, obj := range m.objects {
+		if strings.HasPrefix(name, prefix) && name > after {
+			info := obj.info
+			info.Metadata = nil
+			infos = append(infos, info)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	if len(infos) > limit {
+		infos = infos[:limit]
+	}
+
+	return infos, nil
+}
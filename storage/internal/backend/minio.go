@@ -0,0 +1,171 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"maps"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+// MinIO stores objects in a bucket of a MinIO or other S3 server.
+type MinIO struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewMinIO(client *minio.Client, bucket string) *MinIO {
+	return &MinIO{
+		client: client,
+		bucket: bucket,
+	}
+}
+
+func (m *MinIO) Put(ctx context.Context, name string, r io.Reader, size int64, metadata map[string]string, checksum string) (ObjectInfo, error) {
+	if err := validateName(name); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	opts := minio.PutObjectOptions{UserMetadata: maps.Clone(metadata)}
+	if checksum != "" {
+		sum, err := hex.DecodeString(checksum)
+		if err != nil {
+			return ObjectInfo{}, errors.Wrapf(ErrChecksumMismatch, "invalid checksum %q", checksum)
+		}
+
+		// The server verifies the checksum before it stores the object.
+		// Multipart uploads only carry checksums of their parts, so the
+		// object is sent in one request.
+		if opts.UserMetadata == nil {
+			opts.UserMetadata = map[string]string{}
+		}
+		opts.UserMetadata["X-Amz-Checksum-Sha256"] = base64.StdEncoding.EncodeToString(sum)
+		opts.DisableMultipart = true
+	}
+
+	info, err := m.client.PutObject(ctx, m.bucket, name, r, size, opts)
+	if code := minio.ToErrorResponse(err).Code; code == "BadDigest" || code == "XAmzContentChecksumMismatch" {
+		return ObjectInfo{}, errors.Wrapf(ErrChecksumMismatch, "object %s: %v", name, err)
+	}
+	if err != nil {
+		return ObjectInfo{}, errors.Wrap(err, "put object")
+	}
+
+	return ObjectInfo{
+		Name:     name,
+		Size:     info.Size,
+		ModTime:  info.LastModified,
+		ETag:     info.ETag,
+		Metadata: metadata,
+	}, nil
+}
+
+// Get describes the object from the response the data is read from. Reads
+// that need another request, as those from an offset do, are made with the
+// object's ETag, so they fail rather than return data of a replacement.
+func (m *MinIO) Get(ctx context.Context, name string, offset int64) (io.ReadCloser, ObjectInfo, error) {
+	obj, err := m.client.GetObject(ctx, m.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, errors.Wrap(err, "get object")
+	}
+
+	// GetObject is lazy; stat it so that a missing object fails here rather
+	// than on the first read.
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, errors.Wrap(notFound(err, name), "get object")
+	}
+
+	if err := checkOffset(name, offset, info.Size); err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	if offset > 0 {
+		if _, err := obj.Seek(offset, io.SeekStart); err != nil {
+			obj.Close()
+			return nil, ObjectInfo{}, errors.Wrap(err, "seek object")
+		}
+	}
+
+	return obj, objectInfo(name, info), nil
+}
+
+func (m *MinIO) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	info, err := m.client.StatObject(ctx, m.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, errors.Wrap(notFound(err, name), "stat object")
+	}
+
+	return objectInfo(name, info), nil
+}
+
+func objectInfo(name string, info minio.ObjectInfo) ObjectInfo {
+	// MinIO returns the keys of user metadata canonicalized as HTTP headers.
+	metadata := make(map[string]string, len(info.UserMetadata))
+	for key, value := range info.UserMetadata {
+		metadata[strings.ToLower(key)] = value
+	}
+
+	return ObjectInfo{
+		Name:     name,
+		Size:     info.Size,
+		ModTime:  info.LastModified,
+		ETag:     info.ETag,
+		Metadata: metadata,
+	}
+}
+
+func (m *MinIO) Delete(ctx context.Context, name string) error {
+	err := m.client.RemoveObject(ctx, m.bucket, name, minio.RemoveObjectOptions{})
+	if err != nil {
+		return errors.Wrap(err, "remove object")
+	}
+
+	return nil
+}
+
+func (m *MinIO) List(ctx context.Context, prefix string, after string, limit int) ([]ObjectInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// S3 lists keys in lexical order; StartAfter makes the listing resume
+	// where the previous page ended.
+	objects := m.client.ListObjects(ctx, m.bucket, minio.ListObjectsOptions{
+		Prefix:     prefix,
+		StartAfter: after,
+		Recursive:  true,
+	})
+
+	var infos []ObjectInfo
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, errors.Wrap(obj.Err, "list objects")
+		}
+
+		infos = append(infos, ObjectInfo{
+			Name:    obj.Key,
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+			ETag:    obj.ETag,
+		})
+		if len(infos) == limit {
+			break
+		}
+	}
+
+	return infos, nil
+}
+
+func notFound(err error, name string) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return errors.Wrapf(ErrNotFound, "object %s", name)
+	}
+
+	return err
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"karma8/common/configload"
+	"karma8/common/server"
+
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	HTTP    HTTPConfig    `yaml:"http"`
+	Backend BackendConfig `yaml:"backend"`
+	MinIO   MinIOConfig   `yaml:"minio"`
+	TLS     TLSConfig     `yaml:"tls"`
+	Signing SigningConfig `yaml:"signing"`
+	Log     LogConfig     `yaml:"log"`
+	Tracing TracingConfig `yaml:"tracing"`
+}
+
+type HTTPConfig struct {
+	Port              string        `yaml:"port" env:"HTTP_PORT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	DrainDelay        time.Duration `yaml:"drain_delay" env:"SHUTDOWN_DRAIN_DELAY"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// BackendConfig selects where chunks are stored: "minio", configured by
+// MinIOConfig, "fs" below FSRoot or "memory", which keeps them only until the
+// process exits.
+type BackendConfig struct {
+	Type   string `yaml:"type" env:"STORAGE_BACKEND"`
+	FSRoot string `yaml:"fs_root" env:"FS_ROOT"`
+}
+
+type MinIOConfig struct {
+	Endpoint        string `yaml:"endpoint" env:"MINIO_ENDPOINT"`
+	AccessKeyID     string `yaml:"access_key_id" env:"MINIO_ACCESS_KEY_ID"`
+	SecretAccessKey string `yaml:"secret_access_key" env:"MINIO_SECRET_ACCESS_KEY" secret:"true"`
+	Bucket          string `yaml:"bucket" env:"MINIO_BUCKET"`
+	UseSSL          bool   `yaml:"use_ssl" env:"MINIO_USE_SSL"`
+}
+
+// TLSConfig enables TLS when CertFile is set and requires client
+// certificates signed by ClientCAFile.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile      string `yaml:"key_file" env:"TLS_KEY_FILE"`
+	ClientCAFile string `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+}
+
+type SigningConfig struct {
+	Secret  string        `yaml:"secret" env:"STORAGE_SIGNING_SECRET" secret:"true"`
+	MaxSkew time.Duration `yaml:"max_skew" env:"STORAGE_SIGNING_MAX_SKEW"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type TracingConfig struct {
+	Exporter string `yaml:"exporter" env:"TRACING_EXPORTER"`
+	File     string `yaml:"file" env:"TRACING_FILE"`
+}
+
+func Default() Config {
+	serverDefaults := server.DefaultConfig()
+
+	return Config{
+		HTTP: HTTPConfig{
+			Port:              "8081",
+			ReadHeaderTimeout: serverDefaults.ReadHeaderTimeout,
+			ReadTimeout:       serverDefaults.ReadTimeout,
+			WriteTimeout:      serverDefaults.WriteTimeout,
+			IdleTimeout:       serverDefaults.IdleTimeout,
+			DrainDelay:        serverDefaults.DrainDelay,
+			ShutdownTimeout:   serverDefaults.ShutdownTimeout,
+		},
+		Backend: BackendConfig{
+			Type: "minio",
+		},
+		MinIO: MinIOConfig{
+			Endpoint:        "minio:9000",
+			AccessKeyID:     "minioadmin",
+			SecretAccessKey: "minioadmin",
+			Bucket:          "chunks",
+		},
+		Signing: SigningConfig{
+			MaxSkew: 5 * time.Minute,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+	}
+}
+
+// Load builds the config from the defaults, the YAML file named by -config
+// or CONFIG_FILE, the environment and the flags in args, and validates it.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+
+	rest, err := configload.Load(&cfg, args, os.Getenv)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if len(rest) > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments %q", rest)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// Validate reports every invalid value at once.
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.HTTP.Port != "", "http.port is required")
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout must be positive")
+
+	switch c.Backend.Type {
+	case "minio":
+		check(c.MinIO.Endpoint != "", "minio.endpoint is required")
+		check(c.MinIO.Bucket != "", "minio.bucket is required")
+	case "fs":
+		check(c.Backend.FSRoot != "", "backend.fs_root is required by the fs backend")
+	case "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("backend.type must be minio, fs or memory, got %q", c.Backend.Type))
+	}
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls: cert_file and key_file must be set together")
+	check(c.TLS.ClientCAFile == "" || c.TLS.CertFile != "", "tls.client_ca_file requires cert_file")
+
+	check(c.Signing.Secret == "" || len(c.Signing.Secret) >= 32, "signing.secret must be at least 32 bytes")
+	check(c.Signing.MaxSkew > 0, "signing.max_skew must be positive")
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("log.level must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format must be json or text, got %q", c.Log.Format)
+
+	switch c.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	case "file":
+		check(c.Tracing.File != "", "tracing.file is required by the file exporter")
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter must be otlp, stdout, file or empty, got %q", c.Tracing.Exporter))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// Redacted renders the config as YAML with secrets hidden, for logging the
+// effective config.
+func (c Config) Redacted() string {
+	return configload.Redacted(&c)
+}
+
+// RestartRequired reports whether next differs from c in settings that are
+// not applied on reload. Only the log level is reloaded; certificates are
+// reloaded from their files on their own.
+func (c Config) RestartRequired(next Config) bool {
+	c.Log.Level = ""
+	next.Log.Level = ""
+	return !reflect.DeepEqual(c, next)
+}
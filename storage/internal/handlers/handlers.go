@@ -1,12 +1,50 @@
 package handlers
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"karma8/common/apierror"
+	"karma8/common/logging"
 	"storage/internal/models"
+	"storage/internal/repository"
 	"storage/internal/service"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Headers carrying the metadata of a chunk, sent by the uploader and returned
+// with downloads and HEAD requests.
+const (
+	ChecksumHeader       = "X-Checksum-SHA256"
+	ChunkCountHeader     = "X-Chunk-Count"
+	ChunkHashHeader      = "X-Chunk-Hash"
+	CodecHeader          = "X-Chunk-Codec"
+	LogicalSizeHeader    = "X-Chunk-Logical-Size"
+	CompressedSizeHeader = "X-Chunk-Compressed-Size"
+	UploadedAtHeader     = "X-Chunk-Uploaded-At"
+	EncryptedKeyHeader   = "X-Chunk-Encrypted-Key"
+	KeyIDHeader          = "X-Chunk-Key-ID"
+	OwnerHeader          = "X-Chunk-Owner"
+)
+
+// maxTokenLength bounds the metadata values that are stored as sent.
+const maxTokenLength = 1024
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 1000
 )
 
 type StorageHandler struct {
@@ -27,19 +65,19 @@ func (h *StorageHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
 
 	fileUUID := r.URL.Query().Get("file_uuid")
 	if fileUUID == "" {
-		http.Error(w, "Missing file_uuid parameter", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Missing file_uuid parameter")
 		return
 	}
 
 	chunkIndexStr := r.URL.Query().Get("chunk_index")
 	if chunkIndexStr == "" {
-		http.Error(w, "Missing chunk_index parameter", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Missing chunk_index parameter")
 		return
 	}
 
 	chunkIndex, err := strconv.ParseInt(chunkIndexStr, 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid chunk_index parameter", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid chunk_index parameter")
 		return
 	}
 
@@ -52,17 +90,27 @@ func (h *StorageHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if contentLength < 0 {
-			http.Error(w, "Content-Length header is required for streaming upload", http.StatusBadRequest)
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Content-Length header is required for streaming upload")
 			return
 		}
 	}
 
-	err = h.storageService.UploadChunkStream(r.Context(), fileUUID, chunkIndex, r.Body, contentLength)
+	metadata, err := parseChunkMetadata(r.Header)
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, err.Error())
+		return
+	}
+
+	logger := logging.FromContext(r.Context()).With("file_uuid", fileUUID, "chunk_index", chunkIndex)
+
+	err = h.storageService.UploadChunkStream(r.Context(), fileUUID, chunkIndex, r.Body, contentLength, metadata)
 	if err != nil {
-		http.Error(w, "Error uploading chunk: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, logger, "Error uploading chunk", err)
 		return
 	}
 
+	logger.Debug("chunk stored", "size", contentLength)
+
 	response := models.UploadResponse{
 		FileUUID:   fileUUID,
 		ChunkIndex: chunkIndex,
@@ -70,7 +118,7 @@ func (h *StorageHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
 
 	responseData, err := json.Marshal(response)
 	if err != nil {
-		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, logger, "Error encoding response", err)
 		return
 	}
 
@@ -81,31 +129,317 @@ func (h *StorageHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
 func (h *StorageHandler) DownloadChunk(w http.ResponseWriter, r *http.Request) {
 	fileUUID := r.URL.Query().Get("file_uuid")
 	if fileUUID == "" {
-		http.Error(w, "Missing file_uuid parameter", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Missing file_uuid parameter")
 		return
 	}
 
 	chunkIndexStr := r.URL.Query().Get("chunk_index")
 	if chunkIndexStr == "" {
-		http.Error(w, "Missing chunk_index parameter", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Missing chunk_index parameter")
 		return
 	}
 
 	chunkIndex, err := strconv.ParseInt(chunkIndexStr, 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid chunk_index parameter", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid chunk_index parameter")
+		return
+	}
+
+	var offset int64
+	if header := r.Header.Get("Range"); header != "" {
+		offset, err = parseRangeStart(header)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid Range header")
+			return
+		}
+	}
+
+	logger := logging.FromContext(r.Context()).With("file_uuid", fileUUID, "chunk_index", chunkIndex)
+
+	info, reader, err := h.storageService.OpenChunk(r.Context(), fileUUID, chunkIndex, offset)
+	if err != nil {
+		writeError(w, logger, "Error downloading chunk", err)
 		return
 	}
+	defer reader.Close()
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", "attachment; filename=chunk_"+strconv.FormatInt(chunkIndex, 10))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size-offset, 10))
 	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	if info.ETag != "" {
+		w.Header().Set("ETag", `"`+info.ETag+`"`)
+	}
+	writeChunkMetadata(w.Header(), info.ChunkMetadata)
+	if offset > 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, info.Size-1, info.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// Once the body has started the status cannot change. Aborting the
+	// connection leaves the client with fewer bytes than announced, so that
+	// a failed or corrupt chunk is never taken for a complete one.
+	if _, err := io.Copy(w, reader); err != nil {
+		logger.Error("chunk download failed", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// parseRangeStart parses a Range header of the form "bytes=N-", the only
+// one chunks are read with, and returns N.
+func parseRangeStart(header string) (int64, error) {
+	value, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, errors.Errorf("unsupported range %q", header)
+	}
+
+	value, ok = strings.CutSuffix(value, "-")
+	if !ok {
+		return 0, errors.Errorf("unsupported range %q", header)
+	}
+
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errors.Errorf("invalid range %q", header)
+	}
+
+	return offset, nil
+}
+
+// StatChunk answers HEAD requests for a chunk with its size, checksum and
+// modification time, so that a chunk can be checked without reading it.
+func (h *StorageHandler) StatChunk(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileUUID := vars["uuid"]
+
+	chunkIndex, err := strconv.ParseInt(vars["index"], 10, 64)
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid chunk index")
+		return
+	}
+
+	info, err := h.storageService.StatChunk(r.Context(), fileUUID, chunkIndex)
+	if err != nil {
+		writeError(w, logging.FromContext(r.Context()).With("file_uuid", fileUUID, "chunk_index", chunkIndex), "Error getting chunk", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	if info.ETag != "" {
+		w.Header().Set("ETag", `"`+info.ETag+`"`)
+	}
+	writeChunkMetadata(w.Header(), info.ChunkMetadata)
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseChunkMetadata reads the metadata headers of an upload. All of them are
+// optional.
+func parseChunkMetadata(header http.Header) (models.ChunkMetadata, error) {
+	metadata := models.ChunkMetadata{
+		Checksum:  strings.ToLower(header.Get(ChecksumHeader)),
+		ChunkHash: strings.ToLower(header.Get(ChunkHashHeader)),
+		Codec:     header.Get(CodecHeader),
+		// The gateway wraps the data key; the node only keeps it.
+		EncryptedKey: header.Get(EncryptedKeyHeader),
+		KeyID:        header.Get(KeyIDHeader),
+		Owner:        header.Get(OwnerHeader),
+	}
+
+	if metadata.Checksum != "" && !isHex(metadata.Checksum, sha256.Size) {
+		return models.ChunkMetadata{}, errors.New("Invalid " + ChecksumHeader + " header")
+	}
+	if metadata.ChunkHash != "" && !isHex(metadata.ChunkHash, md5.Size) {
+		return models.ChunkMetadata{}, errors.New("Invalid " + ChunkHashHeader + " header")
+	}
+	if _, err := base64.StdEncoding.DecodeString(metadata.EncryptedKey); err != nil || !isToken(metadata.EncryptedKey) {
+		return models.ChunkMetadata{}, errors.New("Invalid " + EncryptedKeyHeader + " header")
+	}
+	if (metadata.EncryptedKey == "") != (metadata.KeyID == "") {
+		return models.ChunkMetadata{}, errors.New(EncryptedKeyHeader + " and " + KeyIDHeader + " must be sent together")
+	}
+	for _, field := range []struct {
+		header string
+		value  string
+	}{
+		{KeyIDHeader, metadata.KeyID},
+		{OwnerHeader, metadata.Owner},
+	} {
+		if !isToken(field.value) {
+			return models.ChunkMetadata{}, errors.New("Invalid " + field.header + " header")
+		}
+	}
+
+	for _, field := range []struct {
+		header string
+		value  **int64
+	}{
+		{LogicalSizeHeader, &metadata.LogicalSize},
+		{CompressedSizeHeader, &metadata.CompressedSize},
+	} {
+		value := header.Get(field.header)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return models.ChunkMetadata{}, errors.New("Invalid " + field.header + " header")
+		}
+		*field.value = &n
+	}
 
-	err = h.storageService.DownloadChunkStream(r.Context(), fileUUID, chunkIndex, w)
+	if value := header.Get(ChunkCountHeader); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return models.ChunkMetadata{}, errors.New("Invalid " + ChunkCountHeader + " header")
+		}
+		metadata.NumOfChunks = n
+	}
+
+	return metadata, nil
+}
+
+func writeChunkMetadata(header http.Header, metadata models.ChunkMetadata) {
+	set := func(key string, value string) {
+		if value != "" {
+			header.Set(key, value)
+		}
+	}
+	setInt := func(key string, value *int64) {
+		if value != nil {
+			header.Set(key, strconv.FormatInt(*value, 10))
+		}
+	}
+
+	if metadata.NumOfChunks > 0 {
+		set(ChunkCountHeader, strconv.FormatInt(metadata.NumOfChunks, 10))
+	}
+	set(ChecksumHeader, metadata.Checksum)
+	set(ChunkHashHeader, metadata.ChunkHash)
+	set(CodecHeader, metadata.Codec)
+	setInt(LogicalSizeHeader, metadata.LogicalSize)
+	setInt(CompressedSizeHeader, metadata.CompressedSize)
+	set(EncryptedKeyHeader, metadata.EncryptedKey)
+	set(KeyIDHeader, metadata.KeyID)
+	set(OwnerHeader, metadata.Owner)
+	if !metadata.UploadedAt.IsZero() {
+		set(UploadedAtHeader, metadata.UploadedAt.Format(time.RFC3339Nano))
+	}
+}
+
+func isHex(value string, size int) bool {
+	decoded, err := hex.DecodeString(value)
+	return err == nil && len(decoded) == size
+}
+
+// isToken reports whether value can be stored as sent: backends keep
+// metadata as printable ASCII.
+func isToken(value string) bool {
+	if len(value) > maxTokenLength {
+		return false
+	}
+
+	for i := 0; i < len(value); i++ {
+		if value[i] <= ' ' || value[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ListChunks lists the stored chunks ordered by object name, which for the
+// chunks of one file is not the order of their indexes. It lists the chunks
+// of the file_uuid parameter if set, otherwise all, with their metadata if
+// metadata=true. Pages are continued by passing the next value of the
+// response as after.
+func (h *StorageHandler) ListChunks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxListLimit {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid limit parameter")
+			return
+		}
+		limit = parsed
+	}
+
+	withMetadata := query.Get("metadata") == "true"
+
+	chunks, next, err := h.storageService.ListChunks(r.Context(), query.Get("file_uuid"), query.Get("after"), limit, withMetadata)
+	if err != nil {
+		writeError(w, logging.FromContext(r.Context()), "Error listing chunks", err)
+		return
+	}
+
+	responseData, err := json.Marshal(models.ListChunksResponse{Chunks: chunks, Next: next})
+	if err != nil {
+		writeError(w, logging.FromContext(r.Context()), "Error encoding response", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+func (h *StorageHandler) DeleteChunk(w http.ResponseWriter, r *http.Request) {
+	fileUUID := r.URL.Query().Get("file_uuid")
+	if fileUUID == "" {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Missing file_uuid parameter")
+		return
+	}
+
+	chunkIndexStr := r.URL.Query().Get("chunk_index")
+	if chunkIndexStr == "" {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Missing chunk_index parameter")
+		return
+	}
+
+	chunkIndex, err := strconv.ParseInt(chunkIndexStr, 10, 64)
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidArgument, "Invalid chunk_index parameter")
+		return
+	}
+
+	err = h.storageService.DeleteChunk(r.Context(), fileUUID, chunkIndex)
 	if err != nil {
-		http.Error(w, "Error downloading chunk: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, logging.FromContext(r.Context()).With("file_uuid", fileUUID, "chunk_index", chunkIndex), "Error deleting chunk", err)
 		return
 	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError maps the repository's sentinel errors to HTTP statuses.
+// Unexpected errors are logged and answered with a fixed message.
+func writeError(w http.ResponseWriter, logger *slog.Logger, message string, err error) {
+	status, code := http.StatusInternalServerError, apierror.CodeInternal
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		status, code = http.StatusNotFound, apierror.CodeNotFound
+	case errors.Is(err, repository.ErrChecksumMismatch):
+		status, code = http.StatusBadRequest, apierror.CodeChecksumMismatch
+		logger.Warn(strings.ToLower(message), "error", err)
+	case errors.Is(err, repository.ErrInvalidRange):
+		status, code = http.StatusRequestedRangeNotSatisfiable, apierror.CodeRangeNotSatisfiable
+	case errors.Is(err, repository.ErrMetadataMismatch):
+		status, code = http.StatusConflict, apierror.CodeMetadataMismatch
+		logger.Error(strings.ToLower(message), "error", err)
+	default:
+		logger.Error(strings.ToLower(message), "error", err)
+	}
+
+	if status >= http.StatusInternalServerError {
+		apierror.WriteServerError(w, status, code)
+		return
+	}
+
+	apierror.Write(w, status, code, message+": "+err.Error())
 }
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"karma8/common/response"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_http_requests_total",
+		Help: "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_http_request_duration_seconds",
+		Help:    "Time to handle HTTP requests, including streaming the body, by route and method.",
+		Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method"})
+
+	UploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storage_uploaded_bytes_total",
+		Help: "Bytes of chunks stored.",
+	})
+
+	DownloadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storage_downloaded_bytes_total",
+		Help: "Bytes of chunks served.",
+	})
+
+	backendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_backend_operation_duration_seconds",
+		Help:    "Time of storage backend operations, by operation and result.",
+		Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"operation", "result"})
+)
+
+// ObserveBackend records a backend operation that started at start.
+func ObserveBackend(operation string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	backendDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// Middleware counts requests and their latency by route template. Requests
+// whose handler panicked, as with http.ErrAbortHandler, are counted with the
+// code "aborted".
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		recorder := response.NewRecorder(w)
+		start := time.Now()
+
+		defer func() {
+			aborted := recover()
+
+			code := strconv.Itoa(recorder.Status)
+			if aborted != nil {
+				code = "aborted"
+			}
+			httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+			httpRequests.WithLabelValues(route, r.Method, code).Inc()
+
+			if aborted != nil {
+				panic(aborted)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
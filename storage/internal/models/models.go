@@ -1,6 +1,50 @@
 package models
 
+import "time"
+
 type UploadResponse struct {
 	FileUUID   string `json:"file_uuid"`
 	ChunkIndex int64  `json:"chunk_index"`
 }
+
+// ChunkMetadata is what the gateway tells a node about a chunk when it
+// uploads it. It is stored with the chunk, so that a node's contents describe
+// themselves. Fields the gateway did not send are zero.
+type ChunkMetadata struct {
+	NumOfChunks int64 `json:"num_of_chunks,omitempty"`
+	// Checksum is the hex SHA-256 of the chunk as stored and ChunkHash the
+	// hex MD5 of its original data, before compression and encryption.
+	Checksum  string `json:"checksum_sha256,omitempty"`
+	ChunkHash string `json:"chunk_hash,omitempty"`
+	Codec     string `json:"codec,omitempty"`
+	// LogicalSize is the size of the original data and CompressedSize its
+	// size after compression, before encryption.
+	LogicalSize    *int64 `json:"logical_size,omitempty"`
+	CompressedSize *int64 `json:"compressed_size,omitempty"`
+	// EncryptedKey is the base64 data key of an encrypted file, wrapped with
+	// the gateway's master key KeyID, which the node cannot unwrap. With the
+	// Owner of the file it lets the gateway recover the file from its chunks.
+	EncryptedKey string `json:"encrypted_key,omitempty"`
+	KeyID        string `json:"key_id,omitempty"`
+	Owner        string `json:"owner,omitempty"`
+	// UploadedAt is set by the node when it stores the chunk.
+	UploadedAt time.Time `json:"uploaded_at,omitzero"`
+}
+
+// ChunkInfo describes a stored chunk without its data. Listings only include
+// its metadata when asked to.
+type ChunkInfo struct {
+	FileUUID   string    `json:"file_uuid"`
+	ChunkIndex int64     `json:"chunk_index"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modified_at"`
+	ETag       string    `json:"etag,omitempty"`
+	ChunkMetadata
+}
+
+type ListChunksResponse struct {
+	Chunks []ChunkInfo `json:"chunks"`
+	// Next is passed as after to get the following page. It is empty on the
+	// last page.
+	Next string `json:"next,omitempty"`
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"strconv"
+	"time"
+
+	"storage/internal/models"
+
+	"github.com/pkg/errors"
+)
+
+// Keys of the chunk metadata stored with every object. Backends keep them as
+// user metadata, so values are plain ASCII.
+const (
+	metaFileUUID       = "file-uuid"
+	metaChunkIndex     = "chunk-index"
+	metaNumOfChunks    = "num-of-chunks"
+	metaChecksum       = "checksum-sha256"
+	metaChunkHash      = "chunk-hash"
+	metaCodec          = "codec"
+	metaLogicalSize    = "logical-size"
+	metaCompressedSize = "compressed-size"
+	metaEncryptedKey   = "encrypted-key"
+	metaKeyID          = "key-id"
+	metaOwner          = "owner"
+	metaUploadedAt     = "uploaded-at"
+)
+
+func encodeMetadata(fileUUID string, chunkIndex int64, metadata models.ChunkMetadata) map[string]string {
+	encoded := map[string]string{
+		metaFileUUID:   fileUUID,
+		metaChunkIndex: strconv.FormatInt(chunkIndex, 10),
+		metaUploadedAt: metadata.UploadedAt.Format(time.RFC3339Nano),
+	}
+
+	set := func(key string, value string) {
+		if value != "" {
+			encoded[key] = value
+		}
+	}
+	setInt := func(key string, value *int64) {
+		if value != nil {
+			encoded[key] = strconv.FormatInt(*value, 10)
+		}
+	}
+
+	if metadata.NumOfChunks > 0 {
+		set(metaNumOfChunks, strconv.FormatInt(metadata.NumOfChunks, 10))
+	}
+	set(metaChecksum, metadata.Checksum)
+	set(metaChunkHash, metadata.ChunkHash)
+	set(metaCodec, metadata.Codec)
+	setInt(metaLogicalSize, metadata.LogicalSize)
+	setInt(metaCompressedSize, metadata.CompressedSize)
+	set(metaEncryptedKey, metadata.EncryptedKey)
+	set(metaKeyID, metadata.KeyID)
+	set(metaOwner, metadata.Owner)
+
+	return encoded
+}
+
+// decodeMetadata parses stored metadata. The file UUID and chunk index it
+// records replace the ones given, which are those of the object's name; keys
+// that are missing leave them and the returned fields unset. Invalid values
+// fail with ErrMetadataMismatch.
+func decodeMetadata(encoded map[string]string, fileUUID *string, chunkIndex *int64) (models.ChunkMetadata, error) {
+	var metadata models.ChunkMetadata
+	var err error
+
+	parseInt := func(key string) *int64 {
+		value, ok := encoded[key]
+		if !ok || err != nil {
+			return nil
+		}
+
+		n, parseErr := strconv.ParseInt(value, 10, 64)
+		if parseErr != nil {
+			err = errors.Wrapf(ErrMetadataMismatch, "invalid %s %q", key, value)
+			return nil
+		}
+
+		return &n
+	}
+
+	if value, ok := encoded[metaFileUUID]; ok {
+		*fileUUID = value
+	}
+	if index := parseInt(metaChunkIndex); index != nil {
+		*chunkIndex = *index
+	}
+	if numOfChunks := parseInt(metaNumOfChunks); numOfChunks != nil {
+		metadata.NumOfChunks = *numOfChunks
+	}
+	metadata.LogicalSize = parseInt(metaLogicalSize)
+	metadata.CompressedSize = parseInt(metaCompressedSize)
+	metadata.Checksum = encoded[metaChecksum]
+	metadata.ChunkHash = encoded[metaChunkHash]
+	metadata.Codec = encoded[metaCodec]
+	metadata.EncryptedKey = encoded[metaEncryptedKey]
+	metadata.KeyID = encoded[metaKeyID]
+	metadata.Owner = encoded[metaOwner]
+
+	if value, ok := encoded[metaUploadedAt]; ok && err == nil {
+		metadata.UploadedAt, err = time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			err = errors.Wrapf(ErrMetadataMismatch, "invalid %s %q", metaUploadedAt, value)
+		}
+	}
+
+	if err != nil {
+		return models.ChunkMetadata{}, err
+	}
+
+	return metadata, nil
+}
@@ -2,55 +2,298 @@ package repository
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
 	"strconv"
+	"strings"
+	"time"
+
+	"karma8/common/tracing"
+	"storage/internal/backend"
+	"storage/internal/metrics"
+	"storage/internal/models"
 
-	"github.com/minio/minio-go/v7"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrNotFound is returned for chunks the backend does not hold.
+	ErrNotFound         = backend.ErrNotFound
+	ErrChecksumMismatch = backend.ErrChecksumMismatch
+	// ErrInvalidRange is returned for offsets past the end of a chunk.
+	ErrInvalidRange = backend.ErrInvalidRange
+	// ErrMetadataMismatch is returned for chunks whose stored metadata
+	// describes another chunk or cannot be read.
+	ErrMetadataMismatch = errors.New("chunk metadata mismatch")
 )
 
+const chunkNameSeparator = "_chunk_"
+
 type Repository struct {
-	client *minio.Client
-	bucket string
+	backend backend.Backend
 }
 
-func NewRepository(client *minio.Client, bucket string) *Repository {
+func NewRepository(backend backend.Backend) *Repository {
 	return &Repository{
-		client: client,
-		bucket: bucket,
+		backend: backend,
 	}
 }
 
-func (r *Repository) UploadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, reader io.Reader, contentLength int64) error {
+// startOperation starts the span of a backend operation and returns the
+// function that ends it and records the operation's duration.
+func startOperation(ctx context.Context, operation string, objectName string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Tracer.Start(ctx, "backend."+operation, trace.WithAttributes(attribute.String("backend.object", objectName)))
+
+	return ctx, func(err error) {
+		metrics.ObserveBackend(operation, start, err)
+		tracing.End(span, err)
+	}
+}
+
+// UploadChunkStream stores a chunk with its metadata and the time of the
+// upload. If the metadata holds a checksum, a chunk that does not match it
+// fails with ErrChecksumMismatch and the chunk stored before is kept.
+func (r *Repository) UploadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, reader io.Reader, contentLength int64, metadata models.ChunkMetadata) error {
 	objectName := r.getObjectName(fileUUID, chunkIndex)
 
-	readCloser := io.NopCloser(reader)
+	metadata.UploadedAt = time.Now().UTC()
 
-	_, err := r.client.PutObject(ctx, r.bucket, objectName, readCloser, contentLength, minio.PutObjectOptions{})
+	ctx, done := startOperation(ctx, "put", objectName)
+	info, err := r.backend.Put(ctx, objectName, reader, contentLength, encodeMetadata(fileUUID, chunkIndex, metadata), metadata.Checksum)
+	done(err)
 	if err != nil {
 		return errors.Wrap(err, "put object stream")
 	}
 
+	metrics.UploadedBytes.Add(float64(info.Size))
+
 	return nil
 }
 
-func (r *Repository) DownloadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, writer io.Writer) error {
+// OpenChunk returns the metadata of a chunk and a reader of its data from
+// offset, so that the chunk can be described before it is sent. Both come
+// from the same version of the chunk. The chunk's metadata must describe it,
+// otherwise ErrMetadataMismatch is returned.
+//
+// If the chunk is read from its start and the metadata holds a checksum, the
+// reader fails with ErrChecksumMismatch instead of io.EOF when the data does
+// not match it. By then all of the data has been read, so callers that pass
+// it on must treat the error as fatal and make the receiver discard what it
+// got, as by aborting the response. Data read from an offset is not
+// verified.
+func (r *Repository) OpenChunk(ctx context.Context, fileUUID string, chunkIndex int64, offset int64) (models.ChunkInfo, io.ReadCloser, error) {
 	objectName := r.getObjectName(fileUUID, chunkIndex)
 
-	obj, err := r.client.GetObject(ctx, r.bucket, objectName, minio.GetObjectOptions{})
+	// The operation is timed until the reader is closed.
+	ctx, done := startOperation(ctx, "get", objectName)
+
+	obj, info, err := r.backend.Get(ctx, objectName, offset)
+	if err != nil {
+		done(err)
+		return models.ChunkInfo{}, nil, errors.Wrap(err, "get object")
+	}
+
+	chunk, err := chunkInfo(info)
+	if err == nil && (chunk.FileUUID != fileUUID || chunk.ChunkIndex != chunkIndex) {
+		err = errors.Wrapf(ErrMetadataMismatch, "object %s holds chunk %d of file %s", objectName, chunk.ChunkIndex, chunk.FileUUID)
+	}
 	if err != nil {
-		return errors.Wrap(err, "get object")
+		obj.Close()
+		done(err)
+		return models.ChunkInfo{}, nil, err
+	}
+
+	reader := &chunkReader{
+		obj:        obj,
+		objectName: objectName,
+		size:       info.Size - offset,
+		checksum:   chunk.Checksum,
+		hash:       sha256.New(),
+		done:       done,
+	}
+	if offset > 0 {
+		reader.checksum = ""
+	}
+
+	return chunk, reader, nil
+}
+
+// chunkReader reads a chunk, verifies its checksum at the end and records
+// the operation once closed. The checksum is verified as soon as the last
+// byte is read, and the read that returned it is withheld if the chunk does
+// not match, so that the caller never has all of a corrupt chunk.
+type chunkReader struct {
+	obj        io.ReadCloser
+	objectName string
+	size       int64
+	checksum   string
+	hash       hash.Hash
+	n          int64
+	verified   bool
+	err        error
+	done       func(error)
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.obj.Read(p)
+	c.hash.Write(p[:n])
+
+	if c.checksum != "" && !c.verified && (c.n+int64(n) >= c.size || err == io.EOF) {
+		c.verified = true
+		if actual := hex.EncodeToString(c.hash.Sum(nil)); actual != c.checksum {
+			c.err = errors.Wrapf(ErrChecksumMismatch, "object %s is %s, expected %s", c.objectName, actual, c.checksum)
+			return 0, c.err
+		}
+	}
+
+	c.n += int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
 	}
-	defer obj.Close()
 
-	_, err = io.Copy(writer, obj)
+	return n, err
+}
+
+func (c *chunkReader) Close() error {
+	metrics.DownloadedBytes.Add(float64(c.n))
+	c.done(c.err)
+
+	return c.obj.Close()
+}
+
+// StatChunk returns the size, modification time and metadata of a chunk, or
+// ErrNotFound if it is not stored.
+func (r *Repository) StatChunk(ctx context.Context, fileUUID string, chunkIndex int64) (models.ChunkInfo, error) {
+	objectName := r.getObjectName(fileUUID, chunkIndex)
+
+	ctx, done := startOperation(ctx, "stat", objectName)
+	info, err := r.backend.Stat(ctx, objectName)
+	done(err)
+	if err != nil {
+		return models.ChunkInfo{}, errors.Wrap(err, "stat object")
+	}
+
+	return chunkInfo(info)
+}
+
+// ListChunks returns up to limit chunks ordered by object name, starting
+// after the given name. Only chunks of fileUUID are listed if it is set.
+// Objects that are not chunks are skipped. The chunks' metadata is only read,
+// one object at a time, if withMetadata is set. It also returns the name to
+// list the next page after, or "" if this was the last page.
+func (r *Repository) ListChunks(ctx context.Context, fileUUID string, after string, limit int, withMetadata bool) ([]models.ChunkInfo, string, error) {
+	prefix := ""
+	if fileUUID != "" {
+		prefix = fileUUID + chunkNameSeparator
+	}
+
+	listCtx, done := startOperation(ctx, "list", prefix)
+	infos, err := r.backend.List(listCtx, prefix, after, limit)
+	done(err)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "list objects")
+	}
+
+	chunks := make([]models.ChunkInfo, 0, len(infos))
+	for _, info := range infos {
+		fileUUID, chunkIndex, ok := parseObjectName(info.Name)
+		if !ok {
+			continue
+		}
+
+		if !withMetadata {
+			chunks = append(chunks, models.ChunkInfo{
+				FileUUID:   fileUUID,
+				ChunkIndex: chunkIndex,
+				Size:       info.Size,
+				ModTime:    info.ModTime,
+				ETag:       info.ETag,
+			})
+			continue
+		}
+
+		chunk, err := r.StatChunk(ctx, fileUUID, chunkIndex)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	next := ""
+	if len(infos) == limit {
+		next = infos[len(infos)-1].Name
+	}
+
+	return chunks, next, nil
+}
+
+// chunkInfo describes the chunk stored in an object from its metadata.
+// Chunks stored without metadata are identified by the object's name.
+func chunkInfo(info backend.ObjectInfo) (models.ChunkInfo, error) {
+	chunk := models.ChunkInfo{
+		Size:    info.Size,
+		ModTime: info.ModTime,
+		ETag:    info.ETag,
+	}
+
+	var ok bool
+	chunk.FileUUID, chunk.ChunkIndex, ok = parseObjectName(info.Name)
+	if !ok {
+		return models.ChunkInfo{}, errors.Errorf("object %s is not a chunk", info.Name)
+	}
+
+	var err error
+	chunk.ChunkMetadata, err = decodeMetadata(info.Metadata, &chunk.FileUUID, &chunk.ChunkIndex)
+	if err != nil {
+		return models.ChunkInfo{}, errors.Wrapf(err, "object %s", info.Name)
+	}
+
+	return chunk, nil
+}
+
+// parseObjectName returns the file and index of the chunk stored under name.
+// It returns false if name is not one of a chunk.
+func parseObjectName(name string) (string, int64, bool) {
+	fileUUID, index, ok := strings.Cut(name, chunkNameSeparator)
+	if !ok {
+		return "", 0, false
+	}
+
+	chunkIndex, err := strconv.ParseInt(index, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return fileUUID, chunkIndex, true
+}
+
+// DeleteChunk removes a chunk. Removing a chunk that does not exist succeeds.
+func (r *Repository) DeleteChunk(ctx context.Context, fileUUID string, chunkIndex int64) error {
+	objectName := r.getObjectName(fileUUID, chunkIndex)
+
+	ctx, done := startOperation(ctx, "delete", objectName)
+	err := r.backend.Delete(ctx, objectName)
+	done(err)
 	if err != nil {
-		return errors.Wrap(err, "copy")
+		return errors.Wrap(err, "remove object")
 	}
 
 	return nil
 }
 
 func (r *Repository) getObjectName(fileUUID string, chunkIndex int64) string {
-	return fileUUID + "_chunk_" + strconv.FormatInt(chunkIndex, 10)
+	return fileUUID + chunkNameSeparator + strconv.FormatInt(chunkIndex, 10)
 }
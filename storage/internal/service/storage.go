@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 
+	"storage/internal/models"
 	"storage/internal/repository"
 
 	"github.com/pkg/errors"
@@ -23,8 +24,8 @@ func (s *StorageService) GetRepository() *repository.Repository {
 	return s.repository
 }
 
-func (s *StorageService) UploadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, reader io.Reader, contentLength int64) error {
-	err := s.repository.UploadChunkStream(ctx, fileUUID, chunkIndex, reader, contentLength)
+func (s *StorageService) UploadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, reader io.Reader, contentLength int64, metadata models.ChunkMetadata) error {
+	err := s.repository.UploadChunkStream(ctx, fileUUID, chunkIndex, reader, contentLength, metadata)
 	if err != nil {
 		return errors.Wrap(err, "upload chunk stream")
 	}
@@ -32,10 +33,37 @@ func (s *StorageService) UploadChunkStream(ctx context.Context, fileUUID string,
 	return nil
 }
 
-func (s *StorageService) DownloadChunkStream(ctx context.Context, fileUUID string, chunkIndex int64, writer io.Writer) error {
-	err := s.repository.DownloadChunkStream(ctx, fileUUID, chunkIndex, writer)
+func (s *StorageService) OpenChunk(ctx context.Context, fileUUID string, chunkIndex int64, offset int64) (models.ChunkInfo, io.ReadCloser, error) {
+	info, reader, err := s.repository.OpenChunk(ctx, fileUUID, chunkIndex, offset)
 	if err != nil {
-		return errors.Wrap(err, "download chunk stream")
+		return models.ChunkInfo{}, nil, errors.Wrap(err, "open chunk")
+	}
+
+	return info, reader, nil
+}
+
+func (s *StorageService) StatChunk(ctx context.Context, fileUUID string, chunkIndex int64) (models.ChunkInfo, error) {
+	info, err := s.repository.StatChunk(ctx, fileUUID, chunkIndex)
+	if err != nil {
+		return models.ChunkInfo{}, errors.Wrap(err, "stat chunk")
+	}
+
+	return info, nil
+}
+
+func (s *StorageService) ListChunks(ctx context.Context, fileUUID string, after string, limit int, withMetadata bool) ([]models.ChunkInfo, string, error) {
+	chunks, next, err := s.repository.ListChunks(ctx, fileUUID, after, limit, withMetadata)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "list chunks")
+	}
+
+	return chunks, next, nil
+}
+
+func (s *StorageService) DeleteChunk(ctx context.Context, fileUUID string, chunkIndex int64) error {
+	err := s.repository.DeleteChunk(ctx, fileUUID, chunkIndex)
+	if err != nil {
+		return errors.Wrap(err, "delete chunk")
 	}
 
 	return nil